@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package audit implements a tamper-evident audit log. Each record contains
+// the hash of its predecessor, so removing or changing records breaks the
+// chain, which is detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+var errHashMismatch = errors.New("hash mismatch")
+
+// Record is an entry of the audit log.
+type Record struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+
+	Source        string `json:"source"`
+	UserEntryID   string `json:"user_entry_id,omitempty"`
+	Username      string `json:"username,omitempty"`
+	ActorEntryID  string `json:"actor_entry_id,omitempty"`
+	ActorUsername string `json:"actor_username,omitempty"`
+	ClientID      string `json:"client_id,omitempty"`
+
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+
+	// Prev is the hash of the previous record, empty for the first record
+	// of a chain. Hash is the hash of this record, see Logger.
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// A Writer writes encoded records, one per call.
+type Writer interface {
+	WriteRecord(line []byte) error
+	Close() error
+}
+
+// Logger writes chained records to a Writer. The hash of a record is the
+// SHA-256 of its JSON encoding without hash, or the HMAC-SHA256 when a key is
+// set, which makes the chain impossible to recompute without the key.
+type Logger struct {
+	mutex sync.Mutex
+
+	w   Writer
+	key []byte
+
+	seq  uint64
+	prev string
+}
+
+// New creates a Logger which writes to the provided Writer. The chain
+// continues after the provided last record, if not nil.
+func New(w Writer, key []byte, last *Record) *Logger {
+	l := &Logger{
+		w:   w,
+		key: key,
+	}
+	if last != nil {
+		l.seq = last.Seq
+		l.prev = last.Hash
+	}
+
+	return l
+}
+
+// Log adds the provided record to the chain and writes it. Seq, Prev and Hash
+// of the record are set by Log.
+func (l *Logger) Log(record *Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record.Seq = l.seq + 1
+	record.Prev = l.prev
+	record.Hash = ""
+	sum, err := sign(record, l.key)
+	if err != nil {
+		return err
+	}
+	record.Hash = sum
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err = l.w.WriteRecord(append(line, '\n')); err != nil {
+		return err
+	}
+
+	l.seq = record.Seq
+	l.prev = record.Hash
+
+	return nil
+}
+
+// Close closes the Writer of the accociated Logger.
+func (l *Logger) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.w.Close()
+}
+
+// sign returns the hash of the provided record, which must have no hash set.
+func sign(record *Record, key []byte) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	var h hash.Hash
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify reads JSONL encoded records from the provided reader and checks
+// their chain, starting after the provided last record if not nil. It
+// returns the last valid record and an error for the first record which
+// breaks the chain.
+func Verify(r io.Reader, key []byte, last *Record) (*Record, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var line int
+	for scanner.Scan() {
+		line++
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return last, fmt.Errorf("line %d: %v", line, err)
+		}
+		if last != nil {
+			if record.Seq != last.Seq+1 {
+				return last, fmt.Errorf("line %d: sequence %d does not follow %d", line, record.Seq, last.Seq)
+			}
+			if record.Prev != last.Hash {
+				return last, fmt.Errorf("line %d: chain broken", line)
+			}
+		}
+
+		expected := record.Hash
+		record.Hash = ""
+		sum, err := sign(record, key)
+		if err != nil {
+			return last, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !hmac.Equal([]byte(sum), []byte(expected)) {
+			return last, fmt.Errorf("line %d: %w", line, errHashMismatch)
+		}
+		record.Hash = expected
+		last = record
+	}
+
+	return last, scanner.Err()
+}
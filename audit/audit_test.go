@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bufferWriter struct {
+	bytes.Buffer
+}
+
+func (w *bufferWriter) WriteRecord(line []byte) error {
+	_, err := w.Write(line)
+	return err
+}
+
+func (w *bufferWriter) Close() error {
+	return nil
+}
+
+func testRecord(path string) *Record {
+	return &Record{
+		Time:        time.Date(2020, 3, 1, 12, 0, 0, 123, time.UTC),
+		Source:      "test",
+		UserEntryID: "AAAA",
+		Username:    "user1",
+		Method:      "DELETE",
+		Path:        path,
+		Status:      204,
+	}
+}
+
+func TestChain(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("secret")} {
+		w := &bufferWriter{}
+		l := New(w, key, nil)
+		for _, path := range []string{"/a", "/b", "/c"} {
+			if err := l.Log(testRecord(path)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		data := w.String()
+
+		last, err := Verify(strings.NewReader(data), key, nil)
+		if err != nil {
+			t.Fatalf("valid chain not verified: %v", err)
+		}
+		if last.Seq != 3 || last.Path != "/c" {
+			t.Errorf("unexpected last record: %+v", last)
+		}
+
+		// Changed record.
+		if _, err = Verify(strings.NewReader(strings.Replace(data, `"/b"`, `"/x"`, 1)), key, nil); !errors.Is(err, errHashMismatch) {
+			t.Errorf("changed record not detected: %v", err)
+		}
+		// Removed record.
+		lines := strings.SplitAfter(data, "\n")
+		if _, err = Verify(strings.NewReader(lines[0]+lines[2]), key, nil); err == nil {
+			t.Errorf("removed record not detected")
+		}
+		// Wrong key.
+		if _, err = Verify(strings.NewReader(data), []byte("other"), nil); !errors.Is(err, errHashMismatch) {
+			t.Errorf("wrong key not detected: %v", err)
+		}
+
+		// Continued chain.
+		w.Reset()
+		l = New(w, key, last)
+		if err = l.Log(testRecord("/d")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Verify(w, key, last); err != nil {
+			t.Errorf("continued chain not verified: %v", err)
+		}
+	}
+}
+
+func TestFileWriterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kapi-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	if _, err = NewFileWriter(path, 600, 0); err == nil {
+		t.Error("rotation without rotated files not rejected")
+	}
+
+	w, err := NewFileWriter(path, 600, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(w, nil, nil)
+	for i := 0; i < 10; i++ {
+		if err = l.Log(testRecord("/a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("too many rotated files: %v", err)
+	}
+	var data []byte
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		b, readErr := ioutil.ReadFile(name)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if int64(len(b)) > 600 {
+			t.Errorf("file %s too large: %d", name, len(b))
+		}
+		data = append(data, b...)
+	}
+	// The oldest records are gone, so start after the first remaining one.
+	lines := strings.SplitAfter(string(data), "\n")
+	first, err := Verify(strings.NewReader(lines[0]), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Verify(strings.NewReader(strings.Join(lines[1:], "")), nil, first); err != nil {
+		t.Errorf("chain broken across rotated files: %v", err)
+	}
+
+	// Reopened files continue the chain.
+	w, err = NewFileWriter(path, 600, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := w.Last()
+	if err != nil || last == nil || last.Seq != 10 {
+		t.Fatalf("unexpected last record: %+v %v", last, err)
+	}
+	l = New(w, nil, last)
+	if err = l.Log(testRecord("/b")); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	b, _ := ioutil.ReadFile(path)
+	if _, err = Verify(bytes.NewReader(b), nil, nil); err != nil {
+		t.Errorf("reopened chain not verified: %v", err)
+	}
+}
+
+func TestFileWriterRotationFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kapi-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// A non-empty directory in place of the rotated file makes rotation fail.
+	if err = os.MkdirAll(filepath.Join(path+".1", "blocked"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewFileWriter(path, 300, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := New(w, nil, nil)
+	defer l.Close()
+	failed := 0
+	for i := 0; i < 5; i++ {
+		if err = l.Log(testRecord("/a")); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("expected rotation to fail")
+	}
+
+	// Writing recovers once rotation works again.
+	if err = os.RemoveAll(path + ".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.Log(testRecord("/b")); err != nil {
+		t.Fatalf("writing did not recover: %v", err)
+	}
+	if err = l.Log(testRecord("/c")); err != nil {
+		t.Fatal(err)
+	}
+
+	var data []byte
+	for _, name := range []string{path + ".1", path} {
+		b, readErr := ioutil.ReadFile(name)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		data = append(data, b...)
+	}
+	last, err := Verify(bytes.NewReader(data), nil, nil)
+	if err != nil {
+		t.Fatalf("chain broken by failed rotation: %v", err)
+	}
+	if last == nil || last.Seq != uint64(5-failed+2) || last.Path != "/c" {
+		t.Errorf("unexpected last record: %+v", last)
+	}
+}
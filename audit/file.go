@@ -0,0 +1,199 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileWriter writes records to a JSONL file, which is rotated when it would
+// grow beyond a maximum size. Rotated files get the suffixes .1 (newest) to
+// .<maxFiles>, older files are removed.
+type FileWriter struct {
+	mutex sync.Mutex
+
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+// NewFileWriter opens the file at the provided path for appending, creating
+// it if it does not exist. A maxSize of 0 disables rotation, otherwise at
+// least one rotated file must be kept.
+func NewFileWriter(path string, maxSize int64, maxFiles int) (*FileWriter, error) {
+	if maxSize > 0 && maxFiles < 1 {
+		return nil, fmt.Errorf("invalid number of rotated files %d, at least 1 is required", maxFiles)
+	}
+
+	w := &FileWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *FileWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+
+	return nil
+}
+
+// WriteRecord implements the Writer interface.
+func (w *FileWriter) WriteRecord(line []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return fmt.Errorf("audit log rotation failed: %v", err)
+		}
+	}
+
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+
+	return err
+}
+
+// rotate moves the file to the first rotated file and opens a new file. The
+// current file stays open until the new file is open, so writes continue to
+// work when rotation fails and rotation is retried with the next write.
+func (w *FileWriter) rotate() error {
+	os.Remove(w.rotatedPath(w.maxFiles))
+	for i := w.maxFiles - 1; i > 0; i-- {
+		if err := os.Rename(w.rotatedPath(i), w.rotatedPath(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(w.path, w.rotatedPath(1)); err != nil {
+		return err
+	}
+
+	f := w.f
+	if err := w.open(); err != nil {
+		// Move back, so the file stays the one which is written to.
+		os.Rename(w.rotatedPath(1), w.path)
+		return err
+	}
+
+	return f.Close()
+}
+
+func (w *FileWriter) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
+
+// Last returns the last record which was written to the file of the
+// accociated FileWriter, or to the newest rotated file if the file is empty.
+// It returns nil if there is none.
+func (w *FileWriter) Last() (*Record, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, path := range []string{w.path, w.rotatedPath(1)} {
+		record, err := lastRecord(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Close implements the Writer interface.
+func (w *FileWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+
+	return err
+}
+
+// lastRecord returns the record of the last line of the file at the provided
+// path.
+func lastRecord(path string) (*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	// Records are small, the tail of the file contains the last line.
+	offset := size - 64*1024
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, size-offset)
+	if _, err = f.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if idx := bytes.LastIndexByte(tail, '\n'); idx >= 0 {
+		tail = tail[idx+1:]
+	}
+
+	record := &Record{}
+	if err = json.Unmarshal(tail, record); err != nil {
+		return nil, fmt.Errorf("invalid last record in %s: %v", path, err)
+	}
+
+	return record, nil
+}
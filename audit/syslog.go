@@ -0,0 +1,52 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package audit
+
+import (
+	"bytes"
+	"log/syslog"
+)
+
+// SyslogWriter writes records to the local syslog daemon with facility
+// authpriv, which is meant for security sensitive messages.
+type SyslogWriter struct {
+	w *syslog.Writer
+}
+
+// NewSyslogWriter connects to the local syslog daemon and tags all messages
+// with the provided tag.
+func NewSyslogWriter(tag string) (*SyslogWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogWriter{
+		w: w,
+	}, nil
+}
+
+// WriteRecord implements the Writer interface.
+func (w *SyslogWriter) WriteRecord(line []byte) error {
+	return w.w.Info(string(bytes.TrimRight(line, "\n")))
+}
+
+// Close implements the Writer interface.
+func (w *SyslogWriter) Close() error {
+	return w.w.Close()
+}
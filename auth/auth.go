@@ -19,6 +19,7 @@ package auth
 
 import (
 	"context"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	kcoidc "stash.kopano.io/kc/libkcoidc"
@@ -36,6 +37,16 @@ type Record struct {
 
 	StandardClaims *jwt.StandardClaims
 	ExtraClaims    *kcoidc.ExtraClaimsWithType
+
+	// ServicePrincipal is set if the record was authenticated with a client
+	// credentials token. AuthenticatedUserID then is the client ID.
+	ServicePrincipal *ServicePrincipal
+}
+
+// Expired returns true if the access token of the accociated record has
+// expired at the provided time.
+func (r *Record) Expired(now time.Time) bool {
+	return r.StandardClaims != nil && !r.StandardClaims.VerifyExpiresAt(now.Unix(), false)
 }
 
 // AuthenticatedUserIDFromContext returns the provided requests authentication
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+)
+
+// AuthorizedPartyClaim is the claim which identifies the client to which a
+// token was issued.
+const AuthorizedPartyClaim = "azp"
+
+// ServicePrincipal is a machine client which authenticates with tokens of the
+// OAuth2 client credentials grant, instead of a user.
+type ServicePrincipal struct {
+	ClientID string `json:"-"`
+
+	// Scopes are the scopes which the client is allowed to use.
+	Scopes []string `json:"scopes"`
+	// Plugins are the IDs of the plugins which the client is allowed to
+	// access. The ID `*` allows all plugins.
+	Plugins []string `json:"plugins"`
+}
+
+// AllowsScopes returns true if the accociated service principal is allowed to
+// use all of the provided scopes.
+func (sp *ServicePrincipal) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !containsString(sp.Scopes, scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AllowsPlugin returns true if the accociated service principal is allowed to
+// access the plugin with the provided ID.
+func (sp *ServicePrincipal) AllowsPlugin(id string) bool {
+	return id != "" && (containsString(sp.Plugins, "*") || containsString(sp.Plugins, id))
+}
+
+// ServicePrincipals maps client IDs to their service principal.
+type ServicePrincipals map[string]*ServicePrincipal
+
+// LoadServicePrincipals loads service principals from the JSON file with the
+// provided name. The file contains a `clients` object with the client IDs as
+// keys.
+func LoadServicePrincipals(fn string) (ServicePrincipals, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Clients ServicePrincipals `json:"clients"`
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse service clients: %v", err)
+	}
+	for clientID, sp := range config.Clients {
+		if clientID == "" || sp == nil {
+			return nil, fmt.Errorf("invalid service client %q", clientID)
+		}
+		sp.ClientID = clientID
+	}
+
+	return config.Clients, nil
+}
+
+// ClientIDFromClaims returns the ID of the client to which the token with the
+// provided claims was issued.
+func ClientIDFromClaims(audience string, claims *kcoidc.ExtraClaimsWithType) string {
+	if claims != nil {
+		if azp, _ := (*claims)[AuthorizedPartyClaim].(string); azp != "" {
+			return azp
+		}
+	}
+
+	return audience
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+)
+
+func TestServicePrincipals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kapi-auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "clients.json")
+	err = ioutil.WriteFile(fn, []byte(`{"clients":{
+		"backup":{"scopes":["kopano/kvs"],"plugins":["kvs"]},
+		"admin":{"scopes":["kopano/gc","kopano/gc.impersonate"],"plugins":["*"]}
+	}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servicePrincipals, err := LoadServicePrincipals(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup := servicePrincipals["backup"]
+	if backup == nil || backup.ClientID != "backup" {
+		t.Fatalf("unexpected service principal: %v", backup)
+	}
+	if !backup.AllowsPlugin("kvs") || backup.AllowsPlugin("grapi") || backup.AllowsPlugin("") {
+		t.Errorf("unexpected plugins allowed for backup")
+	}
+	if !backup.AllowsScopes([]string{"kopano/kvs"}) || backup.AllowsScopes([]string{"kopano/kvs", "kopano/gc"}) {
+		t.Errorf("unexpected scopes allowed for backup")
+	}
+	if admin := servicePrincipals["admin"]; !admin.AllowsPlugin("grapi") || admin.AllowsPlugin("") {
+		t.Errorf("unexpected plugins allowed for admin")
+	}
+
+	if clientID := ClientIDFromClaims("aud", &kcoidc.ExtraClaimsWithType{AuthorizedPartyClaim: "azp"}); clientID != "azp" {
+		t.Errorf("expected client ID from azp claim, got %s", clientID)
+	}
+	if clientID := ClientIDFromClaims("aud", nil); clientID != "aud" {
+		t.Errorf("expected client ID from audience, got %s", clientID)
+	}
+}
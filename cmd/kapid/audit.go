@@ -0,0 +1,80 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"stash.kopano.io/kc/kapi/audit"
+)
+
+func commandAuditVerify() *cobra.Command {
+	auditVerifyCmd := &cobra.Command{
+		Use:   "audit-verify [audit-log-file...]",
+		Short: "Verify the hash chain of audit log files",
+		Long:  "Verify the hash chain of audit log files. Rotated files are given oldest first, like audit.jsonl.2 audit.jsonl.1 audit.jsonl.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := auditVerify(cmd, args); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	auditVerifyCmd.Flags().String("key-file", "", "Path to the file with the key of the audit log")
+
+	return auditVerifyCmd
+}
+
+func auditVerify(cmd *cobra.Command, args []string) error {
+	var key []byte
+	if fn, _ := cmd.Flags().GetString("key-file"); fn != "" {
+		var err error
+		if key, err = ioutil.ReadFile(fn); err != nil {
+			return fmt.Errorf("failed to read key file: %v", err)
+		}
+		key = bytes.TrimSpace(key)
+	}
+
+	var last *audit.Record
+	for _, fn := range args {
+		f, err := os.Open(fn)
+		if err != nil {
+			return err
+		}
+		last, err = audit.Verify(f, key, last)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+
+	if last == nil {
+		fmt.Fprint(os.Stdout, "audit log is empty\n")
+		return nil
+	}
+	fmt.Fprintf(os.Stdout, "audit log verified up to record %d\n", last.Seq)
+
+	return nil
+}
@@ -21,5 +21,7 @@ import (
 	// Add plugins here to make them available.
 	_ "stash.kopano.io/kc/kapi/plugins/grapi"
 	_ "stash.kopano.io/kc/kapi/plugins/kvs"
+	_ "stash.kopano.io/kc/kapi/plugins/proxy"
 	_ "stash.kopano.io/kc/kapi/plugins/pubs"
+	_ "stash.kopano.io/kc/kapi/plugins/static"
 )
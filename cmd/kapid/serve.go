@@ -53,7 +53,7 @@ func commandServe() *cobra.Command {
 		},
 	}
 	serveCmd.Flags().String("listen", defaultListenAddr, "TCP listen address")
-	serveCmd.Flags().String("plugins-path", "", "Historic unused parameter")
+	serveCmd.Flags().String("plugins-path", "", "Path to a folder containing external plugin manifests")
 	serveCmd.Flags().String("plugins", "", "Enabled plugin IDs. When empty, all found plugins are enabled. Separate multiple IDs with comma.")
 	serveCmd.Flags().String("iss", "", "OIDC issuer URL")
 	serveCmd.Flags().Bool("insecure", false, "Disable TLS certificate and hostname validation")
@@ -80,6 +80,7 @@ func serve(cmd *cobra.Command, args []string) error {
 	logger.Infoln("serve start")
 
 	listenAddr, _ := cmd.Flags().GetString("listen")
+	pluginsPath, _ := cmd.Flags().GetString("plugins-path")
 
 	enabledPlugins := make([]string, 0)
 	if pluginsString, strErr := cmd.Flags().GetString("plugins"); strErr == nil && pluginsString != "" {
@@ -134,6 +135,11 @@ func serve(cmd *cobra.Command, args []string) error {
 		},
 	}
 
+	srv, err := server.NewServer(listenAddr, pluginsPath, iss, enabledPlugins, logger, client, nil)
+	if err != nil {
+		return err
+	}
+
 	// Metrics support.
 	withMetrics, _ := cmd.Flags().GetBool("with-metrics")
 	metricsListenAddr, _ := cmd.Flags().GetString("metrics-listen")
@@ -143,6 +149,7 @@ func serve(cmd *cobra.Command, args []string) error {
 			handler := http.NewServeMux()
 			logger.WithField("listenAddr", metricsListen).Infoln("metrics enabled, starting listener")
 			handler.Handle("/metrics", promhttp.Handler())
+			handler.HandleFunc("/health-report", srv.HealthReportHandler)
 			listenErr := http.ListenAndServe(metricsListen, handler)
 			if listenErr != nil {
 				logger.WithError(listenErr).Errorln("unable to start metrics listener")
@@ -150,11 +157,6 @@ func serve(cmd *cobra.Command, args []string) error {
 		}()
 	}
 
-	srv, err := server.NewServer(listenAddr, "", iss, enabledPlugins, logger, client)
-	if err != nil {
-		return err
-	}
-
 	// Profiling support.
 	withPprof, _ := cmd.Flags().GetBool("with-pprof")
 	pprofListenAddr, _ := cmd.Flags().GetString("pprof-listen")
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var pathParameterRegexp = regexp.MustCompile(`{[^}]+}`)
+
+type operation struct {
+	method string
+	path   string
+	req    *http.Request
+}
+
+func (doc *Document) operations() ([]*operation, error) {
+	operations := make([]*operation, 0)
+	for path, item := range doc.Paths {
+		// Replace all path parameters with a sample value.
+		samplePath := pathParameterRegexp.ReplaceAllString(path, "sample")
+		for _, method := range item.Methods() {
+			req, err := http.NewRequest(strings.ToUpper(method), samplePath, nil)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path %s: %v", path, err)
+			}
+			operations = append(operations, &operation{
+				method: strings.ToUpper(method),
+				path:   path,
+				req:    req,
+			})
+		}
+	}
+
+	return operations, nil
+}
+
+// VerifyRouter checks that the accociated Document and the routes of the
+// provided router describe the same API. Every operation of the document must
+// be routed and every route with a handler must be described by at least one
+// operation for each of its methods.
+func (doc *Document) VerifyRouter(router *mux.Router) error {
+	operations, err := doc.operations()
+	if err != nil {
+		return err
+	}
+
+	problems := make([]string, 0)
+
+	for _, op := range operations {
+		var match mux.RouteMatch
+		if !router.Match(op.req, &match) || match.MatchErr != nil {
+			problems = append(problems, fmt.Sprintf("operation %s %s has no route", op.method, op.path))
+		}
+	}
+
+	err = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil
+		}
+		template, templateErr := route.GetPathTemplate()
+		if templateErr != nil {
+			return templateErr
+		}
+		methods, _ := route.GetMethods()
+		if len(methods) == 0 {
+			// Routes without method matcher must be described at least once.
+			methods = []string{""}
+		}
+		for _, method := range methods {
+			found := false
+			for _, op := range operations {
+				if method != "" && op.method != method {
+					continue
+				}
+				var match mux.RouteMatch
+				if route.Match(op.req, &match) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				if method == "" {
+					method = "*"
+				}
+				problems = append(problems, fmt.Sprintf("route %s %s is not described", method, template))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("OpenAPI document and router disagree:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+
+	return nil
+}
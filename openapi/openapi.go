@@ -0,0 +1,202 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/template"
+)
+
+// Version is the OpenAPI specification version of the documents created
+// by this package.
+const Version = "3.0.3"
+
+// Methods is the list of path item fields which are operations.
+var Methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// Document is an OpenAPI 3 document. Only the parts required to merge
+// document fragments are typed, everything else is kept as raw JSON.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       *Info               `json:"info,omitempty"`
+	Servers    []json.RawMessage   `json:"servers,omitempty"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components *Components         `json:"components,omitempty"`
+	Security   []json.RawMessage   `json:"security,omitempty"`
+	Tags       []json.RawMessage   `json:"tags,omitempty"`
+}
+
+// Info is the OpenAPI info object.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// PathItem is an OpenAPI path item, mapping operation methods and other
+// fields to their raw JSON values.
+type PathItem map[string]json.RawMessage
+
+// Components is the OpenAPI components object.
+type Components struct {
+	Schemas         map[string]json.RawMessage `json:"schemas,omitempty"`
+	Responses       map[string]json.RawMessage `json:"responses,omitempty"`
+	Parameters      map[string]json.RawMessage `json:"parameters,omitempty"`
+	RequestBodies   map[string]json.RawMessage `json:"requestBodies,omitempty"`
+	Headers         map[string]json.RawMessage `json:"headers,omitempty"`
+	SecuritySchemes map[string]json.RawMessage `json:"securitySchemes,omitempty"`
+}
+
+// New creates a new empty Document with the provided info.
+func New(info *Info) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]PathItem),
+	}
+}
+
+// Parse parses the provided JSON data as Document.
+func Parse(data []byte) (*Document, error) {
+	doc := &Document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document: %v", err)
+	}
+	if doc.Paths == nil {
+		doc.Paths = make(map[string]PathItem)
+	}
+
+	return doc, nil
+}
+
+// TemplateFuncs are the functions available in templates executed with
+// Execute. Use json to encode any value as JSON.
+var TemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Execute executes the provided template with the provided data and parses
+// the result as Document. This allows plugins to inject runtime configuration
+// like required scopes into their static API descriptions.
+func Execute(tmpl *template.Template, data interface{}) (*Document, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return Parse(buf.Bytes())
+}
+
+// Methods returns the sorted operation methods of the accociated path item.
+func (item PathItem) Methods() []string {
+	methods := make([]string, 0, len(item))
+	for _, method := range Methods {
+		if _, ok := item[method]; ok {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+
+	return methods
+}
+
+// Merge merges the provided fragment into the accociated Document. Paths must
+// be unique, components with the same name must be equal.
+func (doc *Document) Merge(fragment *Document) error {
+	for path, item := range fragment.Paths {
+		if _, exists := doc.Paths[path]; exists {
+			return fmt.Errorf("duplicate path %s", path)
+		}
+		doc.Paths[path] = item
+	}
+
+	if fragment.Components != nil {
+		if doc.Components == nil {
+			doc.Components = &Components{}
+		}
+		for _, m := range []struct {
+			name string
+			dst  *map[string]json.RawMessage
+			src  map[string]json.RawMessage
+		}{
+			{"schemas", &doc.Components.Schemas, fragment.Components.Schemas},
+			{"responses", &doc.Components.Responses, fragment.Components.Responses},
+			{"parameters", &doc.Components.Parameters, fragment.Components.Parameters},
+			{"requestBodies", &doc.Components.RequestBodies, fragment.Components.RequestBodies},
+			{"headers", &doc.Components.Headers, fragment.Components.Headers},
+			{"securitySchemes", &doc.Components.SecuritySchemes, fragment.Components.SecuritySchemes},
+		} {
+			if err := mergeRawMap(m.dst, m.src); err != nil {
+				return fmt.Errorf("components %s: %v", m.name, err)
+			}
+		}
+	}
+
+	for _, tag := range fragment.Tags {
+		if !containsRaw(doc.Tags, tag) {
+			doc.Tags = append(doc.Tags, tag)
+		}
+	}
+
+	return nil
+}
+
+func mergeRawMap(dst *map[string]json.RawMessage, src map[string]json.RawMessage) error {
+	if len(src) == 0 {
+		return nil
+	}
+	if *dst == nil {
+		*dst = make(map[string]json.RawMessage)
+	}
+	for name, value := range src {
+		if existing, exists := (*dst)[name]; exists {
+			if !equalRaw(existing, value) {
+				return fmt.Errorf("conflicting definitions for %s", name)
+			}
+			continue
+		}
+		(*dst)[name] = value
+	}
+
+	return nil
+}
+
+func containsRaw(list []json.RawMessage, value json.RawMessage) bool {
+	for _, v := range list {
+		if equalRaw(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equalRaw(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
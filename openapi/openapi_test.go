@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package openapi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func mustParse(t *testing.T, data string) *Document {
+	doc, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestMerge(t *testing.T) {
+	doc := New(&Info{Title: "test", Version: "0"})
+
+	err := doc.Merge(mustParse(t, `{
+		"paths": {"/a": {"get": {}}},
+		"components": {"schemas": {"s": {"type": "string"}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = doc.Merge(mustParse(t, `{
+		"paths": {"/b": {"get": {}, "put": {}}},
+		"components": {"schemas": {"s": {"type":"string"}}}
+	}`))
+	if err != nil {
+		t.Fatalf("equal component must merge: %v", err)
+	}
+	if len(doc.Paths) != 2 {
+		t.Fatalf("unexpected number of paths: %d", len(doc.Paths))
+	}
+
+	if err = doc.Merge(mustParse(t, `{"paths": {"/a": {"post": {}}}}`)); err == nil {
+		t.Fatal("duplicate path must fail to merge")
+	}
+	if err = doc.Merge(mustParse(t, `{"components": {"schemas": {"s": {"type": "number"}}}}`)); err == nil {
+		t.Fatal("conflicting component must fail to merge")
+	}
+}
+
+func TestVerifyRouter(t *testing.T) {
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	router := mux.NewRouter()
+	router.Handle("/items/{id}", handler).Methods(http.MethodGet, http.MethodDelete)
+	router.PathPrefix("/blobs/").Handler(handler)
+
+	doc := mustParse(t, `{"paths": {
+		"/items/{id}": {"get": {}, "delete": {}},
+		"/blobs/{key}": {"get": {}}
+	}}`)
+	if err := doc.VerifyRouter(router); err != nil {
+		t.Fatal(err)
+	}
+
+	doc = mustParse(t, `{"paths": {
+		"/items/{id}": {"get": {}},
+		"/blobs/{key}": {"get": {}},
+		"/other": {"get": {}}
+	}}`)
+	if err := doc.VerifyRouter(router); err == nil {
+		t.Fatal("missing and undescribed routes must fail verification")
+	}
+}
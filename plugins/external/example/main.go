@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Command example is an example external plugin for Kopano API.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"stash.kopano.io/kc/kapi/plugins/external/protocol"
+)
+
+func main() {
+	listener, err := protocol.Listen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("/health-check", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	router.HandleFunc("/api/example-external/v1/hello", func(rw http.ResponseWriter, req *http.Request) {
+		authRecord, authErr := protocol.AuthRecordFromRequest(req)
+		if authErr != nil || authRecord == nil {
+			http.Error(rw, "", http.StatusForbidden)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"plugin": os.Getenv(protocol.IDEnvName),
+			"user":   authRecord.AuthenticatedUserID,
+		})
+	})
+	router.HandleFunc("/api/example-external/v1/public/info", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"plugin": os.Getenv(protocol.IDEnvName),
+			"pid":    os.Getpid(),
+		})
+	})
+
+	srv := &http.Server{
+		Handler: router,
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	if err = srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+var exampleBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "kapi-external-test")
+	if err != nil {
+		fmt.Printf("failed to create temporary directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Build the example plugin, used as external plugin process in tests.
+	exampleBinary = filepath.Join(dir, "example-external")
+	build := exec.Command("go", "build", "-o", exampleBinary, "./example")
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err = build.Run(); err != nil {
+		fmt.Printf("failed to build example plugin: %v\n", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestPlugin initializes an ExternalPlugin of the example plugin, with
+// the manifest changed by the provided function if not nil.
+func newTestPlugin(t *testing.T, configure func(*Manifest)) (*ExternalPlugin, func()) {
+	dir, err := ioutil.TempDir("", "kapi-external-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := &Manifest{
+		ID:      "example-external",
+		Command: []string{exampleBinary},
+		Socket:  filepath.Join(dir, "example.sock"),
+		Routes: []*Route{
+			{Prefix: "/api/example-external/v1/"},
+			{Prefix: "/api/example-external/v1/public/", Public: true},
+		},
+		HealthCheck: &HealthCheck{
+			Interval: Duration(50 * time.Millisecond),
+		},
+		RestartDelay: Duration(10 * time.Millisecond),
+	}
+	if configure != nil {
+		configure(manifest)
+	}
+	if err = manifest.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := pluginstest.NewServer()
+	srv.Records["test"] = &auth.Record{
+		AuthenticatedUserID: "user1",
+		StandardClaims: &jwt.StandardClaims{
+			Subject: "user1",
+		},
+	}
+
+	p := New(manifest)
+	if err = p.Initialize(context.Background(), make(chan error, 1), srv); err != nil {
+		t.Fatal(err)
+	}
+
+	return p, func() {
+		p.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func waitHealthy(t *testing.T, p *ExternalPlugin) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !p.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin did not become healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func request(t *testing.T, p *ExternalPlugin, path string, token string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	handled, err := p.ServeHTTP(rw, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handled {
+		return http.StatusNotFound, nil
+	}
+
+	var data map[string]interface{}
+	if rw.Code == http.StatusOK {
+		if err = json.Unmarshal(rw.Body.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rw.Code, data
+}
+
+func TestForwardWithAuthRecord(t *testing.T) {
+	p, cleanup := newTestPlugin(t, nil)
+	defer cleanup()
+	waitHealthy(t, p)
+
+	if status, _ := request(t, p, "/api/other/v1/hello", "test"); status != http.StatusNotFound {
+		t.Errorf("unexpected status for unrelated route: %d", status)
+	}
+
+	if status, _ := request(t, p, "/api/example-external/v1/hello", ""); status != http.StatusForbidden {
+		t.Errorf("unexpected status without token: %d", status)
+	}
+
+	status, data := request(t, p, "/api/example-external/v1/hello", "test")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if data["user"] != "user1" || data["plugin"] != "example-external" {
+		t.Errorf("unexpected response: %v", data)
+	}
+
+	if status, _ := request(t, p, "/api/example-external/v1/public/info", ""); status != http.StatusOK {
+		t.Errorf("unexpected status for public route: %d", status)
+	}
+}
+
+func TestRestartOnExit(t *testing.T) {
+	p, cleanup := newTestPlugin(t, nil)
+	defer cleanup()
+	waitHealthy(t, p)
+
+	status, data := request(t, p, "/api/example-external/v1/public/info", "")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	pid := int(data["pid"].(float64))
+
+	if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			t.Fatal("plugin process was not restarted")
+		}
+		time.Sleep(50 * time.Millisecond)
+		if !p.Healthy() {
+			continue
+		}
+		status, data = request(t, p, "/api/example-external/v1/public/info", "")
+		if status == http.StatusOK && int(data["pid"].(float64)) != pid {
+			break
+		}
+	}
+}
+
+func TestDefaultSocket(t *testing.T) {
+	p, cleanup := newTestPlugin(t, func(manifest *Manifest) {
+		manifest.Socket = ""
+		manifest.HealthCheck.Interval = Duration(time.Minute)
+	})
+	closed := false
+	defer func() {
+		if !closed {
+			cleanup()
+		}
+	}()
+
+	// Healthy right after start, without waiting for the interval.
+	waitHealthy(t, p)
+
+	info, err := os.Stat(filepath.Dir(p.socketPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0700 {
+		t.Errorf("unexpected socket directory mode: %v", mode)
+	}
+
+	cleanup()
+	closed = true
+	if _, err = os.Stat(filepath.Dir(p.socketPath)); !os.IsNotExist(err) {
+		t.Errorf("socket directory not removed: %v", err)
+	}
+}
+
+func TestManifestReservedPrefixes(t *testing.T) {
+	for _, prefix := range []string{"/", "/api/", "/api/gc/", "/api/gc/v1/me", "/api/kvs/v1/", "/health"} {
+		manifest := &Manifest{
+			ID:      "test",
+			Command: []string{"test"},
+			Routes:  []*Route{{Prefix: prefix}},
+		}
+		if err := manifest.validate(); err == nil {
+			t.Errorf("expected error for route prefix %s", prefix)
+		}
+	}
+}
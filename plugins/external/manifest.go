@@ -0,0 +1,189 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package external
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"stash.kopano.io/kc/kapi/plugins"
+)
+
+// Defaults for manifest values.
+const (
+	defaultHealthCheckPath     = "/health-check"
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthCheckFailures = 3
+	defaultRestartDelay        = 1 * time.Second
+	maxRestartDelay            = 30 * time.Second
+)
+
+// Duration is a time.Duration which is represented as string in JSON.
+type Duration time.Duration
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Manifest describes an external plugin.
+type Manifest struct {
+	ID string `json:"id"`
+
+	// Command is the plugin executable with arguments. When set, Kopano API
+	// launches and supervises the plugin process.
+	Command []string `json:"command,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	// Socket is the unix socket path where the plugin listens. It is required
+	// if no command is set. If a command is set, it defaults to a location
+	// in a private directory which is created in the temporary directory.
+	Socket string `json:"socket,omitempty"`
+
+	Routes []*Route `json:"routes"`
+
+	HealthCheck  *HealthCheck `json:"health_check,omitempty"`
+	RestartDelay Duration     `json:"restart_delay,omitempty"`
+}
+
+// Route is an URL path prefix which is forwarded to an external plugin.
+type Route struct {
+	Prefix string `json:"prefix"`
+	// Scopes are the access token scopes required for this route.
+	Scopes []string `json:"scopes,omitempty"`
+	// Public routes are forwarded without access token validation.
+	Public bool `json:"public,omitempty"`
+}
+
+// HealthCheck defines how the health of an external plugin is checked.
+type HealthCheck struct {
+	Path     string   `json:"path,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	// Failures is the number of consecutive failed health checks after which
+	// a launched plugin process is restarted.
+	Failures int `json:"failures,omitempty"`
+}
+
+// LoadManifest reads and validates the manifest at the provided path.
+func LoadManifest(fn string) (*Manifest, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &Manifest{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(m); err != nil {
+		return nil, fmt.Errorf("failed to parse plugin manifest %s: %v", fn, err)
+	}
+	if err = m.validate(); err != nil {
+		return nil, fmt.Errorf("invalid plugin manifest %s: %v", fn, err)
+	}
+
+	return m, nil
+}
+
+// LoadManifests loads all plugin manifests (*.json) found in the provided
+// directory, sorted by file name.
+func LoadManifests(pluginsPath string) ([]*Manifest, error) {
+	fns, err := filepath.Glob(filepath.Join(pluginsPath, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fns)
+
+	manifests := make([]*Manifest, 0, len(fns))
+	for _, fn := range fns {
+		m, loadErr := LoadManifest(fn)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		manifests = append(manifests, m)
+	}
+
+	return manifests, nil
+}
+
+func (m *Manifest) validate() error {
+	if m.ID == "" {
+		return errors.New("id is empty")
+	}
+	if len(m.Command) == 0 && m.Socket == "" {
+		return errors.New("either command or socket is required")
+	}
+	if len(m.Routes) == 0 {
+		return errors.New("no routes")
+	}
+	for _, route := range m.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route prefix %s must start with /", route.Prefix)
+		}
+		if reserved, overlaps := plugins.OverlapsReservedPrefix(route.Prefix); overlaps {
+			return fmt.Errorf("route prefix %s overlaps with %s", route.Prefix, reserved)
+		}
+	}
+
+	if m.HealthCheck == nil {
+		m.HealthCheck = &HealthCheck{}
+	}
+	if m.HealthCheck.Path == "" {
+		m.HealthCheck.Path = defaultHealthCheckPath
+	}
+	if m.HealthCheck.Interval <= 0 {
+		m.HealthCheck.Interval = Duration(defaultHealthCheckInterval)
+	}
+	if m.HealthCheck.Timeout <= 0 {
+		m.HealthCheck.Timeout = Duration(defaultHealthCheckTimeout)
+	}
+	if m.HealthCheck.Failures <= 0 {
+		m.HealthCheck.Failures = defaultHealthCheckFailures
+	}
+	if m.RestartDelay <= 0 {
+		m.RestartDelay = Duration(defaultRestartDelay)
+	}
+
+	// Longest prefix first, so the most specific route wins.
+	sort.SliceStable(m.Routes, func(i, j int) bool {
+		return len(m.Routes[i].Prefix) > len(m.Routes[j].Prefix)
+	})
+
+	return nil
+}
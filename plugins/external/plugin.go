@@ -0,0 +1,228 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/plugins/external/protocol"
+	"stash.kopano.io/kc/kapi/proxy/httpproxy"
+)
+
+const (
+	closeTimeout = 5 * time.Second
+
+	// startupCheckInterval is the interval of health checks until a started
+	// plugin is healthy for the first time.
+	startupCheckInterval = 100 * time.Millisecond
+)
+
+// proxyConfiguration is the configuration of the proxies to plugin processes.
+// Connections over the unix socket are cheap, so keep alive is disabled and
+// requests never use connections which went stale when the process restarted.
+// Idempotent requests are retried while the process starts again.
+var proxyConfiguration = &httpproxy.Configuration{
+	Policy:      "random",
+	MaxFails:    1,
+	Keepalive:   0,
+	TryDuration: 2 * time.Second,
+	TryInterval: 250 * time.Millisecond,
+}
+
+// ExternalPlugin implements a plugin which forwards its routes to an external
+// plugin process via HTTP over a unix socket.
+type ExternalPlugin struct {
+	mutex sync.RWMutex
+
+	manifest   *Manifest
+	info       *plugins.InfoV1
+	socketPath string
+	socketDir  string
+
+	ctx context.Context
+	srv plugins.ServerV1
+
+	quit chan struct{}
+	done chan struct{}
+
+	proxy   *httpproxy.Proxy
+	client  *http.Client
+	cmd     *exec.Cmd
+	healthy bool
+}
+
+// New creates a new ExternalPlugin for the provided manifest.
+func New(manifest *Manifest) *ExternalPlugin {
+	return &ExternalPlugin{
+		manifest: manifest,
+		info: &plugins.InfoV1{
+			ID: manifest.ID,
+		},
+
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Info returns the accociated plugins plugin.Info.
+func (p *ExternalPlugin) Info() *plugins.InfoV1 {
+	return p.info
+}
+
+// Initialize initizalizes the accociated plugin.
+func (p *ExternalPlugin) Initialize(ctx context.Context, errCh chan<- error, srv plugins.ServerV1) error {
+	var err error
+
+	p.ctx = ctx
+	p.srv = srv
+
+	p.socketPath = p.manifest.Socket
+	if p.socketPath == "" {
+		// NOTE: The directory is only accessible by the current user, so
+		// nobody else can listen on the socket to receive the forwarded
+		// requests with their access tokens.
+		p.socketDir, err = ioutil.TempDir("", "kapi-plugin-"+p.manifest.ID+"-")
+		if err != nil {
+			return fmt.Errorf("external: failed to create socket directory: %v", err)
+		}
+		p.socketPath = filepath.Join(p.socketDir, "plugin.sock")
+	}
+	p.socketPath, err = filepath.Abs(p.socketPath)
+	if err != nil {
+		return fmt.Errorf("external: invalid socket path: %v", err)
+	}
+
+	p.proxy, err = httpproxy.New(p.manifest.ID, []string{p.socketPath}, proxyConfiguration)
+	if err != nil {
+		if p.socketDir != "" {
+			os.RemoveAll(p.socketDir)
+		}
+		return fmt.Errorf("external: failed to create proxy: %v", err)
+	}
+
+	socketPath := p.socketPath
+	p.client = &http.Client{
+		Timeout: time.Duration(p.manifest.HealthCheck.Timeout),
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	go p.supervise(ctx)
+
+	srv.Logger().WithField("socket", p.socketPath).Debugf("external: initialize %s", p.manifest.ID)
+	return nil
+}
+
+// Close closes the accociated plugin.
+func (p *ExternalPlugin) Close() error {
+	p.srv.Logger().Debugf("external: close %s", p.manifest.ID)
+
+	close(p.quit)
+	select {
+	case <-p.done:
+	case <-time.After(2 * closeTimeout):
+		return errors.New("timeout while waiting for plugin process to exit")
+	}
+
+	if p.proxy != nil {
+		return p.proxy.Close()
+	}
+
+	return nil
+}
+
+// Healthy returns true when the last health check of the accociated plugin
+// succeeded.
+func (p *ExternalPlugin) Healthy() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.healthy
+}
+
+// HealthV1 returns the health of the accociated plugin.
+func (p *ExternalPlugin) HealthV1() *plugins.HealthV1 {
+	return &plugins.HealthV1{
+		Healthy: p.Healthy(),
+	}
+}
+
+// ServeHTTP serves HTTP requests.
+func (p *ExternalPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) (bool, error) {
+	var route *Route
+	for _, r := range p.manifest.Routes {
+		if plugins.MatchesPrefix(req.URL.Path, r.Prefix) {
+			route = r
+			break
+		}
+	}
+	if route == nil {
+		// Fast exit.
+		return false, nil
+	}
+
+	var handler http.Handler = http.HandlerFunc(p.handleForward)
+	if !route.Public {
+		handler = p.srv.AccessTokenRequired(handler, route.Scopes)
+	}
+
+	// Execute handler.
+	handler.ServeHTTP(rw, req)
+
+	return true, nil
+}
+
+func (p *ExternalPlugin) handleForward(rw http.ResponseWriter, req *http.Request) {
+	// Never forward auth records provided by the client.
+	req.Header.Del(protocol.AuthRecordHeaderName)
+
+	if authRecord, ok := auth.RecordFromContext(req.Context()); ok {
+		value, err := protocol.EncodeAuthRecord(authRecord)
+		if err != nil {
+			p.srv.Logger().WithError(err).Errorln("external: failed to encode auth record")
+			http.Error(rw, "", http.StatusInternalServerError)
+			return
+		}
+		req.Header.Set(protocol.AuthRecordHeaderName, value)
+	}
+
+	p.srv.HandleWithProxy(p.proxy, http.HandlerFunc(p.handleNoProxy)).ServeHTTP(rw, req)
+}
+
+func (p *ExternalPlugin) handleNoProxy(rw http.ResponseWriter, req *http.Request) {
+	// NOTE(longsleep): This handler is only reached when no proxy is available.
+
+	p.srv.Logger().WithError(errors.New("proxy not configured")).Errorf("external: %s proxy request not possible", p.manifest.ID)
+	http.Error(rw, "", http.StatusBadGateway)
+}
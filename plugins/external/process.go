@@ -0,0 +1,226 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package external
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/kapi/plugins/external/protocol"
+)
+
+// supervise launches the plugin process if configured, checks its health and
+// restarts it when it exits or becomes unhealthy. It returns when the plugin
+// is closed.
+func (p *ExternalPlugin) supervise(ctx context.Context) {
+	defer close(p.done)
+
+	logger := p.srv.Logger().WithField("plugin", p.manifest.ID)
+	restartDelay := time.Duration(p.manifest.RestartDelay)
+
+	for {
+		var exitCh <-chan error
+		if len(p.manifest.Command) > 0 {
+			cmd, err := p.start()
+			if err != nil {
+				logger.WithError(err).Errorln("external: failed to start plugin process")
+			} else {
+				logger.WithField("pid", cmd.Process.Pid).Infoln("external: plugin process started")
+				ch := make(chan error, 1)
+				go func() {
+					ch <- cmd.Wait()
+				}()
+				exitCh = ch
+			}
+		}
+
+		started := time.Now()
+		if !p.monitor(ctx, exitCh, logger) {
+			if p.socketDir != "" {
+				os.RemoveAll(p.socketDir)
+			}
+			return
+		}
+
+		// Reset delay if the process was running for a while, back off otherwise.
+		if time.Since(started) > maxRestartDelay {
+			restartDelay = time.Duration(p.manifest.RestartDelay)
+		}
+		logger.WithField("delay", restartDelay).Warnln("external: restarting plugin process")
+		select {
+		case <-p.quit:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+		restartDelay *= 2
+		if restartDelay > maxRestartDelay {
+			restartDelay = maxRestartDelay
+		}
+	}
+}
+
+// monitor health checks the plugin until it exits, gets unhealthy or the
+// plugin is closed. It returns true if the process needs a restart.
+func (p *ExternalPlugin) monitor(ctx context.Context, exitCh <-chan error, logger logrus.FieldLogger) bool {
+	healthCheck := p.manifest.HealthCheck
+	interval := time.Duration(healthCheck.Interval)
+	// Check right away and keep checking often until the process is
+	// listening, so it is not reported unhealthy for a whole interval.
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	started := time.Now()
+	starting := true
+
+	failures := 0
+	for {
+		select {
+		case <-p.quit:
+			p.stop(exitCh, logger)
+			return false
+
+		case <-ctx.Done():
+			p.stop(exitCh, logger)
+			return false
+
+		case err := <-exitCh:
+			p.setHealthy(false)
+			logger.WithError(err).Warnln("external: plugin process exited")
+			return true
+
+		case <-timer.C:
+			err := p.check(ctx)
+			if err == nil {
+				starting = false
+				failures = 0
+				if p.setHealthy(true) {
+					logger.Infoln("external: plugin is healthy")
+				}
+				timer.Reset(interval)
+				continue
+			}
+			if starting && time.Since(started) < interval {
+				timer.Reset(startupCheckInterval)
+				continue
+			}
+
+			starting = false
+			timer.Reset(interval)
+			failures++
+			if p.setHealthy(false) {
+				logger.WithError(err).Warnln("external: plugin is unhealthy")
+			} else {
+				logger.WithError(err).Debugln("external: plugin health check failed")
+			}
+			if len(p.manifest.Command) > 0 && failures >= healthCheck.Failures {
+				logger.WithField("failures", failures).Warnln("external: plugin health check failure limit reached")
+				p.stop(exitCh, logger)
+				return true
+			}
+		}
+	}
+}
+
+func (p *ExternalPlugin) start() (*exec.Cmd, error) {
+	// Remove stale socket, so health checks do not succeed before the new
+	// process is listening.
+	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cmd := exec.Command(p.manifest.Command[0], p.manifest.Command[1:]...)
+	cmd.Env = append(os.Environ(), p.manifest.Env...)
+	cmd.Env = append(cmd.Env,
+		protocol.SocketEnvName+"="+p.socketPath,
+		protocol.IDEnvName+"="+p.manifest.ID,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.cmd = cmd
+	p.mutex.Unlock()
+
+	return cmd, nil
+}
+
+// stop terminates the plugin process if running and waits for it to exit.
+func (p *ExternalPlugin) stop(exitCh <-chan error, logger logrus.FieldLogger) {
+	p.mutex.Lock()
+	cmd := p.cmd
+	p.cmd = nil
+	p.healthy = false
+	p.mutex.Unlock()
+
+	if cmd == nil || exitCh == nil {
+		return
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exitCh:
+		return
+	case <-time.After(closeTimeout):
+		logger.Warnln("external: plugin process did not exit, killing it")
+	}
+	cmd.Process.Kill()
+	<-exitCh
+}
+
+// check runs the health check request against the plugin.
+func (p *ExternalPlugin) check(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, "http://"+p.manifest.ID+p.manifest.HealthCheck.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check failed with status: %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// setHealthy sets the health state and returns true if it changed.
+func (p *ExternalPlugin) setHealthy(healthy bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	changed := p.healthy != healthy
+	p.healthy = healthy
+
+	return changed
+}
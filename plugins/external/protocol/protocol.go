@@ -0,0 +1,98 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package protocol defines how Kopano API talks to external plugin processes.
+// External plugins are HTTP servers listening on a unix socket. Kopano API
+// forwards the routes of the plugin to that socket, after validating access
+// tokens. The validated auth record is passed along with each request.
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"stash.kopano.io/kc/kapi/auth"
+)
+
+// Environment variables set by Kopano API for plugin processes it launches.
+const (
+	SocketEnvName = "KAPI_PLUGIN_SOCKET"
+	IDEnvName     = "KAPI_PLUGIN_ID"
+)
+
+// AuthRecordHeaderName is the request header name which holds the encoded
+// auth record for requests forwarded to external plugins.
+const AuthRecordHeaderName = "X-Kapi-Auth-Record"
+
+// EncodeAuthRecord encodes the provided auth record for use as value of the
+// AuthRecordHeaderName request header.
+func EncodeAuthRecord(record *auth.Record) (string, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeAuthRecord decodes the provided AuthRecordHeaderName request header
+// value.
+func DecodeAuthRecord(value string) (*auth.Record, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth record encoding: %v", err)
+	}
+
+	record := &auth.Record{}
+	if err = json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("invalid auth record: %v", err)
+	}
+
+	return record, nil
+}
+
+// AuthRecordFromRequest returns the auth record of the provided request as
+// forwarded by Kopano API. It returns nil without error for requests to
+// routes which do not require authentication.
+func AuthRecordFromRequest(req *http.Request) (*auth.Record, error) {
+	value := req.Header.Get(AuthRecordHeaderName)
+	if value == "" {
+		return nil, nil
+	}
+
+	return DecodeAuthRecord(value)
+}
+
+// Listen creates the unix socket listener for external plugin processes at
+// the location provided by Kopano API in the environment.
+func Listen() (net.Listener, error) {
+	socketPath := os.Getenv(SocketEnvName)
+	if socketPath == "" {
+		return nil, fmt.Errorf("%s environment variable is not set", SocketEnvName)
+	}
+
+	// Remove stale socket from previous runs.
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return net.Listen("unix", socketPath)
+}
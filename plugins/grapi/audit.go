@@ -0,0 +1,248 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"stash.kopano.io/kc/kapi/audit"
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/proxy/transform"
+)
+
+var auditRecordsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kapi",
+	Subsystem: "grapi",
+	Name:      "audit_records_total",
+	Help:      "Total number of grapi audit records by result",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(auditRecordsCounter)
+}
+
+type contextKey string
+
+const auditRecordContextKey contextKey = "auditRecord"
+
+// auditor records mutating requests and sensitive reads to the audit log.
+type auditor struct {
+	logger *audit.Logger
+	reads  []*regexp.Regexp
+}
+
+// newAuditor creates an auditor which writes to the provided target, which is
+// either `syslog` or the path of a JSONL file. Reads are recorded when their
+// path template matches one of the provided expressions.
+//
+// NOTE: The chain of a file continues after its last record. Syslog cannot be
+// read back, so with syslog every start begins a new chain with sequence 1.
+func newAuditor(target string, maxSize int64, maxFiles int, key []byte, reads []string) (*auditor, error) {
+	a := &auditor{}
+	for _, read := range reads {
+		expression, err := regexp.Compile(read)
+		if err != nil {
+			return nil, fmt.Errorf("invalid read expression %s: %v", read, err)
+		}
+		a.reads = append(a.reads, expression)
+	}
+
+	if target == "syslog" {
+		w, err := audit.NewSyslogWriter("kapid-audit")
+		if err != nil {
+			return nil, err
+		}
+		a.logger = audit.New(w, key, nil)
+		return a, nil
+	}
+
+	w, err := audit.NewFileWriter(target, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	last, err := w.Last()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	a.logger = audit.New(w, key, last)
+
+	return a, nil
+}
+
+// records returns true if the provided request with the provided path
+// template is audited.
+func (a *auditor) records(req *http.Request, path string) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		for _, expression := range a.reads {
+			if expression.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// auditHandler returns a http.Handler which records the requests to next in
+// the audit log, if enabled. Requests are recorded after they were served, so
+// the record contains the upstream status. They are recorded with the subject
+// and client of the access token once next calls auditAuthenticated, and with
+// the injected users once next calls auditInjected, so requests which are
+// denied before are recorded too.
+func (p *KopanoGroupwareCorePlugin) auditHandler(next http.Handler) http.Handler {
+	if p.auditor == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path := pathTemplate(req.URL.Path)
+		if !p.auditor.records(req, path) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		record := &audit.Record{
+			Time:   time.Now().UTC(),
+			Source: pluginInfo.ID,
+
+			Method: req.Method,
+			Path:   path,
+		}
+		auditRW := &auditResponse{
+			ResponseWriter: rw,
+		}
+		req = req.WithContext(context.WithValue(req.Context(), auditRecordContextKey, record))
+		auditAuthenticated(req)
+		defer func() {
+			record.Status = auditRW.status
+			if err := p.auditor.logger.Log(record); err != nil {
+				auditRecordsCounter.WithLabelValues("failure").Inc()
+				p.srv.Logger().WithError(err).Errorln("grapi: failed to write audit record")
+				return
+			}
+			auditRecordsCounter.WithLabelValues("success").Inc()
+		}()
+
+		next.ServeHTTP(auditRW, req)
+	})
+}
+
+// auditAuthenticated sets the subject and client of the access token of the
+// provided request in its audit record, if it is recorded and authenticated.
+func auditAuthenticated(req *http.Request) {
+	record, ok := req.Context().Value(auditRecordContextKey).(*audit.Record)
+	if !ok {
+		return
+	}
+	authRecord, _ := auth.RecordFromContext(req.Context())
+	if authRecord == nil {
+		return
+	}
+
+	record.UserEntryID = authRecord.AuthenticatedUserID
+	record.ClientID = transform.ClientID(req)
+}
+
+// auditInjected sets the users which were injected into the provided request
+// in its audit record, if it is recorded.
+func auditInjected(req *http.Request) {
+	record, ok := req.Context().Value(auditRecordContextKey).(*audit.Record)
+	if !ok {
+		return
+	}
+
+	record.UserEntryID = req.Header.Get(entryIDRequestHeaderName)
+	record.Username = req.Header.Get(usernameRequestHeaderName)
+	record.ActorEntryID = req.Header.Get(actorEntryIDRequestHeaderName)
+	record.ActorUsername = req.Header.Get(actorUsernameRequestHeaderName)
+}
+
+// pathTemplate returns the provided API path with identifiers replaced by
+// `{id}`, so records group by operation and do not depend on entry IDs.
+func pathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for idx, segment := range segments {
+		if segment != "" && !pathTemplateSegmentRegexp.MatchString(segment) {
+			segments[idx] = "{id}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// pathTemplateSegmentRegexp matches the static segments of API paths, like
+// API versions, collection and property names, OData functions and `$value`.
+// Identifiers are entry IDs, email addresses and the like.
+var pathTemplateSegmentRegexp = regexp.MustCompile(`^\$?[a-zA-Z][a-zA-Z.]{0,39}[0-9]?(\(\))?$`)
+
+// auditResponse is a http.ResponseWriter which remembers the response status
+// for the audit record.
+type auditResponse struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *auditResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditResponse) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush implements the http.Flusher interface for streamed responses.
+func (r *auditResponse) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface for WebSocket connections of
+// the subscription proxy, whose response status is written to the hijacked
+// connection.
+func (r *auditResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err == nil && r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+
+	return conn, brw, err
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"stash.kopano.io/kc/kapi/audit"
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+func TestPathTemplate(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/api/gc/v1/me":                                              "/api/gc/v1/me",
+		"/api/gc/v1/me/photo/$value":                                 "/api/gc/v1/me/photo/$value",
+		"/api/gc/v1/me/mailFolders/inbox/messages":                   "/api/gc/v1/me/mailFolders/inbox/messages",
+		"/api/gc/v1/me/messages/AAMkADA1MzA=/attachments":            "/api/gc/v1/me/messages/{id}/attachments",
+		"/api/gc/v1/users/user1@example.com/calendar":                "/api/gc/v1/users/{id}/calendar",
+		"/api/gc/v1/me/events/AAMkADA1MzA_-/microsoft.graph.delta()": "/api/gc/v1/me/events/{id}/microsoft.graph.delta()",
+	} {
+		if template := pathTemplate(path); template != expected {
+			t.Errorf("unexpected template for %s: %s", path, template)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kapi-grapi-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "audit.jsonl")
+
+	a, err := newAuditor(fn, 0, 0, []byte("secret"), []string{`/photo/\$value$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := pluginstest.NewServer()
+	srv.Records["user"] = &auth.Record{AuthenticatedUserID: "user1"}
+	srv.Records["client"] = &auth.Record{
+		AuthenticatedUserID: "client1",
+		ServicePrincipal:    &auth.ServicePrincipal{ClientID: "client1"},
+	}
+	p := &KopanoGroupwareCorePlugin{
+		ctx:          context.Background(),
+		srv:          srv,
+		defaultProxy: &testDefaultProxy{},
+		versions:     apiVersions{newAPIVersion("v1", "", scopesRequired)},
+		auditor:      a,
+	}
+
+	for _, r := range []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/api/gc/v1/me"},
+		{http.MethodPost, "/api/gc/v1/me/events"},
+		{http.MethodGet, "/api/gc/v1/me/photo/$value"},
+		{http.MethodDelete, "/api/gc/v1/me/events/AAMkADA1MzA="},
+	} {
+		req := httptest.NewRequest(r.method, r.path, strings.NewReader("{}"))
+		req.Header.Set("Authorization", "Bearer user")
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Requests without valid access token are recorded without user.
+	req := httptest.NewRequest(http.MethodPost, "/api/gc/v1/me/events", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer invalid")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected request with invalid token to be denied, got %d", rec.Code)
+	}
+
+	// Denied requests are recorded with the subject and client of the token.
+	req = httptest.NewRequest(http.MethodPost, "/api/gc/v1/me/events", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer client")
+	req.Header.Set(entryIDRequestHeaderName, "forged")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected service client without impersonation to be denied, got %d", rec.Code)
+	}
+	a.logger.Close()
+
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	last, err := audit.Verify(f, []byte("secret"), nil)
+	if err != nil {
+		t.Fatalf("audit log not verified: %v", err)
+	}
+	if last == nil || last.Seq != 5 {
+		t.Fatalf("unexpected number of records: %+v", last)
+	}
+	if last.UserEntryID != "client1" || last.ClientID != "client1" || last.Method != http.MethodPost || last.Status != http.StatusForbidden {
+		t.Errorf("unexpected record of denied request: %+v", last)
+	}
+
+	data, _ := ioutil.ReadFile(fn)
+	if strings.Contains(string(data), `"path":"/api/gc/v1/me"`) {
+		t.Errorf("read which is not configured was recorded: %s", data)
+	}
+	if !strings.Contains(string(data), `"method":"POST","path":"/api/gc/v1/me/events","status":201`) {
+		t.Errorf("mutating request not recorded: %s", data)
+	}
+	if !strings.Contains(string(data), `"user_entry_id":"user1"`) || !strings.Contains(string(data), `"method":"DELETE","path":"/api/gc/v1/me/events/{id}","status":404`) {
+		t.Errorf("delete request not recorded: %s", data)
+	}
+	if !strings.Contains(string(data), `"source":"grapi","method":"POST","path":"/api/gc/v1/me/events","status":403`) {
+		t.Errorf("request with invalid token not recorded: %s", data)
+	}
+}
@@ -21,29 +21,69 @@ import (
 	"errors"
 	"net/http"
 
+	"github.com/sirupsen/logrus"
+
 	"stash.kopano.io/kc/kapi/auth"
 )
 
 func (p *KopanoGroupwareCorePlugin) injectAuthIntoRequestHeaders(req *http.Request) error {
 	var err error
 
+	// Never pass on actor headers of clients.
+	req.Header.Del(actorEntryIDRequestHeaderName)
+	req.Header.Del(actorUsernameRequestHeaderName)
+	target := req.Header.Get(impersonateRequestHeaderName)
+	req.Header.Del(impersonateRequestHeaderName)
+
 	authRecord, _ := auth.RecordFromContext(req.Context())
 	if authRecord != nil {
 		authenticatedUserID := authRecord.AuthenticatedUserID
-		if authRecord.ExtraClaims != nil {
+		var authenticatedUsername string
+		switch {
+		case authRecord.ServicePrincipal != nil:
+			// Service clients are no users, they can only act on behalf of
+			// users. Their client ID is no user, so it is never a target.
+			if target == "" || target == authenticatedUserID {
+				err = errors.New("service client requires impersonation")
+			}
+			req.Header.Del(usernameRequestHeaderName)
+		case authRecord.ExtraClaims != nil:
 			kcIDUserID, kcIDUsername := auth.KCIDFromClaims(authRecord.ExtraClaims)
 			if kcIDUserID != "" {
 				authenticatedUserID = kcIDUserID
 			}
 			if kcIDUsername != "" {
+				authenticatedUsername = kcIDUsername
 				req.Header.Set(usernameRequestHeaderName, kcIDUsername)
 			} else {
 				err = errors.New("missing kc.identity with username")
 			}
-		} else {
+		default:
 			req.Header.Del(usernameRequestHeaderName)
 		}
 		req.Header.Set(entryIDRequestHeaderName, authenticatedUserID)
+
+		if err == nil && target != "" && (target != authenticatedUserID || authRecord.ServicePrincipal != nil) {
+			logger := p.srv.Logger().WithFields(logrus.Fields{
+				"actor":  authenticatedUserID,
+				"target": target,
+				"method": req.Method,
+				"path":   req.URL.Path,
+			})
+			if err = p.authorizeImpersonation(authRecord, authenticatedUserID, target); err != nil {
+				logger.Warnln("grapi: impersonation denied")
+				return err
+			}
+			logger.Infoln("grapi: impersonated request")
+
+			// Act as target, which is identified by its entry ID only.
+			req.Header.Set(entryIDRequestHeaderName, target)
+			req.Header.Del(usernameRequestHeaderName)
+			req.Header.Set(actorEntryIDRequestHeaderName, authenticatedUserID)
+			if authenticatedUsername != "" {
+				req.Header.Set(actorUsernameRequestHeaderName, authenticatedUsername)
+			}
+		}
 	} else {
 		err = errors.New("no auth record to inject")
 	}
@@ -0,0 +1,337 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	batchPath           = "/api/gc/v1/$batch"
+	batchBasePath       = "/api/gc/v1"
+	batchMaxRequests    = 20
+	batchMaxRequestSize = 4 * 1024 * 1024
+)
+
+// batchRequest is a JSON batch request as defined by Microsoft Graph.
+type batchRequest struct {
+	Requests []*batchSubRequest `json:"requests"`
+}
+
+type batchSubRequest struct {
+	ID        string            `json:"id"`
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      json.RawMessage   `json:"body,omitempty"`
+	DependsOn []string          `json:"dependsOn,omitempty"`
+
+	url *url.URL
+}
+
+// batchResponse is a JSON batch response as defined by Microsoft Graph.
+type batchResponse struct {
+	Responses []*batchSubResponse `json:"responses"`
+}
+
+type batchSubResponse struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    interface{}       `json:"body,omitempty"`
+}
+
+// validate checks the accociated batch request for duplicate IDs, unknown or
+// circular dependencies and invalid or unsupported sub request URLs.
+func (br *batchRequest) validate() error {
+	if len(br.Requests) == 0 {
+		return errors.New("no requests")
+	}
+	if len(br.Requests) > batchMaxRequests {
+		return fmt.Errorf("too many requests, limit is %d", batchMaxRequests)
+	}
+
+	requests := make(map[string]*batchSubRequest)
+	for _, sr := range br.Requests {
+		if sr == nil || sr.ID == "" || sr.Method == "" || sr.URL == "" {
+			return errors.New("request without id, method or url")
+		}
+		if _, ok := requests[sr.ID]; ok {
+			return fmt.Errorf("duplicate request id %s", sr.ID)
+		}
+		u, err := batchSubRequestURL(sr.URL)
+		if err != nil {
+			return fmt.Errorf("invalid url in request %s", sr.ID)
+		}
+		if u.Path == batchPath || strings.HasPrefix(u.Path, batchBasePath+"/subscriptions") {
+			return fmt.Errorf("unsupported url in request %s", sr.ID)
+		}
+		sr.url = u
+		requests[sr.ID] = sr
+	}
+
+	// Depth first search for circular dependencies.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visiting:
+			return fmt.Errorf("circular dependency in request %s", id)
+		case visited:
+			return nil
+		}
+		state[id] = visiting
+		for _, dependency := range requests[id].DependsOn {
+			if _, ok := requests[dependency]; !ok {
+				return fmt.Errorf("unknown dependency %s in request %s", dependency, id)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		state[id] = visited
+		return nil
+	}
+	for _, sr := range br.Requests {
+		if err := visit(sr.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batchSubRequestURL returns the provided sub request URL below the v1 API
+// with its path cleaned. URLs which leave the v1 API are invalid.
+func batchSubRequestURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return nil, errors.New("not an absolute path")
+	}
+
+	cleaned := path.Clean(batchBasePath + u.Path)
+	if !strings.HasPrefix(cleaned, batchBasePath+"/") {
+		return nil, errors.New("path outside of api")
+	}
+	if strings.HasSuffix(u.Path, "/") {
+		cleaned += "/"
+	}
+
+	return &url.URL{
+		Path:     cleaned,
+		RawQuery: u.RawQuery,
+	}, nil
+}
+
+// batchContext is the context of sub requests. It hides the server of the
+// outer request, so the reverse proxy does not abort the whole batch when
+// copying the response of a sub request fails, and the audit record of the
+// outer request, as sub requests are recorded on their own.
+type batchContext struct {
+	context.Context
+}
+
+func (ctx batchContext) Value(key interface{}) interface{} {
+	if key == http.ServerContextKey || key == auditRecordContextKey {
+		return nil
+	}
+	return ctx.Context.Value(key)
+}
+
+func (p *KopanoGroupwareCorePlugin) handleBatchV1(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, batchMaxRequestSize))
+	if err != nil {
+		http.Error(rw, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var br batchRequest
+	if err = json.Unmarshal(payload, &br); err == nil {
+		err = br.validate()
+	}
+	if err != nil {
+		p.srv.Logger().WithError(err).Debugln("grapi: invalid batch request")
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Run all sub requests concurrently, each waiting for the requests it
+	// depends on.
+	responses := make(map[string]*batchSubResponse)
+	done := make(map[string]chan struct{})
+	for _, sr := range br.Requests {
+		done[sr.ID] = make(chan struct{})
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, sr := range br.Requests {
+		wg.Add(1)
+		go func(sr *batchSubRequest) {
+			defer wg.Done()
+			defer close(done[sr.ID])
+
+			failed := false
+			for _, dependency := range sr.DependsOn {
+				<-done[dependency]
+				mutex.Lock()
+				status := responses[dependency].Status
+				mutex.Unlock()
+				if status < 200 || status >= 300 {
+					failed = true
+				}
+			}
+
+			var response *batchSubResponse
+			if failed {
+				response = &batchSubResponse{
+					ID:     sr.ID,
+					Status: http.StatusFailedDependency,
+				}
+			} else {
+				response = p.serveBatchSubRequest(req, sr)
+			}
+
+			mutex.Lock()
+			responses[sr.ID] = response
+			mutex.Unlock()
+		}(sr)
+	}
+	wg.Wait()
+
+	result := &batchResponse{
+		Responses: make([]*batchSubResponse, 0, len(br.Requests)),
+	}
+	for _, sr := range br.Requests {
+		result.Responses = append(result.Responses, responses[sr.ID])
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(result)
+}
+
+// serveBatchSubRequest serves the provided sub request of a batch with the
+// context, and thus the auth record, of the outer request. Sub requests which
+// fail while their response is copied are answered with status 502.
+func (p *KopanoGroupwareCorePlugin) serveBatchSubRequest(req *http.Request, sr *batchSubRequest) (response *batchSubResponse) {
+	response = &batchSubResponse{
+		ID: sr.ID,
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			p.srv.Logger().WithField("panic", r).Debugln("grapi: batch sub request aborted")
+			response = &batchSubResponse{
+				ID:     sr.ID,
+				Status: http.StatusBadGateway,
+			}
+		}
+	}()
+
+	var body []byte
+	contentType := ""
+	if len(sr.Body) > 0 {
+		var encoded string
+		if err := json.Unmarshal(sr.Body, &encoded); err == nil {
+			// Non-JSON bodies are base64 encoded.
+			if body, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+				response.Status = http.StatusBadRequest
+				return response
+			}
+		} else {
+			body = sr.Body
+			contentType = "application/json"
+		}
+	}
+
+	subReq, err := http.NewRequest(strings.ToUpper(sr.Method), sr.url.String(), bytes.NewReader(body))
+	if err != nil {
+		response.Status = http.StatusBadRequest
+		return response
+	}
+	subReq = subReq.WithContext(batchContext{req.Context()})
+	subReq.Host = req.Host
+	subReq.RemoteAddr = req.RemoteAddr
+	for name, values := range req.Header {
+		switch name {
+		case "Content-Type", "Content-Length", "Accept-Encoding":
+		default:
+			subReq.Header[name] = append([]string(nil), values...)
+		}
+	}
+	if contentType != "" {
+		subReq.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range sr.Headers {
+		subReq.Header.Set(name, value)
+	}
+
+	rw := newBufferedResponse()
+	p.auditHandler(http.HandlerFunc(p.handleDefaultV1)).ServeHTTP(rw, subReq)
+
+	response.Status = rw.status
+	if response.Status == 0 {
+		response.Status = http.StatusOK
+	}
+	if contentLength, err := strconv.ParseInt(rw.header.Get("Content-Length"), 10, 64); err == nil && subReq.Method != http.MethodHead && response.Status != http.StatusNotModified && int64(rw.body.Len()) < contentLength {
+		// Response body copy failed.
+		p.srv.Logger().WithField("id", sr.ID).Debugln("grapi: batch sub request response incomplete")
+		response.Status = http.StatusBadGateway
+		return response
+	}
+	if len(rw.header) > 0 {
+		response.Headers = make(map[string]string)
+		for name := range rw.header {
+			response.Headers[name] = rw.header.Get(name)
+		}
+	}
+	if rw.body.Len() > 0 {
+		mediaType, _, _ := mime.ParseMediaType(rw.header.Get("Content-Type"))
+		if (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && json.Valid(rw.body.Bytes()) {
+			response.Body = json.RawMessage(rw.body.Bytes())
+		} else {
+			response.Body = base64.StdEncoding.EncodeToString(rw.body.Bytes())
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+type testDefaultProxy struct {
+	mutex sync.Mutex
+	order []string
+}
+
+func (dp *testDefaultProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) (int, error) {
+	dp.mutex.Lock()
+	dp.order = append(dp.order, req.Method+" "+req.URL.Path)
+	dp.mutex.Unlock()
+
+	switch req.URL.Path {
+	case "/api/gc/v1/me":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]string{
+			"user": req.Header.Get(entryIDRequestHeaderName),
+		})
+	case "/api/gc/v1/me/events":
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write(body)
+	case "/api/gc/v1/me/panic":
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte("{"))
+		panic(http.ErrAbortHandler)
+	case "/api/gc/v1/me/photo/$value":
+		rw.Header().Set("Content-Type", "image/png")
+		rw.Write([]byte{0x89, 0x50, 0x4e, 0x47})
+	default:
+		http.Error(rw, "", http.StatusNotFound)
+	}
+
+	return 0, nil
+}
+
+func TestBatch(t *testing.T) {
+	defaultProxy := &testDefaultProxy{}
+	srv := pluginstest.NewServer()
+	srv.Records["test"] = &auth.Record{AuthenticatedUserID: "user1"}
+	p := &KopanoGroupwareCorePlugin{
+		ctx:          context.Background(),
+		srv:          srv,
+		defaultProxy: defaultProxy,
+		versions:     apiVersions{newAPIVersion("v1", "", scopesRequired)},
+	}
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, batchPath, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer test")
+		rec := httptest.NewRecorder()
+		if handled, _ := p.ServeHTTP(rec, req); !handled {
+			t.Fatal("batch request not handled")
+		}
+		return rec
+	}
+
+	rec := serve(`{"requests":[
+		{"id":"1","method":"GET","url":"/me"},
+		{"id":"2","method":"POST","url":"/me/events","body":{"subject":"test"},"dependsOn":["1"]},
+		{"id":"3","method":"GET","url":"/me/./photo/$value"},
+		{"id":"4","method":"GET","url":"/missing"},
+		{"id":"5","method":"GET","url":"/me","dependsOn":["4"]},
+		{"id":"6","method":"GET","url":"/me/panic"}
+	]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected batch status: %d", rec.Code)
+	}
+
+	var result struct {
+		Responses []struct {
+			ID      string            `json:"id"`
+			Status  int               `json:"status"`
+			Headers map[string]string `json:"headers"`
+			Body    json.RawMessage   `json:"body"`
+		} `json:"responses"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Responses) != 6 {
+		t.Fatalf("expected 6 responses, got %d", len(result.Responses))
+	}
+	expected := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, `{"user":"user1"}`},
+		{http.StatusCreated, `{"subject":"test"}`},
+		{http.StatusOK, `"iVBORw=="`},
+		{http.StatusNotFound, ``},
+		{http.StatusFailedDependency, ``},
+		{http.StatusBadGateway, ``},
+	}
+	for i, response := range result.Responses {
+		if response.Status != expected[i].status {
+			t.Errorf("response %s: expected status %d, got %d", response.ID, expected[i].status, response.Status)
+		}
+		if expected[i].status < 300 && strings.TrimSpace(string(response.Body)) != expected[i].body {
+			t.Errorf("response %s: unexpected body %s", response.ID, response.Body)
+		}
+	}
+
+	defaultProxy.mutex.Lock()
+	order := strings.Join(defaultProxy.order, ",")
+	defaultProxy.mutex.Unlock()
+	if strings.Index(order, "GET /api/gc/v1/me,") > strings.Index(order, "POST /api/gc/v1/me/events") {
+		t.Errorf("dependency not served first: %s", order)
+	}
+
+	for _, invalid := range []string{
+		`{"requests":[]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"/me"},{"id":"1","method":"GET","url":"/me"}]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"/me","dependsOn":["2"]}]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"/me","dependsOn":["2"]},{"id":"2","method":"GET","url":"/me","dependsOn":["1"]}]}`,
+		`{"requests":[{"id":"1","method":"POST","url":"/$batch"}]}`,
+		`{"requests":[{"id":"1","method":"POST","url":"/me/../$batch"}]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"/../../kvs/v1/kv/user/a"}]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"/me/%2e%2e/%2e%2e/x"}]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"//example.com/me"}]}`,
+		`{"requests":[{"id":"1","method":"POST","url":"/subscriptions"}]}`,
+		`{"requests":[{"id":"1","method":"GET","url":"/me/../subscriptions/1"}]}`,
+	} {
+		if rec := serve(invalid); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected bad request for %s, got %d", invalid, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pubs"
+)
+
+const (
+	bridgeNotifyPath             = "/api/gc/bridge/v1/notify/"
+	bridgeSubscriptionsPath      = "/api/gc/v1/subscriptions"
+	bridgeSubscriptionLifetime   = 1 * time.Hour
+	bridgeRetryInterval          = 30 * time.Second
+	bridgeCleanupTimeout         = 10 * time.Second
+	bridgeMaxNotificationSize    = 1024 * 1024
+	bridgeSubscriptionChangeType = "created,updated,deleted"
+	bridgePublishRef             = "grapi"
+)
+
+var defaultBridgeResources = []string{"me/mailFolders/inbox/messages", "me/events"}
+
+// subscriptionBridge creates and renews grapi subscriptions for users which
+// are connected to the pubs websocket stream and publishes the received
+// change notifications to the pubs topic of the accociated user.
+type subscriptionBridge struct {
+	p         *KopanoGroupwareCorePlugin
+	users     pubs.Users
+	publisher pubs.Publisher
+
+	baseURL   string
+	resources []string
+	secret    []byte
+
+	mutex    sync.RWMutex
+	sessions map[string]*bridgeSession
+}
+
+var errBridgeNoAuth = errors.New("no connected client with valid access token")
+
+// bridgeSession holds the grapi subscriptions of a connected user. Requests
+// are sent with the auth record of a currently connected client of the user.
+type bridgeSession struct {
+	userID      string
+	clientState string
+	cancel      context.CancelFunc
+
+	mutex         sync.RWMutex
+	record        *auth.Record
+	subscriptions map[string]string // resource -> subscription id
+}
+
+type bridgeSubscription struct {
+	ID                 string `json:"id,omitempty"`
+	ChangeType         string `json:"changeType,omitempty"`
+	NotificationURL    string `json:"notificationUrl,omitempty"`
+	Resource           string `json:"resource,omitempty"`
+	ClientState        string `json:"clientState,omitempty"`
+	ExpirationDateTime string `json:"expirationDateTime"`
+}
+
+type bridgeNotifications struct {
+	Value []map[string]json.RawMessage `json:"value"`
+}
+
+// newSubscriptionBridge creates a subscriptionBridge. The secret signs the
+// notification URL tokens, a random secret is used if it is empty.
+func newSubscriptionBridge(p *KopanoGroupwareCorePlugin, users pubs.Users, publisher pubs.Publisher, baseURL string, resources []string, secret []byte) *subscriptionBridge {
+	if len(resources) == 0 {
+		resources = defaultBridgeResources
+	}
+	if len(secret) == 0 {
+		secret = rndm.GenerateRandomBytes(32)
+	}
+
+	return &subscriptionBridge{
+		p:         p,
+		users:     users,
+		publisher: publisher,
+
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		resources: resources,
+		secret:    secret,
+
+		sessions: make(map[string]*bridgeSession),
+	}
+}
+
+// UserConnected implements the pubs.UserWatcher interface.
+func (b *subscriptionBridge) UserConnected(record *auth.Record) {
+	if record == nil || record.AuthenticatedUserID == "" || record.ServicePrincipal != nil {
+		// Service clients have no mailbox to subscribe to.
+		return
+	}
+
+	b.mutex.Lock()
+	if _, ok := b.sessions[record.AuthenticatedUserID]; ok {
+		// Already running, it picks up the new client when renewing.
+		b.mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(b.p.ctx)
+	session := &bridgeSession{
+		userID:      record.AuthenticatedUserID,
+		clientState: rndm.GenerateRandomString(32),
+		cancel:      cancel,
+
+		subscriptions: make(map[string]string),
+	}
+	b.sessions[session.userID] = session
+	b.mutex.Unlock()
+
+	go b.run(ctx, session)
+}
+
+// UserDisconnected implements the pubs.UserWatcher interface.
+func (b *subscriptionBridge) UserDisconnected(record *auth.Record) {
+	if record == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	session, ok := b.sessions[record.AuthenticatedUserID]
+	if ok {
+		delete(b.sessions, record.AuthenticatedUserID)
+	}
+	b.mutex.Unlock()
+
+	if ok {
+		session.cancel()
+	}
+}
+
+// end removes the provided session, if it still is the session of its user.
+func (b *subscriptionBridge) end(session *bridgeSession) {
+	b.mutex.Lock()
+	if b.sessions[session.userID] == session {
+		delete(b.sessions, session.userID)
+	}
+	b.mutex.Unlock()
+
+	session.cancel()
+}
+
+func (b *subscriptionBridge) run(ctx context.Context, session *bridgeSession) {
+	logger := b.p.srv.Logger().WithField("user", session.userID)
+
+	for {
+		interval := bridgeSubscriptionLifetime * 3 / 4
+		if err := b.subscribe(ctx, session); err != nil {
+			if errors.Is(err, errBridgeNoAuth) {
+				logger.Debugln("grapi: bridge session ended, no valid access token")
+				b.end(session)
+			} else if ctx.Err() == nil {
+				logger.WithError(err).Warnln("grapi: bridge subscription failed")
+			}
+			interval = bridgeRetryInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			b.unsubscribe(session)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// subscribe renews the existing subscriptions of the provided session and
+// creates the missing ones.
+func (b *subscriptionBridge) subscribe(ctx context.Context, session *bridgeSession) error {
+	record, ok := b.users.UserAuth(session.userID)
+	if !ok {
+		return errBridgeNoAuth
+	}
+	session.mutex.Lock()
+	session.record = record
+	session.mutex.Unlock()
+
+	var lastErr error
+	expiration := time.Now().Add(bridgeSubscriptionLifetime).UTC().Format(time.RFC3339)
+
+	for _, resource := range b.resources {
+		session.mutex.RLock()
+		id := session.subscriptions[resource]
+		session.mutex.RUnlock()
+
+		if id != "" {
+			err := b.request(ctx, record, http.MethodPatch, bridgeSubscriptionsPath+"/"+id, &bridgeSubscription{
+				ExpirationDateTime: expiration,
+			}, nil)
+			if err == nil {
+				continue
+			}
+			if ctx.Err() != nil {
+				return err
+			}
+			b.p.srv.Logger().WithError(err).WithFields(logrus.Fields{
+				"user":     session.userID,
+				"resource": resource,
+			}).Debugln("grapi: bridge subscription renew failed, recreating")
+		}
+
+		created := &bridgeSubscription{}
+		err := b.request(ctx, record, http.MethodPost, bridgeSubscriptionsPath, &bridgeSubscription{
+			ChangeType:         bridgeSubscriptionChangeType,
+			NotificationURL:    b.baseURL + bridgeNotifyPath + b.token(session.userID),
+			Resource:           resource,
+			ClientState:        session.clientState,
+			ExpirationDateTime: expiration,
+		}, created)
+		if err == nil && created.ID == "" {
+			err = errors.New("subscription without id")
+		}
+
+		session.mutex.Lock()
+		if err == nil {
+			session.subscriptions[resource] = created.ID
+		} else {
+			delete(session.subscriptions, resource)
+			lastErr = err
+		}
+		session.mutex.Unlock()
+	}
+
+	return lastErr
+}
+
+// unsubscribe removes all subscriptions of the provided session.
+func (b *subscriptionBridge) unsubscribe(session *bridgeSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), bridgeCleanupTimeout)
+	defer cancel()
+
+	session.mutex.Lock()
+	record := session.record
+	subscriptions := session.subscriptions
+	session.subscriptions = make(map[string]string)
+	session.mutex.Unlock()
+
+	if current, ok := b.users.UserAuth(session.userID); ok {
+		record = current
+	}
+	if record == nil || record.Expired(time.Now()) {
+		// Nothing valid to authenticate with, let the subscriptions expire.
+		return
+	}
+
+	for _, id := range subscriptions {
+		if err := b.request(ctx, record, http.MethodDelete, bridgeSubscriptionsPath+"/"+id, nil, nil); err != nil {
+			b.p.srv.Logger().WithError(err).WithField("user", session.userID).Debugln("grapi: bridge subscription delete failed")
+		}
+	}
+}
+
+// request sends a request with the provided auth record through the
+// subscription proxy and decodes the JSON response into result.
+func (b *subscriptionBridge) request(ctx context.Context, record *auth.Record, method string, path string, body interface{}, result interface{}) error {
+	b.p.mutex.RLock()
+	subscriptionProxy := b.p.subscriptionProxy
+	b.p.mutex.RUnlock()
+	if subscriptionProxy == nil {
+		return errors.New("proxy not configured")
+	}
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, "http://localhost"+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(auth.ContextWithRecord(ctx, record))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err = b.p.injectAuthIntoRequestHeaders(req); err != nil {
+		return err
+	}
+
+	rw := newBufferedResponse()
+	if _, err = subscriptionProxy.ServeHTTP(rw, req); err != nil {
+		return err
+	}
+	if rw.status < 200 || rw.status >= 300 {
+		return fmt.Errorf("unexpected response status: %d", rw.status)
+	}
+	if result != nil {
+		return json.Unmarshal(rw.body.Bytes(), result)
+	}
+
+	return nil
+}
+
+// token returns the notification URL token of the provided user.
+func (b *subscriptionBridge) token(userID string) string {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(userID))
+
+	return base64.RawURLEncoding.EncodeToString([]byte(userID)) + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verify returns the user of the provided notification URL token.
+func (b *subscriptionBridge) verify(token string) (string, bool) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	userID, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal([]byte(b.token(string(userID))), []byte(token)) {
+		return "", false
+	}
+
+	return string(userID), true
+}
+
+// handleNotify receives the change notifications of the subscriptions created
+// by the accociated bridge and publishes them to the pubs user topic.
+func (b *subscriptionBridge) handleNotify(rw http.ResponseWriter, req *http.Request) {
+	userID, ok := b.verify(strings.TrimPrefix(req.URL.Path, bridgeNotifyPath))
+	if !ok {
+		http.Error(rw, "", http.StatusForbidden)
+		return
+	}
+
+	if validationToken := req.URL.Query().Get("validationToken"); validationToken != "" {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(validationToken))
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(rw, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	b.mutex.RLock()
+	session := b.sessions[userID]
+	b.mutex.RUnlock()
+	if session == nil {
+		// User is gone, let the subscription expire.
+		http.Error(rw, "", http.StatusNotFound)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, bridgeMaxNotificationSize))
+	if err != nil {
+		http.Error(rw, "", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var notifications bridgeNotifications
+	if err = json.Unmarshal(payload, &notifications); err != nil {
+		http.Error(rw, "", http.StatusBadRequest)
+		return
+	}
+
+	topic := b.users.UserTopic(userID)
+	for _, notification := range notifications.Value {
+		var clientState string
+		json.Unmarshal(notification["clientState"], &clientState)
+		if !hmac.Equal([]byte(clientState), []byte(session.clientState)) {
+			b.p.srv.Logger().WithField("user", userID).Debugln("grapi: bridge notification with invalid client state")
+			continue
+		}
+		delete(notification, "clientState")
+
+		data, _ := json.Marshal(notification)
+		if err = b.publisher.Publish(bridgePublishRef, data, topic); err != nil {
+			b.p.srv.Logger().WithError(err).WithField("user", userID).Warnln("grapi: bridge publish failed")
+		}
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+}
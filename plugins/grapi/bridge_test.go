@@ -0,0 +1,263 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+	"stash.kopano.io/kc/kapi/plugins/pubs"
+)
+
+type testSubscriptionProxy struct {
+	mutex    sync.Mutex
+	requests []*bridgeSubscription
+	methods  []string
+	users    []string
+}
+
+func (sp *testSubscriptionProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) (int, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	subscription := &bridgeSubscription{}
+	if body, _ := ioutil.ReadAll(req.Body); len(body) > 0 {
+		json.Unmarshal(body, subscription)
+	}
+	sp.requests = append(sp.requests, subscription)
+	sp.methods = append(sp.methods, req.Method+" "+req.URL.Path)
+	sp.users = append(sp.users, req.Header.Get(entryIDRequestHeaderName))
+
+	switch req.Method {
+	case http.MethodPost:
+		subscription.ID = fmt.Sprintf("sub-%d", len(sp.requests))
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(subscription)
+	case http.MethodDelete:
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	return 0, nil
+}
+
+func (sp *testSubscriptionProxy) count(method string) int {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	n := 0
+	for _, m := range sp.methods {
+		if strings.HasPrefix(m, method+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+type testPubs struct {
+	mutex     sync.Mutex
+	published []string
+	topics    []string
+	records   map[string]*auth.Record
+}
+
+func (tp *testPubs) setUserAuth(record *auth.Record) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	if tp.records == nil {
+		tp.records = make(map[string]*auth.Record)
+	}
+	tp.records[record.AuthenticatedUserID] = record
+}
+
+func (tp *testPubs) UserAuth(userID string) (*auth.Record, bool) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	record, ok := tp.records[userID]
+	if !ok || record.Expired(time.Now()) {
+		return nil, false
+	}
+	return record, true
+}
+
+func (tp *testPubs) UserTopic(userID string) string {
+	return "user-" + userID
+}
+
+func (tp *testPubs) WatchUsers(watcher pubs.UserWatcher) {
+}
+
+func (tp *testPubs) Publish(ref string, data json.RawMessage, topics ...string) error {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	tp.published = append(tp.published, string(data))
+	tp.topics = append(tp.topics, topics...)
+	return nil
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscriptionBridge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	subscriptionProxy := &testSubscriptionProxy{}
+	p := &KopanoGroupwareCorePlugin{
+		ctx:               ctx,
+		srv:               pluginstest.NewServer(),
+		subscriptionProxy: subscriptionProxy,
+	}
+	tp := &testPubs{}
+	p.bridge = newSubscriptionBridge(p, tp, tp, "http://kapi.local/", nil, nil)
+
+	record := &auth.Record{AuthenticatedUserID: "user1"}
+	tp.setUserAuth(record)
+	p.bridge.UserConnected(record)
+	waitFor(t, func() bool {
+		return subscriptionProxy.count(http.MethodPost) == len(defaultBridgeResources)
+	})
+
+	subscriptionProxy.mutex.Lock()
+	created := subscriptionProxy.requests[0]
+	users := append([]string{}, subscriptionProxy.users...)
+	subscriptionProxy.mutex.Unlock()
+	for _, user := range users {
+		if user != "user1" {
+			t.Errorf("expected requests for user1, got %s", user)
+		}
+	}
+	if !strings.HasPrefix(created.NotificationURL, "http://kapi.local"+bridgeNotifyPath) {
+		t.Fatalf("unexpected notification url: %s", created.NotificationURL)
+	}
+	notifyPath := strings.TrimPrefix(created.NotificationURL, "http://kapi.local")
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handled, _ := p.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if !handled {
+			t.Fatalf("request not handled: %s", path)
+		}
+		return rec
+	}
+
+	// Validation, only for valid tokens.
+	if rec := serve(http.MethodPost, bridgeNotifyPath+"dXNlcjI.00?validationToken=abc", ""); rec.Code != http.StatusForbidden || rec.Body.String() == "abc" {
+		t.Errorf("expected forbidden validation for invalid token, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPost, notifyPath+"?validationToken=abc", ""); rec.Code != http.StatusOK || rec.Body.String() != "abc" {
+		t.Errorf("unexpected validation response: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Invalid token.
+	if rec := serve(http.MethodPost, bridgeNotifyPath+"dXNlcjI.00", `{"value":[]}`); rec.Code != http.StatusForbidden {
+		t.Errorf("expected forbidden for invalid token, got %d", rec.Code)
+	}
+
+	// Notifications, only the one with the valid client state is published.
+	body := fmt.Sprintf(`{"value":[{"subscriptionId":"sub-1","clientState":%q,"changeType":"created"},{"subscriptionId":"sub-1","clientState":"wrong"}]}`, created.ClientState)
+	if rec := serve(http.MethodPost, notifyPath, body); rec.Code != http.StatusAccepted {
+		t.Errorf("expected accepted, got %d", rec.Code)
+	}
+	tp.mutex.Lock()
+	if len(tp.published) != 1 || tp.topics[0] != "user-user1" {
+		t.Errorf("unexpected published events: %v %v", tp.published, tp.topics)
+	} else if strings.Contains(tp.published[0], "clientState") || !strings.Contains(tp.published[0], `"changeType":"created"`) {
+		t.Errorf("unexpected published data: %s", tp.published[0])
+	}
+	tp.mutex.Unlock()
+
+	// Disconnect removes the subscriptions.
+	p.bridge.UserDisconnected(record)
+	waitFor(t, func() bool {
+		return subscriptionProxy.count(http.MethodDelete) == len(defaultBridgeResources)
+	})
+	if rec := serve(http.MethodPost, notifyPath, body); rec.Code != http.StatusNotFound {
+		t.Errorf("expected not found after disconnect, got %d", rec.Code)
+	}
+}
+
+func TestSubscriptionBridgeExpiredAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	subscriptionProxy := &testSubscriptionProxy{}
+	p := &KopanoGroupwareCorePlugin{
+		ctx:               ctx,
+		srv:               pluginstest.NewServer(),
+		subscriptionProxy: subscriptionProxy,
+	}
+	tp := &testPubs{}
+	p.bridge = newSubscriptionBridge(p, tp, tp, "http://kapi.local/", nil, nil)
+
+	record := &auth.Record{
+		AuthenticatedUserID: "user1",
+		StandardClaims: &jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(-time.Minute).Unix(),
+		},
+	}
+	tp.setUserAuth(record)
+	p.bridge.UserConnected(record)
+
+	// Without valid auth, the session ends without subscribing.
+	waitFor(t, func() bool {
+		p.bridge.mutex.RLock()
+		defer p.bridge.mutex.RUnlock()
+		return len(p.bridge.sessions) == 0
+	})
+	if count := subscriptionProxy.count(http.MethodPost); count != 0 {
+		t.Errorf("expected no subscriptions, got %d", count)
+	}
+}
+
+func TestSubscriptionBridgeSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	first := newSubscriptionBridge(nil, nil, nil, "http://kapi.local/", nil, secret)
+	second := newSubscriptionBridge(nil, nil, nil, "http://kapi.local/", nil, secret)
+	if userID, ok := second.verify(first.token("user1")); !ok || userID != "user1" {
+		t.Errorf("token not valid with the same secret: %v %s", ok, userID)
+	}
+
+	other := newSubscriptionBridge(nil, nil, nil, "http://kapi.local/", nil, nil)
+	if _, ok := other.verify(first.token("user1")); ok {
+		t.Error("token valid with random secret")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kc/kapi/server/servertest"
+)
+
+// echoHandler responds with the identity headers injected by kapid.
+var echoHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	fmt.Fprintf(rw, "%s %s|%s|%s|%s|%s",
+		req.Method,
+		req.URL.Path,
+		req.Header.Get(entryIDRequestHeaderName),
+		req.Header.Get(usernameRequestHeaderName),
+		req.Header.Get(actorEntryIDRequestHeaderName),
+		req.Header.Get("Authorization"),
+	)
+})
+
+type e2e struct {
+	t   *testing.T
+	srv *servertest.Server
+
+	upstreams map[string]*servertest.Upstream
+	tokens    map[string]string
+}
+
+// newE2E starts kapid with the grapi plugin and the provided fake worker
+// sockets, and creates access tokens for the provided users.
+func newE2E(t *testing.T, dir string, sockets []string, users ...string) *e2e {
+	e := &e2e{
+		t: t,
+
+		upstreams: make(map[string]*servertest.Upstream),
+		tokens:    make(map[string]string),
+	}
+	for _, name := range sockets {
+		e.upstreams[name] = servertest.NewUpstream(t, dir, name, echoHandler)
+	}
+	e.srv = servertest.NewServer(t, []string{"grapi"})
+	for _, user := range users {
+		e.tokens[user] = e.srv.Validator.AddToken(&servertest.Token{
+			Subject:     "sub-" + user,
+			UserEntryID: "entry-" + user,
+			Username:    user,
+			Scopes:      scopesRequired,
+		})
+	}
+
+	return e
+}
+
+func (e *e2e) Close() {
+	e.srv.Close()
+	for _, upstream := range e.upstreams {
+		upstream.Close()
+	}
+}
+
+// get requests the provided path as the provided user and returns the
+// status, the upstream and the body of the response.
+func (e *e2e) get(user string, path string, header http.Header) (int, string, string) {
+	req := e.srv.NewRequest(http.MethodGet, path, e.tokens[user], nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+
+	return response.StatusCode, response.Header.Get("X-Upstream"), string(body)
+}
+
+func TestE2EAuthInjection(t *testing.T) {
+	dir, cleanup := servertest.TempDir(t)
+	defer cleanup()
+	defer servertest.Setenv(map[string]string{"KOPANO_GRAPI_SOCKETS": dir})()
+
+	e := newE2E(t, dir, []string{"rest0.sock", "notify0.sock"}, "user1")
+	defer e.Close()
+
+	status, upstream, body := e.get("user1", "/api/gc/v1/me", http.Header{
+		actorEntryIDRequestHeaderName: {"forged"},
+		entryIDRequestHeaderName:      {"forged"},
+	})
+	if status != http.StatusOK || upstream != "rest0.sock" {
+		t.Fatalf("unexpected response: %d %s %s", status, upstream, body)
+	}
+	if expected := "GET /api/gc/v1/me|entry-user1|user1||Bearer " + e.tokens["user1"]; body != expected {
+		t.Errorf("unexpected injected headers: %s", body)
+	}
+
+	status, upstream, _ = e.get("user1", "/api/gc/v1/subscriptions", nil)
+	if status != http.StatusOK || upstream != "notify0.sock" {
+		t.Errorf("subscription request not sent to notify socket: %d %s", status, upstream)
+	}
+
+	if status, _, _ = e.get("unknown", "/api/gc/v1/me", nil); status != http.StatusForbidden {
+		t.Errorf("request without token not denied: %d", status)
+	}
+	if e.upstreams["rest0.sock"].Requests() != 1 {
+		t.Errorf("denied request reached upstream")
+	}
+}
+
+func TestE2ELoadBalancing(t *testing.T) {
+	dir, cleanup := servertest.TempDir(t)
+	defer cleanup()
+	defer servertest.Setenv(map[string]string{"KOPANO_GRAPI_SOCKETS": dir})()
+
+	users := make([]string, 0, 20)
+	for i := 0; i < cap(users); i++ {
+		users = append(users, fmt.Sprintf("user%d", i))
+	}
+	e := newE2E(t, dir, []string{"rest0.sock", "rest1.sock", "rest2.sock"}, users...)
+	defer e.Close()
+
+	// Users always go to the same worker, and all workers get users.
+	assigned := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for _, user := range users {
+			status, upstream, body := e.get(user, "/api/gc/v1/me", nil)
+			if status != http.StatusOK {
+				t.Fatalf("unexpected response: %d %s", status, body)
+			}
+			if previous, ok := assigned[user]; ok && previous != upstream {
+				t.Errorf("user %s moved from %s to %s", user, previous, upstream)
+			}
+			assigned[user] = upstream
+		}
+	}
+	for name, upstream := range e.upstreams {
+		if upstream.Requests() == 0 {
+			t.Errorf("worker %s got no requests", name)
+		}
+	}
+
+	// Users of a failed worker fail over to the others, the others stay.
+	failed := assigned[users[0]]
+	e.upstreams[failed].Close()
+	for _, user := range users {
+		status, upstream, body := e.get(user, "/api/gc/v1/me", nil)
+		if status != http.StatusOK || upstream == failed {
+			t.Fatalf("request of %s not failed over: %d %s %s", user, status, upstream, body)
+		}
+		if assigned[user] != failed && assigned[user] != upstream {
+			t.Errorf("user %s of healthy worker moved from %s to %s", user, assigned[user], upstream)
+		}
+	}
+
+	// Added workers get users once their socket appears.
+	e.upstreams["rest3.sock"] = servertest.NewUpstream(t, dir, "rest3.sock", echoHandler)
+	deadline := time.Now().Add(5 * time.Second)
+	for e.upstreams["rest3.sock"].Requests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("added worker got no requests")
+		}
+		for _, user := range users {
+			e.get(user, "/api/gc/v1/me", nil)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestE2EBatchAbortedResponse(t *testing.T) {
+	dir, cleanup := servertest.TempDir(t)
+	defer cleanup()
+	defer servertest.Setenv(map[string]string{"KOPANO_GRAPI_SOCKETS": dir})()
+
+	e := newE2E(t, dir, nil, "user1")
+	defer e.Close()
+	e.upstreams["rest0.sock"] = servertest.NewUpstream(t, dir, "rest0.sock", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/gc/v1/me/abort" {
+			echoHandler.ServeHTTP(rw, req)
+			return
+		}
+		// Break off in the middle of the body.
+		rw.Header().Set("Content-Length", "100")
+		rw.Write([]byte("partial"))
+		rw.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+
+	// Wait for the worker socket to be picked up.
+	deadline := time.Now().Add(5 * time.Second)
+	for status, _, _ := e.get("user1", "/api/gc/v1/me", nil); status != http.StatusOK; status, _, _ = e.get("user1", "/api/gc/v1/me", nil) {
+		if time.Now().After(deadline) {
+			t.Fatalf("worker not available: %d", status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	req := e.srv.NewRequest(http.MethodPost, batchPath, e.tokens["user1"], strings.NewReader(`{"requests":[{"id":"1","method":"GET","url":"/me/abort"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected batch status: %d", response.StatusCode)
+	}
+
+	var result struct {
+		Responses []struct {
+			ID     string `json:"id"`
+			Status int    `json:"status"`
+		} `json:"responses"`
+	}
+	if err = json.NewDecoder(response.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Responses) != 1 || result.Responses[0].Status != http.StatusBadGateway {
+		t.Errorf("unexpected batch responses: %+v", result.Responses)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"stash.kopano.io/kc/kapi/auth"
+)
+
+// impersonationScope is the scope which a token must have been authorized
+// for to act on behalf of other users.
+const impersonationScope = "kopano/gc.impersonate"
+
+var errImpersonationDenied = errors.New("impersonation denied")
+
+// impersonationPolicy is the allowlist which defines which actors can act on
+// behalf of which target users. Actors and targets are user entry IDs, or
+// client IDs for actors which are service clients. The target `*` matches all
+// users.
+type impersonationPolicy struct {
+	Rules []*impersonationRule `json:"rules"`
+}
+
+type impersonationRule struct {
+	Actors  []string `json:"actors"`
+	Targets []string `json:"targets"`
+}
+
+func loadImpersonationPolicy(fn string) (*impersonationPolicy, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &impersonationPolicy{}
+	if err = json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse impersonation policy: %v", err)
+	}
+	for idx, rule := range policy.Rules {
+		if rule == nil || len(rule.Actors) == 0 || len(rule.Targets) == 0 {
+			return nil, fmt.Errorf("impersonation policy rule %d without actors or targets", idx)
+		}
+	}
+
+	return policy, nil
+}
+
+// allowed returns true if the accociated policy allows the provided actor to
+// act on behalf of the provided target.
+func (policy *impersonationPolicy) allowed(actor, target string) bool {
+	for _, rule := range policy.Rules {
+		if !containsString(rule.Actors, actor) {
+			continue
+		}
+		if containsString(rule.Targets, "*") || containsString(rule.Targets, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorizeImpersonation returns nil if the provided auth record is allowed
+// to act on behalf of target.
+func (p *KopanoGroupwareCorePlugin) authorizeImpersonation(authRecord *auth.Record, actor, target string) error {
+	if p.impersonation == nil {
+		return errImpersonationDenied
+	}
+	if authRecord.ExtraClaims == nil || !auth.KCAuthorizedScopesFromClaims(authRecord.ExtraClaims)[impersonationScope] {
+		return errImpersonationDenied
+	}
+	if authRecord.ServicePrincipal != nil && !authRecord.ServicePrincipal.AllowsScopes([]string{impersonationScope}) {
+		return errImpersonationDenied
+	}
+	if !p.impersonation.allowed(actor, target) {
+		return errImpersonationDenied
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+func TestImpersonation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kapi-grapi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "impersonation.json")
+	err = ioutil.WriteFile(fn, []byte(`{"rules":[
+		{"actors":["admin"],"targets":["*"]},
+		{"actors":["service"],"targets":["user1"]},
+		{"actors":["backup"],"targets":["*"]}
+	]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := loadImpersonationPolicy(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &KopanoGroupwareCorePlugin{
+		srv:           pluginstest.NewServer(),
+		impersonation: policy,
+	}
+
+	newRecord := func(userID string, scopes ...interface{}) *auth.Record {
+		return &auth.Record{
+			AuthenticatedUserID: "sub-" + userID,
+			ExtraClaims: &kcoidc.ExtraClaimsWithType{
+				auth.IdentityClaim: map[string]interface{}{
+					auth.IdentifiedUserIDClaim:   userID,
+					auth.IdentifiedUsernameClaim: userID + "@example.com",
+				},
+				auth.AuthorizedScopesClaim: scopes,
+			},
+		}
+	}
+
+	newServiceRecord := func(clientID string, allowedScopes ...string) *auth.Record {
+		return &auth.Record{
+			AuthenticatedUserID: clientID,
+			ExtraClaims: &kcoidc.ExtraClaimsWithType{
+				auth.AuthorizedScopesClaim: []interface{}{impersonationScope},
+			},
+			ServicePrincipal: &auth.ServicePrincipal{
+				ClientID: clientID,
+				Scopes:   allowedScopes,
+			},
+		}
+	}
+
+	for _, test := range []struct {
+		record   *auth.Record
+		target   string
+		allowed  bool
+		entryID  string
+		username string
+		actor    string
+	}{
+		{newRecord("user1"), "", true, "user1", "user1@example.com", ""},
+		{newRecord("admin", impersonationScope), "user2", true, "user2", "", "admin"},
+		{newRecord("admin"), "user2", false, "", "", ""},
+		{newRecord("service", impersonationScope), "user1", true, "user1", "", "service"},
+		{newRecord("service", impersonationScope), "user2", false, "", "", ""},
+		{newRecord("user1", impersonationScope), "user2", false, "", "", ""},
+		{newRecord("user1", impersonationScope), "user1", true, "user1", "user1@example.com", ""},
+		{newServiceRecord("backup", impersonationScope), "user2", true, "user2", "", "backup"},
+		{newServiceRecord("backup", impersonationScope), "", false, "", "", ""},
+		{newServiceRecord("backup", impersonationScope), "backup", false, "", "", ""},
+		{newServiceRecord("user1", impersonationScope), "user1", false, "", "", ""},
+		{newServiceRecord("backup"), "user2", false, "", "", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/gc/v1/me", nil)
+		req = req.WithContext(auth.ContextWithRecord(req.Context(), test.record))
+		req.Header.Set(actorEntryIDRequestHeaderName, "spoofed")
+		if test.target != "" {
+			req.Header.Set(impersonateRequestHeaderName, test.target)
+		}
+
+		err := p.injectAuthIntoRequestHeaders(req)
+		if (err == nil) != test.allowed {
+			t.Errorf("%s as %s: expected allowed %v, got %v", test.record.AuthenticatedUserID, test.target, test.allowed, err)
+			continue
+		}
+		if !test.allowed {
+			continue
+		}
+		if v := req.Header.Get(entryIDRequestHeaderName); v != test.entryID {
+			t.Errorf("%s as %s: unexpected entry ID %s", test.record.AuthenticatedUserID, test.target, v)
+		}
+		if v := req.Header.Get(usernameRequestHeaderName); v != test.username {
+			t.Errorf("%s as %s: unexpected username %s", test.record.AuthenticatedUserID, test.target, v)
+		}
+		if v := req.Header.Get(actorEntryIDRequestHeaderName); v != test.actor {
+			t.Errorf("%s as %s: unexpected actor %s", test.record.AuthenticatedUserID, test.target, v)
+		}
+		if v := req.Header.Get(impersonateRequestHeaderName); v != "" {
+			t.Errorf("%s as %s: impersonate header not removed", test.record.AuthenticatedUserID, test.target)
+		}
+	}
+
+	// Disabled without policy.
+	p.impersonation = nil
+	req := httptest.NewRequest(http.MethodGet, "/api/gc/v1/me", nil)
+	req = req.WithContext(auth.ContextWithRecord(req.Context(), newRecord("admin", impersonationScope)))
+	req.Header.Set(impersonateRequestHeaderName, "user2")
+	if err := p.injectAuthIntoRequestHeaders(req); err != errImpersonationDenied {
+		t.Errorf("expected impersonation to be denied without policy, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sizeLimit is the maximum request or response body size of the API paths
+// which match its expression.
+type sizeLimit struct {
+	path  *regexp.Regexp
+	limit int64
+}
+
+// timeoutLimit is the response header timeout of the API paths which match
+// its expression.
+type timeoutLimit struct {
+	path    *regexp.Regexp
+	timeout time.Duration
+}
+
+// splitRouteLimit splits a `<regexp>=<value>` entry.
+func splitRouteLimit(entry string, valueName string) (*regexp.Regexp, string, error) {
+	idx := strings.LastIndex(entry, "=")
+	if idx < 1 {
+		return nil, "", fmt.Errorf("invalid entry %s, expected <regexp>=<%s>", entry, valueName)
+	}
+	path, err := regexp.Compile(entry[:idx])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid path in %s: %v", entry, err)
+	}
+
+	return path, entry[idx+1:], nil
+}
+
+// parseSizeLimits parses a space separated list of `<regexp>=<bytes>`
+// entries.
+func parseSizeLimits(value string) ([]*sizeLimit, error) {
+	limits := make([]*sizeLimit, 0)
+	for _, entry := range strings.Fields(value) {
+		path, v, err := splitRouteLimit(entry, "bytes")
+		if err != nil {
+			return nil, err
+		}
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid size in %s", entry)
+		}
+		limits = append(limits, &sizeLimit{
+			path:  path,
+			limit: limit,
+		})
+	}
+
+	return limits, nil
+}
+
+// parseTimeoutLimits parses a space separated list of `<regexp>=<duration>`
+// entries.
+func parseTimeoutLimits(value string) ([]*timeoutLimit, error) {
+	limits := make([]*timeoutLimit, 0)
+	for _, entry := range strings.Fields(value) {
+		path, v, err := splitRouteLimit(entry, "duration")
+		if err != nil {
+			return nil, err
+		}
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid duration in %s", entry)
+		}
+		limits = append(limits, &timeoutLimit{
+			path:    path,
+			timeout: timeout,
+		})
+	}
+
+	return limits, nil
+}
+
+func matchSizeLimit(limits []*sizeLimit, path string) (int64, bool) {
+	for _, limit := range limits {
+		if limit.path.MatchString(path) {
+			return limit.limit, true
+		}
+	}
+
+	return 0, false
+}
+
+// maxRequestSize returns the request body size limit of the provided path,
+// if the path has its own limit.
+func (p *KopanoGroupwareCorePlugin) maxRequestSize(path string) (int64, bool) {
+	return matchSizeLimit(p.requestSizeLimits, path)
+}
+
+// maxResponseSize returns the response body size limit of the provided path,
+// if the path has its own limit.
+func (p *KopanoGroupwareCorePlugin) maxResponseSize(path string) (int64, bool) {
+	return matchSizeLimit(p.responseSizeLimits, path)
+}
+
+// responseHeaderTimeout returns the response header timeout of the provided
+// path, if the path has its own timeout.
+func (p *KopanoGroupwareCorePlugin) responseHeaderTimeout(path string) (time.Duration, bool) {
+	for _, limit := range p.responseHeaderTimeouts {
+		if limit.path.MatchString(path) {
+			return limit.timeout, true
+		}
+	}
+
+	return 0, false
+}
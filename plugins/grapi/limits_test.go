@@ -0,0 +1,71 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteLimits(t *testing.T) {
+	limits, err := parseSizeLimits(`/attachments$=157286400 ^/api/gc/v1/me/photo/\$value$=4194304 /x=y=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &KopanoGroupwareCorePlugin{
+		requestSizeLimits: limits,
+	}
+
+	for path, expected := range map[string]int64{
+		"/api/gc/v1/me/messages/1/attachments": 157286400,
+		"/api/gc/v1/me/photo/$value":           4194304,
+		"/api/gc/v1/x=y":                       1,
+		"/api/gc/v1/me":                        -1,
+	} {
+		limit, ok := p.maxRequestSize(path)
+		if !ok {
+			limit = -1
+		}
+		if limit != expected {
+			t.Errorf("%s: expected limit %d, got %d", path, expected, limit)
+		}
+	}
+
+	for _, invalid := range []string{"/attachments", "=1", "/a=-1", "(=1"} {
+		if _, err := parseSizeLimits(invalid); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+
+	timeouts, err := parseTimeoutLimits(`/attachments/[^/]+/\$value$=10m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.responseHeaderTimeouts = timeouts
+	if timeout, ok := p.responseHeaderTimeout("/api/gc/v1/me/messages/1/attachments/2/$value"); !ok || timeout != 10*time.Minute {
+		t.Errorf("unexpected attachment timeout: %v", timeout)
+	}
+	if _, ok := p.responseHeaderTimeout("/api/gc/v1/me"); ok {
+		t.Errorf("unexpected timeout for path without own timeout")
+	}
+	for _, invalid := range []string{"/a=1", "/a=-1s", "/a"} {
+		if _, err := parseTimeoutLimits(invalid); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
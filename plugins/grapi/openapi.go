@@ -0,0 +1,140 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"text/template"
+
+	"stash.kopano.io/kc/kapi/openapi"
+)
+
+// NOTE(longsleep): The grapi endpoints are provided by the upstream GRAPI
+// workers and are only described in general here. See the GRAPI project for
+// the documentation of the actual resources.
+var openAPITemplate = template.Must(template.New("openapi").Funcs(openapi.TemplateFuncs).Parse(`{
+	"openapi": "3.0.3",
+	"tags": [
+		{
+			"name": "grapi",
+			"description": "Kopano Groupware REST API, proxied to GRAPI"
+		}
+	],
+	"paths": {
+		"/api/gc/v1/subscriptions": {
+			"get": {
+				"tags": ["grapi"],
+				"summary": "List subscriptions",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"200": {"$ref": "#/components/responses/grapiUpstream"},
+					"403": {"description": "Access denied."},
+					"502": {"description": "No GRAPI subscription worker available."}
+				}
+			},
+			"post": {
+				"tags": ["grapi"],
+				"summary": "Create subscription",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"requestBody": {
+					"content": {
+						"application/json": {}
+					}
+				},
+				"responses": {
+					"201": {"$ref": "#/components/responses/grapiUpstream"},
+					"403": {"description": "Access denied."},
+					"502": {"description": "No GRAPI subscription worker available."}
+				}
+			}
+		},
+		"/api/gc/v1/{resource}": {
+			"parameters": [
+				{
+					"name": "resource",
+					"in": "path",
+					"required": true,
+					"description": "Path of the GRAPI resource, for example me or users/{id}. Can contain slashes.",
+					"schema": {
+						"type": "string"
+					}
+				}
+			],
+			"get": {
+				"tags": ["grapi"],
+				"summary": "Get resource",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"200": {"$ref": "#/components/responses/grapiUpstream"},
+					"403": {"description": "Access denied."},
+					"502": {"description": "No GRAPI worker available."}
+				}
+			},
+			"post": {
+				"tags": ["grapi"],
+				"summary": "Create resource or invoke action",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"default": {"$ref": "#/components/responses/grapiUpstream"}
+				}
+			},
+			"patch": {
+				"tags": ["grapi"],
+				"summary": "Update resource",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"default": {"$ref": "#/components/responses/grapiUpstream"}
+				}
+			},
+			"put": {
+				"tags": ["grapi"],
+				"summary": "Replace resource",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"default": {"$ref": "#/components/responses/grapiUpstream"}
+				}
+			},
+			"delete": {
+				"tags": ["grapi"],
+				"summary": "Delete resource",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"default": {"$ref": "#/components/responses/grapiUpstream"}
+				}
+			}
+		}
+	},
+	"components": {
+		"responses": {
+			"grapiUpstream": {
+				"description": "Response of the upstream GRAPI worker.",
+				"content": {
+					"application/json": {}
+				}
+			}
+		}
+	}
+}`))
+
+// OpenAPIV1 returns the OpenAPI document fragment of the accociated plugin.
+func (p *KopanoGroupwareCorePlugin) OpenAPIV1() (*openapi.Document, error) {
+	return openapi.Execute(openAPITemplate, &struct {
+		Scopes []string
+	}{
+		Scopes: scopesRequired,
+	})
+}
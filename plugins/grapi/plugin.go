@@ -18,18 +18,27 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/rs/cors"
+	"github.com/sirupsen/logrus"
 
 	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/plugins/pubs"
 	"stash.kopano.io/kc/kapi/proxy"
+	"stash.kopano.io/kc/kapi/proxy/httpcache"
+	"stash.kopano.io/kc/kapi/proxy/httpproxy"
+	"stash.kopano.io/kc/kapi/proxy/transform"
 	"stash.kopano.io/kc/kapi/version"
 )
 
@@ -37,10 +46,11 @@ var pluginInfo = &plugins.InfoV1{
 	ID:        "grapi",
 	Version:   version.Version,
 	BuildDate: version.BuildDate,
+
+	OptionalDependencies: []string{"pubs"},
 }
 
 var scopesRequired = []string{"profile", "email", "kopano/gc"}
-var apiV0Enabled = false
 
 // KopanoGroupwareCorePlugin implements the Kopano Groupware Core API within
 // Kopano API.
@@ -53,8 +63,23 @@ type KopanoGroupwareCorePlugin struct {
 
 	cors *cors.Cors
 
+	versions apiVersions
+
+	proxyConfiguration *httpproxy.Configuration
+	notifyPingInterval time.Duration
+	cache              *httpcache.Cache
+	transformer        *transform.Transformer
+	requestSizeLimits  []*sizeLimit
+
+	responseSizeLimits     []*sizeLimit
+	responseHeaderTimeouts []*timeoutLimit
+
 	defaultProxy      proxy.HTTPProxyHandler
 	subscriptionProxy proxy.HTTPProxyHandler
+
+	bridge        *subscriptionBridge
+	impersonation *impersonationPolicy
+	auditor       *auditor
 }
 
 // Info returns the accociated plugins plugin.Info.
@@ -69,18 +94,24 @@ func (p *KopanoGroupwareCorePlugin) Initialize(ctx context.Context, errCh chan<-
 
 	srv.Logger().Debugln("grapi: initialize")
 
+	var err error
+	restUpstreams := strings.Fields(os.Getenv("KOPANO_GRAPI_UPSTREAMS"))
+	notifyUpstreams := strings.Fields(os.Getenv("KOPANO_GRAPI_NOTIFY_UPSTREAMS"))
+
 	socketPath := os.Getenv("KOPANO_GRAPI_SOCKETS")
-	if socketPath == "" {
-		return fmt.Errorf("KOPANO_GRAPI_SOCKETS environment variable is not set but required")
+	if socketPath == "" && len(restUpstreams) == 0 {
+		return fmt.Errorf("KOPANO_GRAPI_SOCKETS or KOPANO_GRAPI_UPSTREAMS environment variable is not set but required")
 	}
 
-	socketPath, err := filepath.Abs(socketPath)
-	if err != nil {
-		return fmt.Errorf("KOPANO_GRAPI_SOCKETS value is invalid: %v", err)
-	}
+	if socketPath != "" {
+		socketPath, err = filepath.Abs(socketPath)
+		if err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_SOCKETS value is invalid: %v", err)
+		}
 
-	if fp, err := os.Stat(socketPath); err != nil || !fp.IsDir() {
-		p.srv.Logger().Warnf("KOPANO_GRAPI_SOCKETS does not exist or is not a directory: %v", err)
+		if fp, statErr := os.Stat(socketPath); statErr != nil || !fp.IsDir() {
+			p.srv.Logger().Warnf("KOPANO_GRAPI_SOCKETS does not exist or is not a directory: %v", statErr)
+		}
 	}
 
 	if os.Getenv("KOPANO_GRAPI_ALLOW_CORS") == "1" {
@@ -94,78 +125,358 @@ func (p *KopanoGroupwareCorePlugin) Initialize(ctx context.Context, errCh chan<-
 	}
 	p.srv.Logger().WithField("required_scopes", scopesRequired).Infoln("grapi: access requirements set up")
 
-	if os.Getenv("KOPANO_GRAPI_ENABLE_API_V0") == "1" {
-		apiV0Enabled = true
-		p.srv.Logger().Warnln("grapi: obsolete insecure API v0 endpoints enabled")
+	p.versions, err = newAPIVersions(scopesRequired, os.Getenv("KOPANO_GRAPI_ENABLE_API_V0") == "1")
+	if err != nil {
+		return err
+	}
+	for _, v := range p.versions {
+		if v.name == "v0" {
+			p.srv.Logger().Warnln("grapi: obsolete API v0 endpoints enabled")
+		}
+		if len(v.scopesRequired) == 0 {
+			p.srv.Logger().WithField("version", v.name).Warnln("grapi: API version requires no scopes")
+		}
+		p.srv.Logger().WithFields(logrus.Fields{
+			"version":         v.name,
+			"required_scopes": v.scopesRequired,
+			"deprecated":      v.deprecated,
+		}).Debugln("grapi: API version enabled")
 	}
 
-	// Start looking for rest sockets asynchronously to allow them to start later.
-	go func() {
-		pr, err := p.initializeProxy(ctx, socketPath, "rest*.sock")
-		if err != nil {
-			errCh <- err
-			return
+	proxyConfiguration := *restProxyConfiguration
+	if healthCheckPath := os.Getenv("KOPANO_GRAPI_HEALTH_CHECK_PATH"); healthCheckPath != "" {
+		proxyConfiguration.HealthCheckPath = healthCheckPath
+		if v := os.Getenv("KOPANO_GRAPI_HEALTH_CHECK_INTERVAL"); v != "" {
+			if proxyConfiguration.HealthCheckInterval, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("KOPANO_GRAPI_HEALTH_CHECK_INTERVAL value is invalid: %v", err)
+			}
+		}
+		if v := os.Getenv("KOPANO_GRAPI_HEALTH_CHECK_TIMEOUT"); v != "" {
+			if proxyConfiguration.HealthCheckTimeout, err = time.ParseDuration(v); err != nil {
+				return fmt.Errorf("KOPANO_GRAPI_HEALTH_CHECK_TIMEOUT value is invalid: %v", err)
+			}
+		}
+		if v := os.Getenv("KOPANO_GRAPI_HEALTHY_THRESHOLD"); v != "" {
+			threshold, parseErr := strconv.ParseUint(v, 10, 32)
+			if parseErr != nil {
+				return fmt.Errorf("KOPANO_GRAPI_HEALTHY_THRESHOLD value is invalid: %v", parseErr)
+			}
+			proxyConfiguration.HealthyThreshold = uint(threshold)
+		}
+		if v := os.Getenv("KOPANO_GRAPI_UNHEALTHY_THRESHOLD"); v != "" {
+			threshold, parseErr := strconv.ParseUint(v, 10, 32)
+			if parseErr != nil {
+				return fmt.Errorf("KOPANO_GRAPI_UNHEALTHY_THRESHOLD value is invalid: %v", parseErr)
+			}
+			proxyConfiguration.UnhealthyThreshold = uint(threshold)
 		}
-		if pr == nil {
-			return
+		p.srv.Logger().WithFields(logrus.Fields{
+			"path":     proxyConfiguration.HealthCheckPath,
+			"interval": proxyConfiguration.HealthCheckInterval,
+			"timeout":  proxyConfiguration.HealthCheckTimeout,
+		}).Infoln("grapi: upstream health checks enabled")
+	}
+	if v := os.Getenv("KOPANO_GRAPI_RESPONSE_HEADER_TIMEOUT"); v != "" {
+		if proxyConfiguration.ResponseHeaderTimeout, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_RESPONSE_HEADER_TIMEOUT value is invalid: %v", err)
+		}
+	}
+	if p.responseHeaderTimeouts, err = parseTimeoutLimits(os.Getenv("KOPANO_GRAPI_RESPONSE_HEADER_TIMEOUT_ROUTES")); err != nil {
+		return fmt.Errorf("KOPANO_GRAPI_RESPONSE_HEADER_TIMEOUT_ROUTES value is invalid: %v", err)
+	}
+	if v := os.Getenv("KOPANO_GRAPI_MAX_RESPONSE_SIZE"); v != "" {
+		if proxyConfiguration.MaxResponseSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_MAX_RESPONSE_SIZE value is invalid: %v", err)
 		}
+	}
+	if p.responseSizeLimits, err = parseSizeLimits(os.Getenv("KOPANO_GRAPI_MAX_RESPONSE_SIZE_ROUTES")); err != nil {
+		return fmt.Errorf("KOPANO_GRAPI_MAX_RESPONSE_SIZE_ROUTES value is invalid: %v", err)
+	}
+
+	p.notifyPingInterval = defaultNotifyPingInterval
+	if v := os.Getenv("KOPANO_GRAPI_NOTIFY_PING_INTERVAL"); v != "" {
+		if p.notifyPingInterval, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_NOTIFY_PING_INTERVAL value is invalid: %v", err)
+		}
+	}
+
+	if v := os.Getenv("KOPANO_GRAPI_MAX_REQUEST_SIZE"); v != "" {
+		if proxyConfiguration.MaxRequestSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_MAX_REQUEST_SIZE value is invalid: %v", err)
+		}
+	}
+	if p.requestSizeLimits, err = parseSizeLimits(os.Getenv("KOPANO_GRAPI_MAX_REQUEST_SIZE_ROUTES")); err != nil {
+		return fmt.Errorf("KOPANO_GRAPI_MAX_REQUEST_SIZE_ROUTES value is invalid: %v", err)
+	}
+
+	if v := os.Getenv("KOPANO_GRAPI_CACHE_SIZE"); v != "" {
+		cacheSize, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("KOPANO_GRAPI_CACHE_SIZE value is invalid: %v", parseErr)
+		}
+		var cacheMaxEntrySize int64 = 1024 * 1024
+		if v = os.Getenv("KOPANO_GRAPI_CACHE_MAX_ENTRY_SIZE"); v != "" {
+			if cacheMaxEntrySize, parseErr = strconv.ParseInt(v, 10, 64); parseErr != nil {
+				return fmt.Errorf("KOPANO_GRAPI_CACHE_MAX_ENTRY_SIZE value is invalid: %v", parseErr)
+			}
+		}
+		if cacheSize > 0 {
+			p.cache = httpcache.New("grapi", cacheSize, cacheMaxEntrySize)
+			p.srv.Logger().WithFields(logrus.Fields{
+				"size":           cacheSize,
+				"max_entry_size": cacheMaxEntrySize,
+			}).Infoln("grapi: response cache enabled")
+		}
+	}
+
+	if fn := os.Getenv("KOPANO_GRAPI_IMPERSONATION_POLICY"); fn != "" {
+		if p.impersonation, err = loadImpersonationPolicy(fn); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_IMPERSONATION_POLICY value is invalid: %v", err)
+		}
+		p.srv.Logger().WithField("rules", len(p.impersonation.Rules)).Infoln("grapi: impersonation enabled")
+	}
+
+	if bridgeURL := os.Getenv("KOPANO_GRAPI_PUBS_BRIDGE_URL"); bridgeURL != "" {
+		usersService, _ := srv.LookupService(pubs.UsersServiceID)
+		users, _ := usersService.(pubs.Users)
+		publisherService, _ := srv.LookupService(pubs.PublisherServiceID)
+		publisher, _ := publisherService.(pubs.Publisher)
+		if users == nil || publisher == nil {
+			return fmt.Errorf("KOPANO_GRAPI_PUBS_BRIDGE_URL requires the pubs plugin")
+		}
+		var bridgeSecret []byte
+		if fn := os.Getenv("KOPANO_GRAPI_PUBS_BRIDGE_SECRET_FILE"); fn != "" {
+			if bridgeSecret, err = ioutil.ReadFile(fn); err != nil {
+				return fmt.Errorf("KOPANO_GRAPI_PUBS_BRIDGE_SECRET_FILE value is invalid: %v", err)
+			}
+			bridgeSecret = bytes.TrimSpace(bridgeSecret)
+			if len(bridgeSecret) < 32 {
+				return fmt.Errorf("KOPANO_GRAPI_PUBS_BRIDGE_SECRET_FILE value is invalid: secret must be at least 32 bytes")
+			}
+		} else {
+			p.srv.Logger().Warnln("grapi: KOPANO_GRAPI_PUBS_BRIDGE_SECRET_FILE is not set, existing subscriptions stop delivering notifications on restart")
+		}
+		p.bridge = newSubscriptionBridge(p, users, publisher, bridgeURL, strings.Fields(os.Getenv("KOPANO_GRAPI_PUBS_BRIDGE_RESOURCES")), bridgeSecret)
+		users.WatchUsers(p.bridge)
+		p.srv.Logger().WithField("url", bridgeURL).Infoln("grapi: pubs subscription bridge enabled")
+	}
+
+	if target := os.Getenv("KOPANO_GRAPI_AUDIT_LOG"); target != "" {
+		var auditMaxSize int64 = 100 * 1024 * 1024
+		if v := os.Getenv("KOPANO_GRAPI_AUDIT_LOG_MAX_SIZE"); v != "" {
+			if auditMaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return fmt.Errorf("KOPANO_GRAPI_AUDIT_LOG_MAX_SIZE value is invalid: %v", err)
+			}
+		}
+		auditMaxFiles := 10
+		if v := os.Getenv("KOPANO_GRAPI_AUDIT_LOG_MAX_FILES"); v != "" {
+			if auditMaxFiles, err = strconv.Atoi(v); err != nil {
+				return fmt.Errorf("KOPANO_GRAPI_AUDIT_LOG_MAX_FILES value is invalid: %v", err)
+			}
+			if auditMaxFiles < 1 {
+				return fmt.Errorf("KOPANO_GRAPI_AUDIT_LOG_MAX_FILES value is invalid: must be at least 1")
+			}
+		}
+		var auditKey []byte
+		if fn := os.Getenv("KOPANO_GRAPI_AUDIT_KEY_FILE"); fn != "" {
+			if auditKey, err = ioutil.ReadFile(fn); err != nil {
+				return fmt.Errorf("KOPANO_GRAPI_AUDIT_KEY_FILE value is invalid: %v", err)
+			}
+			auditKey = bytes.TrimSpace(auditKey)
+		} else {
+			p.srv.Logger().Warnln("grapi: KOPANO_GRAPI_AUDIT_KEY_FILE is not set, audit records are chained without key")
+		}
+		if p.auditor, err = newAuditor(target, auditMaxSize, auditMaxFiles, auditKey, strings.Fields(os.Getenv("KOPANO_GRAPI_AUDIT_READS"))); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_AUDIT_LOG value is invalid: %v", err)
+		}
+		p.srv.Logger().WithField("target", target).Infoln("grapi: audit log enabled")
+	}
+
+	if fn := os.Getenv("KOPANO_GRAPI_TRANSFORM_RULES"); fn != "" {
+		if p.transformer, err = transform.Load(fn); err != nil {
+			return fmt.Errorf("KOPANO_GRAPI_TRANSFORM_RULES value is invalid: %v", err)
+		}
+		p.srv.Logger().WithField("rules", fn).Infoln("grapi: request and response transformations enabled")
+	}
+
+	proxyConfiguration.TLSCAFile = os.Getenv("KOPANO_GRAPI_UPSTREAM_CA_FILE")
+	proxyConfiguration.TLSCertFile = os.Getenv("KOPANO_GRAPI_UPSTREAM_CERT_FILE")
+	proxyConfiguration.TLSKeyFile = os.Getenv("KOPANO_GRAPI_UPSTREAM_KEY_FILE")
+	proxyConfiguration.TLSServerName = os.Getenv("KOPANO_GRAPI_UPSTREAM_SERVER_NAME")
+	if os.Getenv("KOPANO_GRAPI_UPSTREAM_INSECURE_SKIP_VERIFY") == "1" {
+		p.srv.Logger().Warnln("grapi: insecure mode, TLS verification of upstreams is disabled")
+		proxyConfiguration.TLSInsecureSkipVerify = true
+	}
+	p.proxyConfiguration = &proxyConfiguration
 
+	err = p.startUpstreams(ctx, errCh, "rest", socketPath, "rest*.sock", restUpstreams, func(pr *httpproxy.Proxy) {
 		p.mutex.Lock()
 		p.defaultProxy = pr
 		p.mutex.Unlock()
 		p.srv.Logger().Debugf("grapi: enabled default api proxy")
-	}()
-
-	// Start looking for subscriptions ockets asynchronously to allow them to start later.
-	go func() {
-		pr, err := p.initializeProxy(ctx, socketPath, "notify*.sock")
-		if err != nil {
-			errCh <- err
-			return
-		}
-		if pr == nil {
-			return
-		}
+	})
+	if err != nil {
+		return fmt.Errorf("KOPANO_GRAPI_UPSTREAMS value is invalid: %v", err)
+	}
 
+	err = p.startUpstreams(ctx, errCh, "notify", socketPath, "notify*.sock", notifyUpstreams, func(pr *httpproxy.Proxy) {
 		p.mutex.Lock()
 		p.subscriptionProxy = pr
 		p.mutex.Unlock()
 		p.srv.Logger().Debugf("grapi: enabled subscription proxy")
+	})
+	if err != nil {
+		return fmt.Errorf("KOPANO_GRAPI_NOTIFY_UPSTREAMS value is invalid: %v", err)
+	}
+
+	return nil
+}
+
+// poolConfiguration returns the proxy configuration for the provided pool.
+// Subscription requests are streamed and can wait long for a response, their
+// WebSocket connections and event streams are kept alive with pings.
+func (p *KopanoGroupwareCorePlugin) poolConfiguration(pool string) *httpproxy.Configuration {
+	configuration := p.proxyConfiguration
+	if configuration == nil {
+		configuration = restProxyConfiguration
+	}
+
+	if pool == "notify" {
+		notifyConfiguration := *configuration
+		notifyConfiguration.ResponseHeaderTimeout = 0
+		notifyConfiguration.MaxResponseSize = 0
+		notifyConfiguration.FlushInterval = -1
+		notifyConfiguration.PingInterval = p.notifyPingInterval
+		return &notifyConfiguration
+	}
+
+	return configuration
+}
+
+// startUpstreams creates the proxy for the provided pool. When upstreams are
+// given explicitly they are used as is, otherwise the socket files matching
+// the provided pattern in socketPath are watched asynchronously to allow
+// them to start later and to follow added and removed workers.
+func (p *KopanoGroupwareCorePlugin) startUpstreams(ctx context.Context, errCh chan<- error, pool string, socketPath string, pattern string, upstreams []string, onProxy func(*httpproxy.Proxy)) error {
+	if len(upstreams) > 0 {
+		pr, err := httpproxy.New("grapi-"+pool, upstreams, p.poolConfiguration(pool))
+		if err != nil {
+			return err
+		}
+		p.srv.Logger().WithField("upstreams", upstreams).Infof("grapi: using %d %s upstream proxy workers", len(upstreams), pool)
+		onProxy(pr)
+
+		go func() {
+			select {
+			case <-p.exitCh:
+			case <-ctx.Done():
+			}
+			pr.Close()
+		}()
+
+		return nil
+	}
+
+	if socketPath == "" {
+		p.srv.Logger().Warnf("grapi: no %s upstreams configured", pool)
+		return nil
+	}
+
+	go func() {
+		err := p.newUpstreamWatcher(pool, socketPath, pattern, onProxy).Watch(ctx)
+		if err != nil {
+			errCh <- err
+		}
 	}()
 
 	return nil
 }
 
+// HealthV1 returns the health of the accociated plugin. It is healthy as long
+// as at least one rest upstream is healthy.
+func (p *KopanoGroupwareCorePlugin) HealthV1() *plugins.HealthV1 {
+	p.mutex.RLock()
+	defaultProxy, _ := p.defaultProxy.(*httpproxy.Proxy)
+	subscriptionProxy, _ := p.subscriptionProxy.(*httpproxy.Proxy)
+	p.mutex.RUnlock()
+
+	details := make(map[string]*httpproxy.Status)
+	health := &plugins.HealthV1{
+		Details: details,
+	}
+	if defaultProxy != nil {
+		details["rest"] = defaultProxy.Status()
+		health.Healthy = details["rest"].Healthy > 0
+	}
+	if subscriptionProxy != nil {
+		details["notify"] = subscriptionProxy.Status()
+	}
+
+	return health
+}
+
+// DrainV1 ends the WebSocket connections and event streams of the accociated
+// plugin cleanly, so subscription clients reconnect to another instance.
+func (p *KopanoGroupwareCorePlugin) DrainV1() {
+	p.mutex.RLock()
+	defaultProxy, _ := p.defaultProxy.(*httpproxy.Proxy)
+	subscriptionProxy, _ := p.subscriptionProxy.(*httpproxy.Proxy)
+	p.mutex.RUnlock()
+
+	p.srv.Logger().Debugln("grapi: drain")
+
+	if defaultProxy != nil {
+		defaultProxy.Drain()
+	}
+	if subscriptionProxy != nil {
+		subscriptionProxy.Drain()
+	}
+}
+
 // Close closes the accociated plugin.
 func (p *KopanoGroupwareCorePlugin) Close() error {
 	p.srv.Logger().Debugln("grapi: close")
 
 	close(p.exitCh)
 
+	if p.auditor != nil {
+		if err := p.auditor.logger.Close(); err != nil {
+			p.srv.Logger().WithError(err).Warnln("grapi: failed to close audit log")
+		}
+	}
+
 	return nil
 }
 
+// handlerV1 returns the handler of the provided API v1 path.
+func (p *KopanoGroupwareCorePlugin) handlerV1(path string) http.Handler {
+	switch {
+	case path == batchPath:
+		return http.HandlerFunc(p.handleBatchV1)
+	case strings.HasPrefix(path, "/api/gc/v1/subscriptions"):
+		return http.HandlerFunc(p.handleSubscriptionsV1)
+	default:
+		return http.HandlerFunc(p.handleDefaultV1)
+	}
+}
+
 // ServeHTTP serves HTTP requests.
 func (p *KopanoGroupwareCorePlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) (bool, error) {
 	var handler http.Handler
 
 	// Find handler.
 	switch path := req.URL.Path; {
-	case strings.HasPrefix(path, "/api/gc/v1/subscriptions"):
-		handler = p.srv.AccessTokenRequired(http.HandlerFunc(p.handleSubscriptionsV1), scopesRequired)
-
-	case apiV0Enabled && strings.HasPrefix(path, "/api/gc/v0/subscriptions"):
-		// Backwards compatibility - rewrite URL to v1.
-		req.URL.Path = strings.Replace(req.URL.Path, "/api/gc/v0/", "/api/gc/v1/", 1)
-		handler = p.srv.AccessTokenRequired(http.HandlerFunc(p.handleSubscriptionsV1), nil)
-
-	case strings.HasPrefix(path, "/api/gc/v1/"):
-		handler = p.srv.AccessTokenRequired(http.HandlerFunc(p.handleDefaultV1), scopesRequired)
-
-	case apiV0Enabled && strings.HasPrefix(path, "/api/gc/v0/"):
-		// Backwards compatibility - rewrite URL to v1.
-		req.URL.Path = strings.Replace(req.URL.Path, "/api/gc/v0/", "/api/gc/v1/", 1)
-		handler = p.srv.AccessTokenRequired(http.HandlerFunc(p.handleDefaultV1), nil)
+	case p.bridge != nil && strings.HasPrefix(path, bridgeNotifyPath):
+		// Notifications are sent by grapi and authenticated by the token in
+		// the URL.
+		handler = http.HandlerFunc(p.bridge.handleNotify)
+
+	case strings.HasPrefix(path, apiBasePath):
+		if version := p.versions.match(path); version != nil {
+			// Audit outside of the version handler, so requests which are
+			// denied by the access token check are recorded too.
+			handler = p.auditHandler(version.handler(p.srv, p.handlerV1(version.path(path))))
+		}
 	}
 
 	if handler == nil {
@@ -18,25 +18,30 @@
 package plugin
 
 import (
-	"context"
 	"errors"
-	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
+	"strings"
 	"time"
 
-	"stash.kopano.io/kc/kapi/proxy"
 	"stash.kopano.io/kc/kapi/proxy/httpproxy"
+	"stash.kopano.io/kc/kapi/proxy/transform"
 )
 
 const (
 	entryIDRequestHeaderName  = "X-Kopano-UserEntryID"
 	usernameRequestHeaderName = "X-Kopano-Username"
+
+	impersonateRequestHeaderName   = "X-Kopano-Impersonate"
+	actorEntryIDRequestHeaderName  = "X-Kopano-Actor-UserEntryID"
+	actorUsernameRequestHeaderName = "X-Kopano-Actor-Username"
 )
 
+// defaultNotifyPingInterval is the default time without notifications after
+// which subscription clients get a ping.
+const defaultNotifyPingInterval = 30 * time.Second
+
 var restProxyConfiguration = &httpproxy.Configuration{
-	Policy:      "header " + entryIDRequestHeaderName,
+	Policy:      "consistent_header " + entryIDRequestHeaderName,
 	FailTimeout: 500 * time.Millisecond,
 	MaxFails:    1,
 	MaxConns:    0,
@@ -44,64 +49,15 @@ var restProxyConfiguration = &httpproxy.Configuration{
 	TryDuration: 1 * time.Second,
 	TryInterval: 50 * time.Millisecond,
 	Sticky:      "nocache",
-}
 
-func (p *KopanoGroupwareCorePlugin) initializeProxy(ctx context.Context, socketPath string, pattern string) (proxy.HTTPProxyHandler, error) {
-	p.srv.Logger().Debugf("grapi: looking for proxy %s files in %s", pattern, socketPath)
-
-	var err error
-	var init bool
-	var count int
-	for {
-		for {
-			if fp, statErr := os.Stat(socketPath); statErr != nil || !fp.IsDir() {
-				err = statErr
-				break
-			}
-
-			socketPaths, globErr := filepath.Glob(fmt.Sprintf("%s/%s", socketPath, pattern))
-			if globErr != nil {
-				err = globErr
-				break
-			}
-			if len(socketPaths) == 0 {
-				err = fmt.Errorf("no proxy %s files found in socket-path", pattern)
-				break
-			}
-
-			if !init {
-				// Do another loop to avoid missing socket files when they
-				// are just in process of creation.
-				init = true
-				break
-			}
-
-			pr, proxyErr := httpproxy.New("grapi", socketPaths, restProxyConfiguration)
-			if proxyErr != nil {
-				return nil, proxyErr
-			}
-
-			p.srv.Logger().Debugf("grapi: found %d %s upstream proxy workers", len(socketPaths), pattern)
-			return pr, nil
-		}
-
-		if err != nil && count == 5 {
-			p.srv.Logger().WithError(err).Warnf("grapi: waiting for proxy %s files to appear", pattern)
-		}
-		count++
-		if count > 60 {
-			count = 0
-		}
-
-		select {
-		case <-p.exitCh:
-			return nil, nil
-		case <-ctx.Done():
-			return nil, nil
-		case <-time.After(1 * time.Second):
-			// retry.
-		}
-	}
+	ResponseHeaderTimeout: 120 * time.Second,
+	MaxRequestSize:        32 * 1024 * 1024,
+
+	RetryBudget:             0.2,
+	RetryBudgetMinPerSecond: 10,
+
+	CircuitBreakerThreshold: 5,
+	CircuitBreakerTimeout:   5 * time.Second,
 }
 
 func (p *KopanoGroupwareCorePlugin) handleDefaultV1(rw http.ResponseWriter, req *http.Request) {
@@ -116,11 +72,51 @@ func (p *KopanoGroupwareCorePlugin) handleDefaultV1(rw http.ResponseWriter, req
 		http.Error(rw, "", http.StatusForbidden)
 		return
 	}
+	auditInjected(req)
+
+	// Apply the limits of the route, if it has its own.
+	if limit, ok := p.maxRequestSize(req.URL.Path); ok {
+		req = httpproxy.WithMaxRequestSize(req, limit)
+	}
+	if limit, ok := p.maxResponseSize(req.URL.Path); ok {
+		req = httpproxy.WithMaxResponseSize(req, limit)
+	}
+	if timeout, ok := p.responseHeaderTimeout(req.URL.Path); ok {
+		req = httpproxy.WithResponseHeaderTimeout(req, timeout)
+	}
+
+	// Serve from cache if enabled.
+	if defaultProxy != nil && p.cache != nil {
+		defaultProxy = p.cache.Handler(defaultProxy, cacheKey)
+	}
+
+	// Transform if enabled. The cache holds untransformed responses, as
+	// transformations can depend on the client.
+	if defaultProxy != nil && p.transformer != nil {
+		defaultProxy = p.transformer.Handler(defaultProxy)
+	}
 
 	// Proxy all.
 	p.srv.HandleWithProxy(defaultProxy, http.HandlerFunc(p.handleNoProxy)).ServeHTTP(rw, req)
 }
 
+// cacheKey returns the key under which responses to the provided request are
+// cached. It is made of the injected user, the injected actor of impersonated
+// requests and the client of the access token, since responses can differ
+// for each of them.
+func cacheKey(req *http.Request) string {
+	user := req.Header.Get(entryIDRequestHeaderName)
+	if user == "" {
+		return ""
+	}
+
+	return strings.Join([]string{
+		user,
+		req.Header.Get(actorEntryIDRequestHeaderName),
+		transform.ClientID(req),
+	}, "\x00")
+}
+
 func (p *KopanoGroupwareCorePlugin) handleSubscriptionsV1(rw http.ResponseWriter, req *http.Request) {
 	p.mutex.RLock()
 	subscriptionProxy := p.subscriptionProxy
@@ -133,6 +129,7 @@ func (p *KopanoGroupwareCorePlugin) handleSubscriptionsV1(rw http.ResponseWriter
 		http.Error(rw, "", http.StatusForbidden)
 		return
 	}
+	auditInjected(req)
 
 	// Proxy all.
 	p.srv.HandleWithProxy(subscriptionProxy, http.HandlerFunc(p.handleNoProxy)).ServeHTTP(rw, req)
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+
+	"stash.kopano.io/kc/kapi/auth"
+)
+
+func TestCacheKey(t *testing.T) {
+	request := func(user string, actor string, client string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/gc/v1/me", nil)
+		req = req.WithContext(auth.ContextWithRecord(req.Context(), &auth.Record{
+			AuthenticatedUserID: user,
+			ExtraClaims: &kcoidc.ExtraClaimsWithType{
+				auth.AuthorizedPartyClaim: client,
+			},
+		}))
+		if user != "" {
+			req.Header.Set(entryIDRequestHeaderName, user)
+		}
+		if actor != "" {
+			req.Header.Set(actorEntryIDRequestHeaderName, actor)
+		}
+		return req
+	}
+
+	if key := cacheKey(request("", "", "client1")); key != "" {
+		t.Errorf("expected no key without user, got %q", key)
+	}
+
+	keys := make(map[string]string)
+	for name, req := range map[string]*http.Request{
+		"user":                request("user1", "", "client1"),
+		"other user":          request("user2", "", "client1"),
+		"other client":        request("user1", "", "client2"),
+		"impersonated":        request("user1", "user2", "client1"),
+		"impersonated client": request("user1", "user2", "client2"),
+	} {
+		key := cacheKey(req)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%s and %s share the cache key %q", name, other, key)
+		}
+		keys[key] = name
+	}
+	if cacheKey(request("user1", "user2", "client1")) != cacheKey(request("user1", "user2", "client1")) {
+		t.Errorf("cache key not stable")
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"stash.kopano.io/kc/kapi/plugins"
+)
+
+const apiBasePath = "/api/gc/"
+
+var (
+	apiRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kapi",
+		Subsystem: "grapi",
+		Name:      "api_requests_total",
+		Help:      "Total number of GRAPI API requests by API version",
+	}, []string{"version"})
+)
+
+func init() {
+	prometheus.MustRegister(apiRequestsCounter)
+}
+
+// apiVersion is a version of the grapi HTTP API. Versions other than the
+// current are served by rewriting their requests to the version they alias.
+type apiVersion struct {
+	name   string
+	prefix string
+	alias  string
+
+	scopesRequired []string
+
+	deprecated  bool
+	deprecation time.Time
+	sunset      time.Time
+}
+
+func newAPIVersion(name string, alias string, scopesRequired []string) *apiVersion {
+	return &apiVersion{
+		name:   name,
+		prefix: apiBasePath + name + "/",
+		alias:  alias,
+
+		scopesRequired: scopesRequired,
+	}
+}
+
+// configure applies the KOPANO_GRAPI_API_<VERSION>_* environment variables
+// to the accociated version.
+func (v *apiVersion) configure() error {
+	env := "KOPANO_GRAPI_API_" + strings.ToUpper(v.name) + "_"
+
+	if value, ok := os.LookupEnv(env + "REQUIRED_SCOPES"); ok {
+		v.scopesRequired = strings.Fields(value)
+	}
+	if value := os.Getenv(env + "DEPRECATION"); value != "" {
+		deprecation, err := parseAPIVersionDate(value)
+		if err != nil {
+			return fmt.Errorf("%sDEPRECATION value is invalid: %v", env, err)
+		}
+		v.deprecated = true
+		v.deprecation = deprecation
+	}
+	if value := os.Getenv(env + "SUNSET"); value != "" {
+		sunset, err := parseAPIVersionDate(value)
+		if err != nil {
+			return fmt.Errorf("%sSUNSET value is invalid: %v", env, err)
+		}
+		v.deprecated = true
+		v.sunset = sunset
+	}
+
+	return nil
+}
+
+// path returns the path which serves the provided path of the accociated
+// version.
+func (v *apiVersion) path(path string) string {
+	if v.alias == "" {
+		return path
+	}
+
+	return apiBasePath + v.alias + "/" + strings.TrimPrefix(path, v.prefix)
+}
+
+// handler returns a http.Handler which checks the auth requirements of the
+// accociated version, sets its deprecation headers, counts its usage and
+// then serves the request with next.
+func (v *apiVersion) handler(srv plugins.ServerV1, next http.Handler) http.Handler {
+	authenticated := srv.AccessTokenRequired(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		auditAuthenticated(req)
+		if v.alias != "" {
+			req.URL.Path = v.path(req.URL.Path)
+		}
+		next.ServeHTTP(rw, req)
+	}), v.scopesRequired)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if v.deprecated {
+			if v.deprecation.IsZero() {
+				rw.Header().Set("Deprecation", "true")
+			} else {
+				rw.Header().Set("Deprecation", v.deprecation.UTC().Format(http.TimeFormat))
+			}
+			if !v.sunset.IsZero() {
+				rw.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+			}
+			if v.alias != "" {
+				rw.Header().Set("Link", fmt.Sprintf("<%s%s/>; rel=\"successor-version\"", apiBasePath, v.alias))
+			}
+		}
+
+		apiRequestsCounter.WithLabelValues(v.name).Inc()
+
+		if !v.sunset.IsZero() && time.Now().After(v.sunset) {
+			http.Error(rw, "", http.StatusGone)
+			return
+		}
+
+		authenticated.ServeHTTP(rw, req)
+	})
+}
+
+// apiVersions are the enabled versions of the grapi HTTP API.
+type apiVersions []*apiVersion
+
+// newAPIVersions returns the current version with the provided required
+// scopes and, if enabled, the obsolete version v0, configured from the
+// environment. API v0 is served by v1 and deprecated. It requires the same
+// scopes as v1 unless configured otherwise.
+func newAPIVersions(scopesRequired []string, enableV0 bool) (apiVersions, error) {
+	v1 := newAPIVersion("v1", "", scopesRequired)
+	if err := v1.configure(); err != nil {
+		return nil, err
+	}
+	versions := apiVersions{v1}
+
+	if enableV0 {
+		v0 := newAPIVersion("v0", "v1", v1.scopesRequired)
+		v0.deprecated = true
+		if err := v0.configure(); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v0)
+	}
+
+	return versions, nil
+}
+
+// match returns the version which serves the provided path.
+func (versions apiVersions) match(path string) *apiVersion {
+	for _, v := range versions {
+		if strings.HasPrefix(path, v.prefix) {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func parseAPIVersionDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", value)
+}
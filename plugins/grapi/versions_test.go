@@ -0,0 +1,118 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+func TestAPIVersions(t *testing.T) {
+	defaultProxy := &testDefaultProxy{}
+	v0 := newAPIVersion("v0", "v1", scopesRequired)
+	v0.deprecated = true
+	srv := pluginstest.NewServer()
+	srv.Records["test"] = &auth.Record{AuthenticatedUserID: "user1"}
+	p := &KopanoGroupwareCorePlugin{
+		ctx:          context.Background(),
+		srv:          srv,
+		defaultProxy: defaultProxy,
+		versions:     apiVersions{newAPIVersion("v1", "", scopesRequired), v0},
+	}
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer test")
+		rec := httptest.NewRecorder()
+		if handled, _ := p.ServeHTTP(rec, req); !handled {
+			t.Fatalf("request not handled: %s", path)
+		}
+		return rec
+	}
+
+	rec := serve("/api/gc/v1/me")
+	if rec.Code != http.StatusOK || rec.Header().Get("Deprecation") != "" {
+		t.Errorf("unexpected v1 response: %d %v", rec.Code, rec.Header())
+	}
+
+	rec = serve("/api/gc/v0/me")
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected v0 status: %d", rec.Code)
+	}
+	if rec.Header().Get("Deprecation") != "true" || rec.Header().Get("Link") != `</api/gc/v1/>; rel="successor-version"` {
+		t.Errorf("unexpected v0 headers: %v", rec.Header())
+	}
+	defaultProxy.mutex.Lock()
+	if last := defaultProxy.order[len(defaultProxy.order)-1]; last != "GET /api/gc/v1/me" {
+		t.Errorf("v0 request not rewritten to v1: %s", last)
+	}
+	defaultProxy.mutex.Unlock()
+
+	v0.sunset = time.Now().Add(-time.Hour)
+	rec = serve("/api/gc/v0/me")
+	if rec.Code != http.StatusGone || rec.Header().Get("Sunset") == "" {
+		t.Errorf("unexpected v0 response after sunset: %d %v", rec.Code, rec.Header())
+	}
+
+	if handled, _ := p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/gc/v2/me", nil)); handled {
+		t.Errorf("unknown version was handled")
+	}
+}
+
+func TestAPIVersionsScopes(t *testing.T) {
+	versions, err := newAPIVersions([]string{"kopano/gc"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions.match("/api/gc/v0/me") != nil {
+		t.Errorf("v0 enabled without being requested")
+	}
+
+	defer os.Unsetenv("KOPANO_GRAPI_API_V1_REQUIRED_SCOPES")
+	os.Setenv("KOPANO_GRAPI_API_V1_REQUIRED_SCOPES", "profile kopano/gc")
+	versions, err = newAPIVersions([]string{"kopano/gc"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v0 := versions.match("/api/gc/v0/me")
+	if v0 == nil || !v0.deprecated {
+		t.Fatalf("v0 not enabled")
+	}
+	if strings.Join(v0.scopesRequired, " ") != "profile kopano/gc" {
+		t.Errorf("v0 does not require the scopes of v1: %v", v0.scopesRequired)
+	}
+
+	// Explicit opt-out.
+	defer os.Unsetenv("KOPANO_GRAPI_API_V0_REQUIRED_SCOPES")
+	os.Setenv("KOPANO_GRAPI_API_V0_REQUIRED_SCOPES", "")
+	versions, err = newAPIVersions([]string{"kopano/gc"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v0 = versions.match("/api/gc/v0/me"); len(v0.scopesRequired) != 0 {
+		t.Errorf("v0 scopes not cleared: %v", v0.scopesRequired)
+	}
+}
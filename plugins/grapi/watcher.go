@@ -0,0 +1,251 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/kapi/proxy/httpproxy"
+)
+
+const (
+	// upstreamSyncDelay collects socket changes which happen in quick
+	// succession, like when GRAPI starts all its workers.
+	upstreamSyncDelay = 250 * time.Millisecond
+)
+
+var (
+	workersGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kapi",
+		Subsystem: "grapi",
+		Name:      "workers",
+		Help:      "Number of GRAPI worker sockets in the upstream pool",
+	}, []string{"pool"})
+	workerGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kapi",
+		Subsystem: "grapi",
+		Name:      "worker",
+		Help:      "GRAPI worker sockets in the upstream pool, 1 when present",
+	}, []string{"pool", "worker"})
+)
+
+func init() {
+	prometheus.MustRegister(workersGauge, workerGauge)
+}
+
+// upstreamWatcher keeps the upstreams of a proxy in sync with the socket files
+// matching a pattern in a directory.
+type upstreamWatcher struct {
+	p *KopanoGroupwareCorePlugin
+
+	pool       string
+	socketPath string
+	pattern    string
+	onProxy    func(*httpproxy.Proxy)
+
+	logger  logrus.FieldLogger
+	proxy   *httpproxy.Proxy
+	workers []string
+}
+
+func (p *KopanoGroupwareCorePlugin) newUpstreamWatcher(pool string, socketPath string, pattern string, onProxy func(*httpproxy.Proxy)) *upstreamWatcher {
+	return &upstreamWatcher{
+		p: p,
+
+		pool:       pool,
+		socketPath: socketPath,
+		pattern:    pattern,
+		onProxy:    onProxy,
+
+		logger: p.srv.Logger().WithField("pool", pool),
+	}
+}
+
+// Watch watches the accociated socket directory until the provided context is
+// done or the accociated plugin exits. The proxy is created once the first
+// socket file appears.
+func (w *upstreamWatcher) Watch(ctx context.Context) error {
+	defer func() {
+		if w.proxy != nil {
+			w.proxy.Close()
+		}
+	}()
+
+	w.logger.Debugf("grapi: looking for proxy %s files in %s", w.pattern, w.socketPath)
+
+	var count int
+	for {
+		err := w.watch(ctx)
+		if err == nil {
+			return nil
+		}
+
+		if count == 5 {
+			w.logger.WithError(err).Warnf("grapi: waiting for proxy %s files to appear", w.pattern)
+		}
+		count++
+		if count > 60 {
+			count = 0
+		}
+
+		select {
+		case <-w.p.exitCh:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-time.After(1 * time.Second):
+			// retry.
+		}
+	}
+}
+
+// watch watches the accociated socket directory. It returns an error when the
+// directory can not be watched or disappears, and nil when watching ends.
+func (w *upstreamWatcher) watch(ctx context.Context) error {
+	if fp, err := os.Stat(w.socketPath); err != nil {
+		return err
+	} else if !fp.IsDir() {
+		return fmt.Errorf("%s is not a directory", w.socketPath)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(w.socketPath); err != nil {
+		return err
+	}
+
+	// Initial sync after the watch is in place, so no change is missed.
+	if err = w.sync(); err != nil {
+		return err
+	}
+	if len(w.workers) == 0 {
+		w.logger.Warnf("grapi: waiting for proxy %s files to appear", w.pattern)
+	}
+
+	var syncCh <-chan time.Time
+	for {
+		select {
+		case <-w.p.exitCh:
+			return nil
+
+		case <-ctx.Done():
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Name == w.socketPath && event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// Socket directory is gone, sync to clear the workers.
+				w.sync()
+				return fmt.Errorf("%s was removed", w.socketPath)
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			if match, _ := filepath.Match(w.pattern, filepath.Base(event.Name)); match && syncCh == nil {
+				syncCh = time.After(upstreamSyncDelay)
+			}
+
+		case watchErr, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			// Events might have been lost, resync.
+			w.logger.WithError(watchErr).Warnln("grapi: error while watching proxy socket files")
+			if syncCh == nil {
+				syncCh = time.After(upstreamSyncDelay)
+			}
+
+		case <-syncCh:
+			syncCh = nil
+			if err = w.sync(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sync updates the proxy upstreams to the socket files currently found.
+func (w *upstreamWatcher) sync() error {
+	socketPaths, err := filepath.Glob(filepath.Join(w.socketPath, w.pattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(socketPaths)
+
+	if equalStrings(socketPaths, w.workers) {
+		return nil
+	}
+
+	if w.proxy == nil {
+		if len(socketPaths) == 0 {
+			return nil
+		}
+		w.proxy, err = httpproxy.New("grapi-"+w.pool, socketPaths, w.p.poolConfiguration(w.pool))
+		if err != nil {
+			return err
+		}
+		w.onProxy(w.proxy)
+	} else if err = w.proxy.SetUpstreams(socketPaths); err != nil {
+		return err
+	}
+
+	for _, worker := range w.workers {
+		workerGauge.DeleteLabelValues(w.pool, filepath.Base(worker))
+	}
+	for _, worker := range socketPaths {
+		workerGauge.WithLabelValues(w.pool, filepath.Base(worker)).Set(1)
+	}
+	workersGauge.WithLabelValues(w.pool).Set(float64(len(socketPaths)))
+	w.workers = socketPaths
+
+	if len(socketPaths) == 0 {
+		w.logger.Warnf("grapi: no proxy %s files found, no upstream proxy workers", w.pattern)
+	} else {
+		w.logger.WithField("workers", socketPaths).Infof("grapi: found %d %s upstream proxy workers", len(socketPaths), w.pattern)
+	}
+
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+	"stash.kopano.io/kc/kapi/proxy/httpproxy"
+)
+
+func TestUpstreamWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kapi-grapi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "sockets")
+
+	p := &KopanoGroupwareCorePlugin{
+		exitCh: make(chan bool, 1),
+		srv:    pluginstest.NewServer(),
+	}
+	proxyCh := make(chan *httpproxy.Proxy, 1)
+	watcher := p.newUpstreamWatcher("rest", socketPath, "rest*.sock", func(pr *httpproxy.Proxy) {
+		proxyCh <- pr
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.Watch(ctx)
+	}()
+
+	waitForWorkers := func(pr *httpproxy.Proxy, expected ...string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			var workers []string
+			for _, upstream := range pr.Upstreams() {
+				workers = append(workers, filepath.Base(upstream.Name))
+			}
+			sort.Strings(workers)
+			if equalStrings(workers, expected) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("unexpected workers: %v, expected %v", workers, expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	listen := func(name string) net.Listener {
+		listener, listenErr := net.Listen("unix", filepath.Join(socketPath, name))
+		if listenErr != nil {
+			t.Fatal(listenErr)
+		}
+		return listener
+	}
+
+	// Socket directory appears later.
+	time.Sleep(100 * time.Millisecond)
+	if err = os.Mkdir(socketPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	rest0 := listen("rest0.sock")
+	defer rest0.Close()
+
+	var pr *httpproxy.Proxy
+	select {
+	case pr = <-proxyCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy was not created")
+	}
+	waitForWorkers(pr, "rest0.sock")
+
+	rest1 := listen("rest1.sock")
+	notify0 := listen("notify0.sock")
+	defer notify0.Close()
+	waitForWorkers(pr, "rest0.sock", "rest1.sock")
+
+	rest1.Close()
+	waitForWorkers(pr, "rest0.sock")
+
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not exit")
+	}
+}
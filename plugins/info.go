@@ -22,4 +22,11 @@ type InfoV1 struct {
 	ID        string
 	Version   string
 	BuildDate string
+
+	// Dependencies are the IDs of plugins which must be enabled as well and
+	// which are initialized before this plugin.
+	Dependencies []string
+	// OptionalDependencies are the IDs of plugins which are initialized
+	// before this plugin when they are enabled.
+	OptionalDependencies []string
 }
@@ -32,35 +32,59 @@ import (
 const valueSizeLimit = 16384
 
 func (p *KVSPlugin) handleUserKV(rw http.ResponseWriter, req *http.Request) {
-	key := req.URL.Path
+	user, ok := auth.RecordFromContext(req.Context())
+	if !ok || user.ServicePrincipal != nil {
+		http.Error(rw, "", http.StatusForbidden)
+		return
+	}
+
+	p.handleKV(rw, req, "user", user)
+}
 
+func (p *KVSPlugin) handleClientKV(rw http.ResponseWriter, req *http.Request) {
 	user, ok := auth.RecordFromContext(req.Context())
-	if !ok {
+	if !ok || user.ServicePrincipal == nil {
 		http.Error(rw, "", http.StatusForbidden)
 		return
 	}
 
+	p.handleKV(rw, req, "client", user)
+}
+
+func (p *KVSPlugin) handleKV(rw http.ResponseWriter, req *http.Request, realm string, user *auth.Record) {
+	key := req.URL.Path
+
 	req.ParseForm()
 
 	switch req.Method {
 	case http.MethodGet:
-		p.handleGet(rw, req, "user", key, user)
+		p.handleGet(rw, req, realm, key, user)
 		return
 	case http.MethodPut:
 		if req.Form.Get("batch") == "1" {
-			p.handleBatchCreateOrUpdate(rw, req, "user", key, user)
+			p.handleBatchCreateOrUpdate(rw, req, realm, key, user)
 		} else {
-			p.handleCreateOrUpdate(rw, req, "user", key, user)
+			p.handleCreateOrUpdate(rw, req, realm, key, user)
 		}
 		return
 	case http.MethodDelete:
-		p.handleDelete(rw, req, "user", key, user)
+		p.handleDelete(rw, req, realm, key, user)
 		return
 	}
 
 	http.Error(rw, "", http.StatusNotImplemented)
 }
 
+// clientID returns the ID of the client to which the token of the provided
+// auth record was issued.
+func clientID(user *auth.Record) string {
+	if user.ServicePrincipal != nil {
+		return user.ServicePrincipal.ClientID
+	}
+
+	return user.StandardClaims.Audience
+}
+
 func (p *KVSPlugin) handleGet(rw http.ResponseWriter, req *http.Request, realm string, key string, user *auth.Record) {
 	recurse := req.Form.Get("recurse") == "1"
 	raw := req.Form.Get("raw") == "1"
@@ -75,7 +99,7 @@ func (p *KVSPlugin) handleGet(rw http.ResponseWriter, req *http.Request, realm s
 		Collection: collection,
 		Key:        key,
 		OwnerID:    user.AuthenticatedUserID,
-		ClientID:   user.StandardClaims.Audience,
+		ClientID:   clientID(user),
 	}
 
 	result, err := p.store.Get(req.Context(), realm, record)
@@ -165,7 +189,7 @@ func (p *KVSPlugin) handleCreateOrUpdate(rw http.ResponseWriter, req *http.Reque
 		Value:       body,
 		ContentType: contentType,
 		OwnerID:     user.AuthenticatedUserID,
-		ClientID:    user.StandardClaims.Audience,
+		ClientID:    clientID(user),
 	}
 
 	err = p.store.CreateOrUpdate(req.Context(), realm, record)
@@ -209,7 +233,7 @@ func (p *KVSPlugin) handleBatchCreateOrUpdate(rw http.ResponseWriter, req *http.
 			Key:         key + "/" + *ir.Key,
 			ContentType: ir.ContentType,
 			OwnerID:     user.AuthenticatedUserID,
-			ClientID:    user.StandardClaims.Audience,
+			ClientID:    clientID(user),
 		}
 		if strings.HasPrefix(ir.ContentType, "application/json") {
 			records[i].Value = ir.Value
@@ -239,7 +263,7 @@ func (p *KVSPlugin) handleDelete(rw http.ResponseWriter, req *http.Request, real
 	record := &kv.Record{
 		Key:      key,
 		OwnerID:  user.AuthenticatedUserID,
-		ClientID: user.StandardClaims.Audience,
+		ClientID: clientID(user),
 	}
 
 	ok, err := p.store.Delete(req.Context(), realm, record)
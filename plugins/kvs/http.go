@@ -33,6 +33,7 @@ func (p *KVSPlugin) addRoutes(ctx context.Context, router *mux.Router) http.Hand
 	v1 := router.PathPrefix(httpBaseURL).Subrouter()
 
 	v1.PathPrefix("/kv/user/").Handler(http.StripPrefix(httpBaseURL+"kv/user/", p.srv.AccessTokenRequired(p.MakeHTTPUserKVHandler(v1), scopesRequired)))
+	v1.PathPrefix("/kv/client/").Handler(http.StripPrefix(httpBaseURL+"kv/client/", p.srv.AccessTokenRequired(p.MakeHTTPClientKVHandler(v1), scopesRequired)))
 
 	return router
 }
@@ -68,3 +69,11 @@ func (p *KVSPlugin) MakeHTTPUserKVHandler(router *mux.Router) http.Handler {
 		p.handleUserKV(rw, req)
 	})
 }
+
+// MakeHTTPClientKVHandler creates the HTTP handler for the per service client
+// kv store.
+func (p *KVSPlugin) MakeHTTPClientKVHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleClientKV(rw, req)
+	})
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"text/template"
+
+	"stash.kopano.io/kc/kapi/openapi"
+)
+
+var openAPITemplate = template.Must(template.New("openapi").Funcs(openapi.TemplateFuncs).Parse(`{
+	"openapi": "3.0.3",
+	"tags": [
+		{
+			"name": "kvs",
+			"description": "Key value store"
+		}
+	],
+	"paths": {
+		{{- range $idx, $realm := .Realms}}{{if $idx}},{{end}}
+		"/api/kvs/v1/kv/{{$realm}}/{key}": {
+			"parameters": [
+				{
+					"name": "key",
+					"in": "path",
+					"required": true,
+					"description": "Key of the document. The first segment of the key is the collection. Keys can contain slashes.",
+					"schema": {
+						"type": "string"
+					}
+				}
+			],
+			"get": {
+				"tags": ["kvs"],
+				"summary": "Get document or collection",
+				"security": [{"oidc": {{json $.Scopes}}}],
+				"parameters": [
+					{
+						"name": "raw",
+						"in": "query",
+						"description": "Return the raw document as stored instead of the JSON envelope.",
+						"schema": {
+							"type": "string",
+							"enum": ["1"]
+						}
+					},
+					{
+						"name": "recurse",
+						"in": "query",
+						"description": "Return all documents with the same key prefix.",
+						"schema": {
+							"type": "string",
+							"enum": ["1"]
+						}
+					}
+				],
+				"responses": {
+					"200": {
+						"description": "The document, or an array of documents when recursing.",
+						"content": {
+							"application/json": {
+								"schema": {
+									"oneOf": [
+										{"$ref": "#/components/schemas/kvsRecord"},
+										{
+											"type": "array",
+											"items": {"$ref": "#/components/schemas/kvsRecord"}
+										}
+									]
+								}
+							}
+						}
+					},
+					"403": {"description": "Access denied."},
+					"404": {"description": "No document found for key."}
+				}
+			},
+			"put": {
+				"tags": ["kvs"],
+				"summary": "Create or update document",
+				"security": [{"oidc": {{json $.Scopes}}}],
+				"parameters": [
+					{
+						"name": "batch",
+						"in": "query",
+						"description": "Create or update all documents of the JSON array in the request body transactionally.",
+						"schema": {
+							"type": "string",
+							"enum": ["1"]
+						}
+					}
+				],
+				"requestBody": {
+					"description": "The document value, or an array of documents in batch mode.",
+					"content": {
+						"*/*": {
+							"schema": {
+								"type": "string",
+								"format": "binary",
+								"maxLength": {{$.ValueSizeLimit}}
+							}
+						}
+					}
+				},
+				"responses": {
+					"200": {"description": "Document stored."},
+					"400": {"description": "Invalid request body."},
+					"403": {"description": "Access denied."}
+				}
+			},
+			"delete": {
+				"tags": ["kvs"],
+				"summary": "Delete document",
+				"security": [{"oidc": {{json $.Scopes}}}],
+				"responses": {
+					"200": {"description": "Document deleted."},
+					"403": {"description": "Access denied."},
+					"404": {"description": "No document found for key."}
+				}
+			}
+		}{{end}}
+	},
+	"components": {
+		"schemas": {
+			"kvsRecord": {
+				"type": "object",
+				"properties": {
+					"key": {"type": "string"},
+					"value": {"description": "The stored value, Base64 encoded if not JSON."},
+					"content_type": {"type": "string"}
+				}
+			}
+		}
+	}
+}`))
+
+// OpenAPIV1 returns the OpenAPI document fragment of the accociated plugin.
+func (p *KVSPlugin) OpenAPIV1() (*openapi.Document, error) {
+	return openapi.Execute(openAPITemplate, &struct {
+		Realms         []string
+		Scopes         []string
+		ValueSizeLimit int
+	}{
+		Realms:         []string{"user", "client"},
+		Scopes:         scopesRequired,
+		ValueSizeLimit: valueSizeLimit,
+	})
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	"stash.kopano.io/kc/kapi/openapi"
 	"stash.kopano.io/kc/kapi/proxy"
 )
 
@@ -44,11 +45,45 @@ type PluginV1 interface {
 	Initialize(ctx context.Context, errCh chan<- error, srv ServerV1) error
 }
 
+// OpenAPIProviderV1 is the interface a plugin can implement to describe its
+// HTTP API with an OpenAPI 3 document fragment. Kopano API server merges the
+// fragments of all plugins into a single document.
+type OpenAPIProviderV1 interface {
+	OpenAPIV1() (*openapi.Document, error)
+}
+
+// HealthV1 is the health report of a plugin.
+type HealthV1 struct {
+	Healthy bool        `json:"healthy"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// HealthReporterV1 is the interface a plugin can implement to report its
+// health on the health check endpoint of Kopano API server.
+type HealthReporterV1 interface {
+	HealthV1() *HealthV1
+}
+
+// DrainerV1 is the interface a plugin can implement to end its long lived
+// connections cleanly when Kopano API server shuts down. DrainV1 is called
+// once when the server stops accepting new connections, before it waits for
+// the active connections to finish.
+type DrainerV1 interface {
+	DrainV1()
+}
+
 // ServerV1 is the interface how a plugin can integrate calls provided by
-// Kopano API server.
+// Kopano API server. Plugins can register services with the server during
+// initialization, for other plugins to look them up. Services are typically
+// typed Go interfaces published by the providing plugin. Plugins which use a
+// service should declare the providing plugin as dependency in their InfoV1 so
+// they are initialized after it.
 type ServerV1 interface {
 	Logger() logrus.FieldLogger
 
 	AccessTokenRequired(next http.Handler, scopesRequired []string) http.Handler
 	HandleWithProxy(proxy proxy.HTTPProxyHandler, next http.Handler) http.Handler
+
+	RegisterService(id string, service interface{}) error
+	LookupService(id string) (interface{}, bool)
 }
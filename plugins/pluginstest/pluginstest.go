@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package pluginstest provides a fake Kopano API server for unit tests of
+// plugins. Use the server/servertest package to test plugins end to end with
+// the real server instead.
+package pluginstest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/proxy"
+)
+
+// Server is a fake plugins.ServerV1 which plugins can be initialized with.
+type Server struct {
+	// Records maps the bearer access tokens which are accepted by
+	// AccessTokenRequired to the authentication records of their requests.
+	// NOTE: Required scopes are not checked.
+	Records map[string]*auth.Record
+
+	logger logrus.FieldLogger
+
+	servicesMutex sync.RWMutex
+	services      map[string]interface{}
+}
+
+// NewServer creates a Server without access tokens. It logs only in verbose
+// test runs.
+func NewServer() *Server {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	if !testing.Verbose() {
+		logger.SetOutput(ioutil.Discard)
+	}
+
+	return &Server{
+		Records: make(map[string]*auth.Record),
+
+		logger:   logger,
+		services: make(map[string]interface{}),
+	}
+}
+
+// Logger implements the plugins.ServerV1 interface.
+func (s *Server) Logger() logrus.FieldLogger {
+	return s.logger
+}
+
+// AccessTokenRequired implements the plugins.ServerV1 interface.
+func (s *Server) AccessTokenRequired(next http.Handler, scopesRequired []string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		authHeader := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+		if len(authHeader) != 2 || authHeader[0] != "Bearer" {
+			http.Error(rw, "", http.StatusForbidden)
+			return
+		}
+		record, ok := s.Records[authHeader[1]]
+		if !ok {
+			http.Error(rw, "", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(rw, req.WithContext(auth.ContextWithRecord(req.Context(), record)))
+	})
+}
+
+// HandleWithProxy implements the plugins.ServerV1 interface.
+func (s *Server) HandleWithProxy(proxy proxy.HTTPProxyHandler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if proxy == nil {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		status, err := proxy.ServeHTTP(rw, req)
+		if err != nil {
+			s.logger.WithError(err).Errorln("proxy request failed")
+			http.Error(rw, "", status)
+		}
+	})
+}
+
+// RegisterService implements the plugins.ServerV1 interface.
+func (s *Server) RegisterService(id string, service interface{}) error {
+	s.servicesMutex.Lock()
+	defer s.servicesMutex.Unlock()
+
+	if _, exists := s.services[id]; exists {
+		return fmt.Errorf("service %s is already registered", id)
+	}
+	s.services[id] = service
+
+	return nil
+}
+
+// LookupService implements the plugins.ServerV1 interface.
+func (s *Server) LookupService(id string) (interface{}, bool) {
+	s.servicesMutex.RLock()
+	defer s.servicesMutex.RUnlock()
+
+	service, ok := s.services[id]
+	return service, ok
+}
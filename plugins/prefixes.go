@@ -0,0 +1,67 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugins
+
+import (
+	"strings"
+)
+
+// ReservedPrefixes are the URL paths of Kopano API and its built-in plugins,
+// which the configurable routes of plugins must not shadow.
+var ReservedPrefixes = []string{
+	"/health-check",
+	"/api/openapi",
+	"/api/gc/",
+	"/api/kvs/",
+	"/api/pubs/",
+}
+
+// OverlapsReservedPrefix returns the reserved prefix which the provided route
+// prefix matches or is matched by, if any.
+func OverlapsReservedPrefix(prefix string) (string, bool) {
+	for _, reserved := range ReservedPrefixes {
+		if strings.HasPrefix(reserved, prefix) || strings.HasPrefix(prefix, reserved) {
+			return reserved, true
+		}
+	}
+
+	return "", false
+}
+
+// MatchesPrefix returns true if the provided path is the provided prefix or
+// below it. Prefixes without trailing slash match whole path segments only,
+// so /api/foo matches /api/foo/bar but not /api/foobar.
+func MatchesPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// HasDotSegments returns true if the provided path has . or .. segments,
+// which upstreams might resolve to a path other than the matched one.
+func HasDotSegments(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugins
+
+import (
+	"testing"
+)
+
+func TestMatchesPrefix(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		prefix   string
+		expected bool
+	}{
+		{"/api/foo", "/api/foo", true},
+		{"/api/foo/bar", "/api/foo", true},
+		{"/api/foobar", "/api/foo", false},
+		{"/api/foo/bar", "/api/foo/", true},
+		{"/api/foo", "/api/foo/", false},
+		{"/api/other", "/api/foo", false},
+	} {
+		if matched := MatchesPrefix(test.path, test.prefix); matched != test.expected {
+			t.Errorf("%s with prefix %s: expected %v, got %v", test.path, test.prefix, test.expected, matched)
+		}
+	}
+}
+
+func TestHasDotSegments(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		expected bool
+	}{
+		{"/api/foo", false},
+		{"/api/foo/..bar", false},
+		{"/api/foo/../bar", true},
+		{"/api/foo/./bar", true},
+		{"/api/foo/..", true},
+	} {
+		if has := HasDotSegments(test.path); has != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.path, test.expected, has)
+		}
+	}
+}
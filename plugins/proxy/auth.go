@@ -0,0 +1,100 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/kapi/auth"
+)
+
+func (p *ProxyPlugin) injectAuthIntoRequestHeaders(req *http.Request, inject *Inject) error {
+	// Never forward injection headers provided by the client.
+	for _, name := range []string{inject.UserIDHeader, inject.UsernameHeader, inject.ClaimsHeader} {
+		if name != "" {
+			req.Header.Del(name)
+		}
+	}
+
+	authRecord, _ := auth.RecordFromContext(req.Context())
+	if authRecord == nil {
+		return errors.New("no auth record to inject")
+	}
+
+	if authRecord.ServicePrincipal != nil && inject.UserIDHeader != "" {
+		// The subject of service clients is their client ID, which must
+		// never reach upstreams as user ID.
+		return errors.New("service client has no user ID to inject")
+	}
+
+	authenticatedUserID := authRecord.AuthenticatedUserID
+	var username string
+	if authRecord.ExtraClaims != nil {
+		kcIDUserID, kcIDUsername := auth.KCIDFromClaims(authRecord.ExtraClaims)
+		if kcIDUserID != "" {
+			authenticatedUserID = kcIDUserID
+		}
+		username = kcIDUsername
+	}
+
+	if inject.UserIDHeader != "" {
+		req.Header.Set(inject.UserIDHeader, authenticatedUserID)
+	}
+	if inject.UsernameHeader != "" {
+		if username == "" {
+			return errors.New("missing kc.identity with username")
+		}
+		req.Header.Set(inject.UsernameHeader, username)
+	}
+	if inject.ClaimsHeader != "" {
+		value, err := p.signClaims(authRecord)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(inject.ClaimsHeader, value)
+	}
+
+	return nil
+}
+
+// signClaims returns the claims of the provided auth record as JWT signed with
+// the accociated plugin's claims secret.
+func (p *ProxyPlugin) signClaims(authRecord *auth.Record) (string, error) {
+	claims := make(jwt.MapClaims)
+	if authRecord.ExtraClaims != nil {
+		for k, v := range *authRecord.ExtraClaims {
+			claims[k] = v
+		}
+	}
+	if authRecord.StandardClaims != nil {
+		// Merge standard claims via JSON to keep their claim names.
+		b, err := json.Marshal(authRecord.StandardClaims)
+		if err != nil {
+			return "", err
+		}
+		if err = json.Unmarshal(b, &claims); err != nil {
+			return "", err
+		}
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(p.claimsSecret)
+}
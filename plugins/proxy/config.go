@@ -0,0 +1,183 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/proxy"
+	"stash.kopano.io/kc/kapi/proxy/transform"
+)
+
+// Config is the configuration of the proxy plugin.
+type Config struct {
+	Routes []*Route `json:"routes"`
+}
+
+// Route maps an URL path prefix to upstreams.
+type Route struct {
+	Prefix string `json:"prefix"`
+	// Upstreams are unix socket paths or URIs like http://127.0.0.1:8080 or
+	// unix:///run/service.sock.
+	Upstreams []string `json:"upstreams"`
+	// Scopes are the access token scopes required for this route.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// StripPrefix is removed from the request path before forwarding and
+	// AddPrefix is prepended afterwards.
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	AddPrefix   string `json:"add_prefix,omitempty"`
+
+	Inject *Inject `json:"inject,omitempty"`
+
+	// Sticky is an additional sticky rule for the route, for example
+	// "pin-cookie kapi_sticky cookie-secure" to pin clients to upstreams.
+	Sticky string `json:"sticky,omitempty"`
+
+	// Timeout limits the whole request, ResponseHeaderTimeout the wait for
+	// the response headers and IdleTimeout the time without data while
+	// streaming the response. Upstream timeouts result in status 504.
+	Timeout               Duration `json:"timeout,omitempty"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout,omitempty"`
+	IdleTimeout           Duration `json:"idle_timeout,omitempty"`
+	// MaxResponseSize is the maximum size of response bodies in bytes and
+	// MaxRequestSize the maximum size of request bodies.
+	MaxResponseSize int64 `json:"max_response_size,omitempty"`
+	MaxRequestSize  int64 `json:"max_request_size,omitempty"`
+	// FlushInterval is how often streamed responses are flushed to the
+	// client, negative values flush immediately.
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+	// PingInterval is the time without data after which clients of
+	// WebSocket connections and event streams get a ping.
+	PingInterval Duration `json:"ping_interval,omitempty"`
+
+	// Transform defines transformations of requests and responses of the
+	// route. Rule paths match the request path as forwarded.
+	Transform *transform.Configuration `json:"transform,omitempty"`
+
+	proxy proxy.HTTPProxyHandler
+}
+
+// Duration is a time.Duration which is encoded as string like "1m30s" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %v", err)
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+
+	return nil
+}
+
+// Inject defines which authentication details are injected into forwarded
+// requests as request headers.
+type Inject struct {
+	UserIDHeader   string `json:"user_id_header,omitempty"`
+	UsernameHeader string `json:"username_header,omitempty"`
+	// ClaimsHeader receives the claims of the access token as JWT signed
+	// with KOPANO_PROXY_CLAIMS_SECRET_KEY (HS256).
+	ClaimsHeader string `json:"claims_header,omitempty"`
+}
+
+func loadConfig(fn string) (*Config, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", fn, err)
+	}
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", fn, err)
+	}
+
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Routes) == 0 {
+		return errors.New("no routes")
+	}
+	for _, route := range c.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route prefix %s must start with /", route.Prefix)
+		}
+		if reserved, overlaps := plugins.OverlapsReservedPrefix(route.Prefix); overlaps {
+			return fmt.Errorf("route prefix %s overlaps with %s", route.Prefix, reserved)
+		}
+		if len(route.Upstreams) == 0 {
+			return fmt.Errorf("route %s has no upstreams", route.Prefix)
+		}
+		if route.StripPrefix != "" && !strings.HasPrefix(route.Prefix, route.StripPrefix) {
+			return fmt.Errorf("route %s strip prefix %s does not match", route.Prefix, route.StripPrefix)
+		}
+	}
+
+	// Longest prefix first, so the most specific route wins.
+	sort.SliceStable(c.Routes, func(i, j int) bool {
+		return len(c.Routes[i].Prefix) > len(c.Routes[j].Prefix)
+	})
+
+	return nil
+}
+
+// needsClaimsSecret returns true if any route injects signed claims.
+func (c *Config) needsClaimsSecret() bool {
+	for _, route := range c.Routes {
+		if route.Inject != nil && route.Inject.ClaimsHeader != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// needsStickySecret returns true if any route pins upstreams with cookies.
+func (c *Config) needsStickySecret() bool {
+	for _, route := range c.Routes {
+		if strings.Contains(route.Sticky, "pin-cookie") {
+			return true
+		}
+	}
+
+	return false
+}
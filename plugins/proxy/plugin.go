@@ -0,0 +1,264 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/proxy/httpproxy"
+	"stash.kopano.io/kc/kapi/proxy/transform"
+	"stash.kopano.io/kc/kapi/version"
+)
+
+var pluginInfo = &plugins.InfoV1{
+	ID:        "proxy",
+	Version:   version.Version,
+	BuildDate: version.BuildDate,
+}
+
+var proxyConfiguration = &httpproxy.Configuration{
+	Policy:      "random",
+	FailTimeout: 500 * time.Millisecond,
+	MaxFails:    1,
+	MaxConns:    0,
+	Keepalive:   100,
+	TryDuration: 1 * time.Second,
+	TryInterval: 50 * time.Millisecond,
+	Sticky:      "nocache",
+}
+
+// ProxyPlugin implements a generic configurable reverse proxy within Kopano
+// API.
+type ProxyPlugin struct {
+	ctx context.Context
+	srv plugins.ServerV1
+
+	config       *Config
+	claimsSecret []byte
+	stickySecret []byte
+
+	proxies []*httpproxy.Proxy
+}
+
+// Info returns the accociated plugins plugin.Info.
+func (p *ProxyPlugin) Info() *plugins.InfoV1 {
+	return pluginInfo
+}
+
+// Initialize initizalizes the accociated plugin.
+func (p *ProxyPlugin) Initialize(ctx context.Context, errCh chan<- error, srv plugins.ServerV1) error {
+	var err error
+
+	p.ctx = ctx
+	p.srv = srv
+
+	srv.Logger().Debugln("proxy: initialize")
+
+	configFile := os.Getenv("KOPANO_PROXY_CONFIG")
+	if configFile == "" {
+		return fmt.Errorf("KOPANO_PROXY_CONFIG environment variable is not set but required")
+	}
+	p.config, err = loadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("proxy: %v", err)
+	}
+
+	if p.config.needsClaimsSecret() {
+		secretString := os.Getenv("KOPANO_PROXY_CLAIMS_SECRET_KEY")
+		if secretString == "" {
+			return fmt.Errorf("KOPANO_PROXY_CLAIMS_SECRET_KEY environment variable is not set but required for claims injection")
+		}
+		p.claimsSecret, err = hex.DecodeString(secretString)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to hex decode claims secret key: %v", err)
+		}
+		if len(p.claimsSecret) < 32 {
+			return fmt.Errorf("proxy: claims secret key too small, at least 32 bytes are required")
+		}
+	}
+
+	if p.config.needsStickySecret() {
+		if secretString := os.Getenv("KOPANO_PROXY_STICKY_SECRET_KEY"); secretString != "" {
+			p.stickySecret, err = hex.DecodeString(secretString)
+			if err != nil {
+				return fmt.Errorf("proxy: failed to hex decode sticky secret key: %v", err)
+			}
+			if len(p.stickySecret) < 32 {
+				return fmt.Errorf("proxy: sticky secret key too small, at least 32 bytes are required")
+			}
+		} else {
+			p.srv.Logger().Warnln("proxy: KOPANO_PROXY_STICKY_SECRET_KEY is not set, using random key - sticky cookies will not survive restarts")
+		}
+	}
+
+	for _, route := range p.config.Routes {
+		configuration := *proxyConfiguration
+		configuration.Timeout = time.Duration(route.Timeout)
+		configuration.ResponseHeaderTimeout = time.Duration(route.ResponseHeaderTimeout)
+		configuration.IdleTimeout = time.Duration(route.IdleTimeout)
+		configuration.MaxResponseSize = route.MaxResponseSize
+		configuration.MaxRequestSize = route.MaxRequestSize
+		configuration.FlushInterval = time.Duration(route.FlushInterval)
+		configuration.PingInterval = time.Duration(route.PingInterval)
+		if route.Sticky != "" {
+			configuration.Sticky = proxyConfiguration.Sticky + " " + route.Sticky
+			configuration.StickySecret = p.stickySecret
+		}
+		routeProxy, err := httpproxy.New("proxy:"+route.Prefix, route.Upstreams, &configuration)
+		if err != nil {
+			return fmt.Errorf("proxy: failed to create proxy for %s: %v", route.Prefix, err)
+		}
+		p.proxies = append(p.proxies, routeProxy)
+		route.proxy = routeProxy
+		if route.Transform != nil {
+			transformer, transformErr := transform.New(route.Transform)
+			if transformErr != nil {
+				return fmt.Errorf("proxy: invalid transform for %s: %v", route.Prefix, transformErr)
+			}
+			route.proxy = transformer.Handler(route.proxy)
+		}
+		p.srv.Logger().WithFields(logrus.Fields{
+			"prefix":          route.Prefix,
+			"upstreams":       route.Upstreams,
+			"required_scopes": route.Scopes,
+		}).Infoln("proxy: route set up")
+	}
+
+	return nil
+}
+
+// DrainV1 ends the WebSocket connections and event streams of all routes of
+// the accociated plugin cleanly.
+func (p *ProxyPlugin) DrainV1() {
+	p.srv.Logger().Debugln("proxy: drain")
+
+	for _, routeProxy := range p.proxies {
+		routeProxy.Drain()
+	}
+}
+
+// Close closes the accociated plugin.
+func (p *ProxyPlugin) Close() error {
+	p.srv.Logger().Debugln("proxy: close")
+
+	for _, routeProxy := range p.proxies {
+		routeProxy.Close()
+	}
+
+	return nil
+}
+
+// ServeHTTP serves HTTP requests.
+func (p *ProxyPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) (bool, error) {
+	route := p.match(req.URL.Path)
+	if plugins.HasDotSegments(req.URL.Path) {
+		// NOTE: Paths are not cleaned by the server, but upstreams might
+		// resolve them to a route with other scopes than the matched one.
+		if route == nil {
+			route = p.match(path.Clean(req.URL.Path))
+		}
+		if route == nil {
+			return false, nil
+		}
+		http.Error(rw, "", http.StatusBadRequest)
+		return true, nil
+	}
+	if route == nil {
+		// Fast exit.
+		return false, nil
+	}
+
+	handler := p.srv.AccessTokenRequired(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleRoute(rw, req, route)
+	}), route.Scopes)
+
+	// Execute handler.
+	handler.ServeHTTP(rw, req)
+
+	return true, nil
+}
+
+// match returns the route of the provided path, or nil if there is none.
+func (p *ProxyPlugin) match(path string) *Route {
+	for _, route := range p.config.Routes {
+		if plugins.MatchesPrefix(path, route.Prefix) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+func (p *ProxyPlugin) handleRoute(rw http.ResponseWriter, req *http.Request, route *Route) {
+	// Inject proper auth.
+	if route.Inject != nil {
+		err := p.injectAuthIntoRequestHeaders(req, route.Inject)
+		if err != nil {
+			p.srv.Logger().WithError(err).Debugln("auth required")
+			http.Error(rw, "", http.StatusForbidden)
+			return
+		}
+	}
+
+	// Rewrite path.
+	if route.StripPrefix != "" || route.AddPrefix != "" {
+		path := strings.TrimPrefix(req.URL.Path, route.StripPrefix)
+		if route.AddPrefix != "" {
+			path = strings.TrimSuffix(route.AddPrefix, "/") + "/" + strings.TrimPrefix(path, "/")
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+
+	// Proxy all.
+	p.srv.HandleWithProxy(route.proxy, http.HandlerFunc(p.handleNoProxy)).ServeHTTP(rw, req)
+}
+
+func (p *ProxyPlugin) handleNoProxy(rw http.ResponseWriter, req *http.Request) {
+	// NOTE(longsleep): This handler is only reached when no proxy is available.
+
+	p.srv.Logger().WithError(errors.New("proxy not configured")).Errorln("proxy: proxy request not possible")
+	http.Error(rw, "", http.StatusBadGateway)
+}
+
+// Register is the exported registration entry point as loaded by Kopano API to
+// register plugins.
+var Register plugins.RegisterPluginV1 = func() plugins.PluginV1 {
+	return &ProxyPlugin{}
+}
+
+func init() {
+	err := plugins.RegisterV1("proxy", Register)
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+func TestProxyRoutes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"path":   req.URL.Path,
+			"user":   req.Header.Get("X-User-ID"),
+			"claims": req.Header.Get("X-Claims"),
+		})
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "kapi-proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, _ := json.Marshal(&Config{
+		Routes: []*Route{
+			{
+				Prefix:      "/api/example/v1/",
+				Upstreams:   []string{upstream.URL},
+				StripPrefix: "/api/example/",
+				AddPrefix:   "/service/",
+				Inject: &Inject{
+					UserIDHeader: "X-User-ID",
+					ClaimsHeader: "X-Claims",
+				},
+			},
+			{
+				Prefix:    "/svc/admin",
+				Upstreams: []string{upstream.URL},
+				Scopes:    []string{"admin"},
+			},
+		},
+	})
+	configFile := filepath.Join(dir, "proxy.json")
+	if err = ioutil.WriteFile(configFile, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret := make([]byte, 32)
+	os.Setenv("KOPANO_PROXY_CONFIG", configFile)
+	os.Setenv("KOPANO_PROXY_CLAIMS_SECRET_KEY", hex.EncodeToString(secret))
+	defer os.Unsetenv("KOPANO_PROXY_CONFIG")
+	defer os.Unsetenv("KOPANO_PROXY_CLAIMS_SECRET_KEY")
+
+	srv := pluginstest.NewServer()
+	srv.Records["test"] = &auth.Record{
+		AuthenticatedUserID: "user1",
+		StandardClaims: &jwt.StandardClaims{
+			Subject: "user1",
+			Issuer:  "https://issuer.local",
+		},
+	}
+
+	p := Register().(*ProxyPlugin)
+	if err = p.Initialize(context.Background(), make(chan error, 1), srv); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	rw := httptest.NewRecorder()
+	handled, _ := p.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/other/v1/", nil))
+	if handled {
+		t.Error("unrelated request was handled")
+	}
+	rw = httptest.NewRecorder()
+	handled, _ = p.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/svc/administrator", nil))
+	if handled {
+		t.Error("request to partial prefix segment was handled")
+	}
+
+	for _, path := range []string{
+		"/api/example/v1/../../../svc/admin",
+		"/api/example/v1/%2E%2E/%2e%2e/%2e%2e/svc/admin",
+		"/svc/other/../admin",
+		"/svc/admin/./users",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer test")
+		rw = httptest.NewRecorder()
+		handled, _ = p.ServeHTTP(rw, req)
+		if !handled || rw.Code != http.StatusBadRequest {
+			t.Errorf("unexpected result for path with dot segments %s: %v %d", path, handled, rw.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/example/v1/hello", nil)
+	req.Header.Set("Authorization", "Bearer test")
+	req.Header.Set("X-User-ID", "forged")
+	rw = httptest.NewRecorder()
+	handled, _ = p.ServeHTTP(rw, req)
+	if !handled {
+		t.Fatal("request was not handled")
+	}
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rw.Code)
+	}
+
+	var data map[string]string
+	if err = json.Unmarshal(rw.Body.Bytes(), &data); err != nil {
+		t.Fatal(err)
+	}
+	if data["path"] != "/service/v1/hello" {
+		t.Errorf("unexpected upstream path: %s", data["path"])
+	}
+	if data["user"] != "user1" {
+		t.Errorf("unexpected upstream user: %s", data["user"])
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(data["claims"], claims, func(token *jwt.Token) (interface{}, error) {
+		return secret, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to verify claims: %v", err)
+	}
+	if claims["sub"] != "user1" || claims["iss"] != "https://issuer.local" {
+		t.Errorf("unexpected claims: %v", claims)
+	}
+}
+
+func TestInjectServicePrincipal(t *testing.T) {
+	p := &ProxyPlugin{}
+	record := &auth.Record{
+		AuthenticatedUserID: "client1",
+		ServicePrincipal:    &auth.ServicePrincipal{ClientID: "client1"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/example/v1/hello", nil)
+	req = req.WithContext(auth.ContextWithRecord(req.Context(), record))
+	req.Header.Set("X-User-ID", "forged")
+	if err := p.injectAuthIntoRequestHeaders(req, &Inject{UserIDHeader: "X-User-ID"}); err == nil {
+		t.Error("service client injected as user")
+	}
+	if value := req.Header.Get("X-User-ID"); value != "" {
+		t.Errorf("user ID header not removed: %s", value)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/example/v1/hello", nil)
+	req = req.WithContext(auth.ContextWithRecord(req.Context(), record))
+	if err := p.injectAuthIntoRequestHeaders(req, &Inject{}); err != nil {
+		t.Errorf("service client without user ID injection denied: %v", err)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	route := &Route{}
+	if err := json.Unmarshal([]byte(`{"timeout": "1m30s", "flush_interval": "-1ns"}`), route); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(route.Timeout) != 90*time.Second || route.FlushInterval != -1 {
+		t.Errorf("unexpected durations: %v %v", route.Timeout, route.FlushInterval)
+	}
+	if data, _ := json.Marshal(route.Timeout); string(data) != `"1m30s"` {
+		t.Errorf("unexpected encoding: %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"timeout": 90}`), route); err == nil {
+		t.Error("expected error for duration number")
+	}
+}
+
+func TestConfigReservedPrefixes(t *testing.T) {
+	for _, prefix := range []string{"/", "/api/", "/api/gc/", "/api/kvs/v1/example/", "/health-check"} {
+		config := &Config{
+			Routes: []*Route{
+				{Prefix: prefix, Upstreams: []string{"http://127.0.0.1:8080"}},
+			},
+		}
+		if err := config.validate(); err == nil {
+			t.Errorf("expected error for route prefix %s", prefix)
+		}
+	}
+
+	config := &Config{
+		Routes: []*Route{
+			{Prefix: "/api/example/v1/", Upstreams: []string{"http://127.0.0.1:8080"}},
+		},
+	}
+	if err := config.validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
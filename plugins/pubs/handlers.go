@@ -178,13 +178,14 @@ func (p *PubsPlugin) handleWebsocketConnect(ctx context.Context) (string, error)
 		when: time.Now(),
 	}
 
-	authenticatedUserID, _ := auth.AuthenticatedUserIDFromContext(ctx)
-	if authenticatedUserID == "" {
+	authRecord, _ := auth.RecordFromContext(ctx)
+	if authRecord == nil || authRecord.AuthenticatedUserID == "" {
 		return "", fmt.Errorf("request is not authorized")
 	}
 
 	record.user = &userRecord{
-		id: authenticatedUserID,
+		id:   authRecord.AuthenticatedUserID,
+		auth: authRecord,
 	}
 
 	p.keys.Set(key, record)
@@ -218,6 +219,7 @@ func (p *PubsPlugin) handleWebsocketConnection(ctx context.Context, key string,
 	}
 
 	id := strconv.FormatUint(atomic.AddUint64(&p.count, 1), 10)
+	p.connectionUsers.Set(id, kr.user)
 
 	loggerFields := logrus.Fields{
 		"websocket_connection": id,
@@ -225,6 +227,7 @@ func (p *PubsPlugin) handleWebsocketConnection(ctx context.Context, key string,
 
 	c, err := connection.New(ctx, ws, p, p.srv.Logger().WithFields(loggerFields), id)
 	if err != nil {
+		p.connectionUsers.Remove(id)
 		return err
 	}
 
@@ -241,4 +244,5 @@ func (p *PubsPlugin) serveWebsocketConnection(c *connection.Connection, id strin
 	p.connections.Set(id, c)
 	c.ServeWS(p.ctx)
 	p.connections.Remove(id)
+	p.connectionUsers.Remove(id)
 }
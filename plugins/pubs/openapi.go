@@ -0,0 +1,207 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pubs
+
+import (
+	"text/template"
+
+	"stash.kopano.io/kc/kapi/openapi"
+)
+
+var openAPITemplate = template.Must(template.New("openapi").Funcs(openapi.TemplateFuncs).Parse(`{
+	"openapi": "3.0.3",
+	"tags": [
+		{
+			"name": "pubs",
+			"description": "Pub/sub with webhooks and websocket streams"
+		}
+	],
+	"paths": {
+		"/api/pubs/v1/webhook": {
+			"post": {
+				"tags": ["pubs"],
+				"summary": "Register webhook",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"parameters": [
+					{
+						"name": "topic",
+						"in": "query",
+						"description": "Topic to publish to. A random topic is created when not set.",
+						"schema": {
+							"type": "string"
+						}
+					}
+				],
+				"responses": {
+					"200": {
+						"description": "Webhook registered.",
+						"content": {
+							"application/json": {
+								"schema": {"$ref": "#/components/schemas/pubsWebhookRegisterResponse"}
+							}
+						}
+					},
+					"403": {"description": "Access denied."}
+				}
+			}
+		},
+		"/api/pubs/v1/webhook/{id}/{token}": {
+			"parameters": [
+				{"$ref": "#/components/parameters/pubsWebhookID"},
+				{"$ref": "#/components/parameters/pubsWebhookToken"}
+			],
+			"post": {
+				"tags": ["pubs"],
+				"summary": "Publish to webhook",
+				"parameters": [
+					{
+						"name": "validationToken",
+						"in": "query",
+						"description": "Validation handshake token which is returned unmodified.",
+						"schema": {
+							"type": "string"
+						}
+					}
+				],
+				"requestBody": {
+					"content": {
+						"application/json": {}
+					}
+				},
+				"responses": {
+					"200": {"description": "Validation token."},
+					"204": {"description": "Published."},
+					"400": {"description": "Invalid request body."},
+					"422": {"description": "Invalid token."}
+				}
+			}
+		},
+		"/api/pubs/v1/webhook/{id}/{token}/{envelope}": {
+			"parameters": [
+				{"$ref": "#/components/parameters/pubsWebhookID"},
+				{"$ref": "#/components/parameters/pubsWebhookToken"},
+				{
+					"name": "envelope",
+					"in": "path",
+					"required": true,
+					"description": "Type of the JSON envelope enclosing the published data.",
+					"schema": {
+						"type": "string"
+					}
+				}
+			],
+			"post": {
+				"tags": ["pubs"],
+				"summary": "Publish to webhook with envelope",
+				"requestBody": {
+					"content": {
+						"application/json": {}
+					}
+				},
+				"responses": {
+					"204": {"description": "Published."},
+					"400": {"description": "Invalid request body."},
+					"422": {"description": "Invalid token."}
+				}
+			}
+		},
+		"/api/pubs/v1/stream/connect": {
+			"get": {
+				"tags": ["pubs"],
+				"summary": "Get websocket stream URL",
+				"security": [{"oidc": {{json .Scopes}}}],
+				"responses": {
+					"200": {
+						"description": "Single use websocket stream URL.",
+						"content": {
+							"application/json": {
+								"schema": {"$ref": "#/components/schemas/pubsStreamConnectResponse"}
+							}
+						}
+					},
+					"403": {"description": "Access denied."}
+				}
+			}
+		},
+		"/api/pubs/v1/stream/websocket/{key}": {
+			"get": {
+				"tags": ["pubs"],
+				"summary": "Websocket stream",
+				"parameters": [
+					{
+						"name": "key",
+						"in": "path",
+						"required": true,
+						"schema": {
+							"type": "string"
+						}
+					}
+				],
+				"responses": {
+					"101": {"description": "Switching to websocket protocol."},
+					"404": {"description": "Unknown or already used key."}
+				}
+			}
+		}
+	},
+	"components": {
+		"parameters": {
+			"pubsWebhookID": {
+				"name": "id",
+				"in": "path",
+				"required": true,
+				"schema": {
+					"type": "string"
+				}
+			},
+			"pubsWebhookToken": {
+				"name": "token",
+				"in": "path",
+				"required": true,
+				"schema": {
+					"type": "string"
+				}
+			}
+		},
+		"schemas": {
+			"pubsWebhookRegisterResponse": {
+				"type": "object",
+				"properties": {
+					"id": {"type": "string"},
+					"topic": {"type": "string"},
+					"pubUrl": {"type": "string"}
+				}
+			},
+			"pubsStreamConnectResponse": {
+				"type": "object",
+				"properties": {
+					"streamUrl": {"type": "string"}
+				}
+			}
+		}
+	}
+}`))
+
+// OpenAPIV1 returns the OpenAPI document fragment of the accociated plugin.
+func (p *PubsPlugin) OpenAPIV1() (*openapi.Document, error) {
+	return openapi.Execute(openAPITemplate, &struct {
+		Scopes []string
+	}{
+		Scopes: scopesRequired,
+	})
+}
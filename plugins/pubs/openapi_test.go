@@ -0,0 +1,43 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pubs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	p := &PubsPlugin{
+		srv: pluginstest.NewServer(),
+	}
+	router := mux.NewRouter()
+	p.addRoutes(context.Background(), router)
+
+	doc, err := p.OpenAPIV1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = doc.VerifyRouter(router); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"encoding/hex"
@@ -34,6 +35,7 @@ import (
 	"github.com/rs/cors"
 	"stash.kopano.io/kgol/rndm"
 
+	"stash.kopano.io/kc/kapi/auth"
 	"stash.kopano.io/kc/kapi/plugins"
 	"stash.kopano.io/kc/kapi/version"
 )
@@ -73,6 +75,12 @@ type PubsPlugin struct {
 
 	count       uint64
 	connections cmap.ConcurrentMap
+
+	topicKey        []byte
+	connectionUsers cmap.ConcurrentMap
+	usersMutex      sync.Mutex
+	users           map[string]map[*userRecord]struct{}
+	userWatchers    []UserWatcher
 }
 
 // Info returns the accociated plugins plugin.Info.
@@ -131,6 +139,17 @@ func (p *PubsPlugin) Initialize(ctx context.Context, errCh chan<- error, srv plu
 
 	p.connections = cmap.New()
 
+	p.topicKey = hashKey
+	p.connectionUsers = cmap.New()
+	p.users = make(map[string]map[*userRecord]struct{})
+
+	if err = srv.RegisterService(PublisherServiceID, Publisher(p)); err != nil {
+		return fmt.Errorf("pubs: failed to register publisher service: %v", err)
+	}
+	if err = srv.RegisterService(UsersServiceID, Users(p)); err != nil {
+		return fmt.Errorf("pubs: failed to register users service: %v", err)
+	}
+
 	// Cleanup function.
 	go func() {
 		ticker := time.NewTicker(connectCleanupInterval)
@@ -187,7 +206,8 @@ func (p *PubsPlugin) purgeExpiredKeys() {
 }
 
 type userRecord struct {
-	id string
+	id   string
+	auth *auth.Record
 }
 
 // Register is the exported registration entry point as loaded by Kopano API to
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pubs
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// PublisherServiceID is the ID of the Publisher service registered by the
+// pubs plugin.
+const PublisherServiceID = "pubs.publisher"
+
+// Publisher is the service interface for other plugins to publish events to
+// pubs topics.
+type Publisher interface {
+	// Publish sends the provided JSON data as event to all subscribers of the
+	// provided topics. The ref identifies the sender and is included in the
+	// event info.
+	Publish(ref string, data json.RawMessage, topics ...string) error
+}
+
+// Publish implements the Publisher interface.
+func (p *PubsPlugin) Publish(ref string, data json.RawMessage, topics ...string) error {
+	if len(topics) == 0 {
+		return errors.New("pubsub_without_topics")
+	}
+
+	info, err := PrettyJSON(&streamTopicDefinition{
+		Ref:    ref,
+		Topics: topics,
+	})
+	if err != nil {
+		return err
+	}
+
+	event, err := PrettyJSON(&streamEnvelope{
+		Type: streamEnvelopeTypeEvent,
+		Data: data,
+		Info: info,
+	})
+	if err != nil {
+		return err
+	}
+
+	p.pubsub.Pub(event, topics...)
+
+	return nil
+}
@@ -27,8 +27,9 @@ import (
 )
 
 type pubsubBinder struct {
-	id string
-	ch chan interface{}
+	id   string
+	ch   chan interface{}
+	user *userRecord
 }
 
 func (p *PubsPlugin) onSubInit(c *connection.Connection) error {
@@ -39,9 +40,21 @@ func (p *PubsPlugin) onSubInit(c *connection.Connection) error {
 	}
 	c.Bind(binder)
 
+	// Subscribe to the topic of the connected user, which is announced with
+	// the hello.
+	var user *userRecord
+	var topics []string
+	if record, ok := p.connectionUsers.Get(c.ID()); ok {
+		user = record.(*userRecord)
+		topic := p.UserTopic(user.id)
+		p.pubsub.AddSub(ch, topic)
+		topics = append(topics, topic)
+	}
+
 	// Say hello.
 	info, err := PrettyJSON(&streamTopicDefinition{
-		Ref: binder.id,
+		Ref:    binder.id,
+		Topics: topics,
 	})
 	if err != nil {
 		return err
@@ -83,6 +96,11 @@ func (p *PubsPlugin) onSubInit(c *connection.Connection) error {
 		}
 	}()
 
+	if user != nil {
+		binder.user = user
+		p.userConnected(user)
+	}
+
 	c.Logger().WithField("id", binder.id).Debugln("pubs: pubsub connection initialized")
 
 	return nil
@@ -141,6 +159,9 @@ func (p *PubsPlugin) onUnsubAll(c *connection.Connection) error {
 
 	c.Logger().WithField("id", binder.id).Debugln("pubs: unsub all with connection")
 	p.pubsub.Unsub(binder.ch)
+	if binder.user != nil {
+		p.userDisconnected(binder.user)
+	}
 	return nil
 }
 
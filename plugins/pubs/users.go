@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pubs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"time"
+
+	"stash.kopano.io/kc/kapi/auth"
+)
+
+// UsersServiceID is the ID of the Users service registered by the pubs
+// plugin.
+const UsersServiceID = "pubs.users"
+
+// Users is the service interface for other plugins to follow which users are
+// connected to the pubs websocket stream and to send events to them.
+type Users interface {
+	// UserTopic returns the topic to which all websocket streams of the
+	// provided user are subscribed. The topic is not guessable, so only the
+	// user receives its events.
+	UserTopic(userID string) string
+	// WatchUsers registers the provided watcher to be notified when users
+	// connect to and disconnect from the websocket stream.
+	WatchUsers(watcher UserWatcher)
+	// UserAuth returns the auth record of a connected websocket stream of the
+	// provided user whose access token has not expired, preferring the one
+	// which expires last.
+	UserAuth(userID string) (*auth.Record, bool)
+}
+
+// UserWatcher is notified whenever a websocket stream of a user connects and
+// when its last one disconnects. Notifications must not block.
+type UserWatcher interface {
+	UserConnected(record *auth.Record)
+	UserDisconnected(record *auth.Record)
+}
+
+// UserTopic implements the Users interface.
+func (p *PubsPlugin) UserTopic(userID string) string {
+	mac := hmac.New(sha256.New, p.topicKey)
+	mac.Write([]byte("user:" + userID))
+
+	return "user-" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// WatchUsers implements the Users interface.
+func (p *PubsPlugin) WatchUsers(watcher UserWatcher) {
+	p.usersMutex.Lock()
+	defer p.usersMutex.Unlock()
+
+	p.userWatchers = append(p.userWatchers, watcher)
+}
+
+// UserAuth implements the Users interface.
+func (p *PubsPlugin) UserAuth(userID string) (*auth.Record, bool) {
+	p.usersMutex.Lock()
+	defer p.usersMutex.Unlock()
+
+	now := time.Now()
+	var record *auth.Record
+	for user := range p.users[userID] {
+		if user.auth.Expired(now) {
+			continue
+		}
+		if record == nil || expiresAt(user.auth) > expiresAt(record) {
+			record = user.auth
+		}
+	}
+
+	return record, record != nil
+}
+
+// expiresAt returns the expiration time of the provided auth record as Unix
+// time, with records without expiration last.
+func expiresAt(record *auth.Record) int64 {
+	if record.StandardClaims == nil || record.StandardClaims.ExpiresAt == 0 {
+		return math.MaxInt64
+	}
+
+	return record.StandardClaims.ExpiresAt
+}
+
+func (p *PubsPlugin) userConnected(user *userRecord) {
+	p.usersMutex.Lock()
+	defer p.usersMutex.Unlock()
+
+	if p.users[user.id] == nil {
+		p.users[user.id] = make(map[*userRecord]struct{})
+	}
+	p.users[user.id][user] = struct{}{}
+	for _, watcher := range p.userWatchers {
+		watcher.UserConnected(user.auth)
+	}
+}
+
+func (p *PubsPlugin) userDisconnected(user *userRecord) {
+	p.usersMutex.Lock()
+	defer p.usersMutex.Unlock()
+
+	delete(p.users[user.id], user)
+	if len(p.users[user.id]) > 0 {
+		return
+	}
+	delete(p.users, user.id)
+	for _, watcher := range p.userWatchers {
+		watcher.UserDisconnected(user.auth)
+	}
+}
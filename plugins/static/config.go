@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"stash.kopano.io/kc/kapi/plugins"
+)
+
+const (
+	defaultIndex = "index.html"
+)
+
+// Config is the configuration of the static plugin.
+type Config struct {
+	Sites []*Site `json:"sites"`
+}
+
+// Site is a directory served under an URL path prefix.
+type Site struct {
+	Prefix string `json:"prefix"`
+	Root   string `json:"root"`
+	Index  string `json:"index,omitempty"`
+	// SPA enables serving the index file for requests which do not match a
+	// file, so client side routing of single page applications works.
+	SPA bool `json:"spa,omitempty"`
+
+	CacheControl []*CacheControlRule `json:"cache_control,omitempty"`
+	Protected    []*ProtectedPath    `json:"protected,omitempty"`
+}
+
+// CacheControlRule sets the Cache-Control header value for files matching
+// the pattern. Patterns without a slash match the file name, other patterns
+// match the path relative to the site root (see path.Match).
+type CacheControlRule struct {
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+}
+
+// ProtectedPath is a path prefix relative to the site prefix, which requires
+// an access token with the provided scopes.
+type ProtectedPath struct {
+	Prefix string   `json:"prefix"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func loadConfig(fn string) (*Config, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %v", fn, err)
+	}
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", fn, err)
+	}
+
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	if len(c.Sites) == 0 {
+		return errors.New("no sites")
+	}
+	for _, site := range c.Sites {
+		if !strings.HasPrefix(site.Prefix, "/") || !strings.HasSuffix(site.Prefix, "/") {
+			return fmt.Errorf("site prefix %s must start and end with /", site.Prefix)
+		}
+		if reserved, overlaps := plugins.OverlapsReservedPrefix(site.Prefix); overlaps {
+			return fmt.Errorf("site prefix %s overlaps with %s", site.Prefix, reserved)
+		}
+		if site.Root == "" {
+			return fmt.Errorf("site %s has no root", site.Prefix)
+		}
+		root, err := filepath.Abs(site.Root)
+		if err != nil {
+			return fmt.Errorf("site %s root is invalid: %v", site.Prefix, err)
+		}
+		site.Root = root
+		if site.Index == "" {
+			site.Index = defaultIndex
+		}
+		for _, rule := range site.CacheControl {
+			if _, err = path.Match(rule.Pattern, ""); err != nil {
+				return fmt.Errorf("site %s cache control pattern %s is invalid: %v", site.Prefix, rule.Pattern, err)
+			}
+		}
+		for _, protected := range site.Protected {
+			if !strings.HasPrefix(protected.Prefix, "/") {
+				return fmt.Errorf("site %s protected prefix %s must start with /", site.Prefix, protected.Prefix)
+			}
+		}
+	}
+
+	// Longest prefix first, so the most specific site wins.
+	sort.SliceStable(c.Sites, func(i, j int) bool {
+		return len(c.Sites[i].Prefix) > len(c.Sites[j].Prefix)
+	})
+
+	return nil
+}
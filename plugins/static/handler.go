@@ -0,0 +1,231 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precompressedEncodings are the supported precompressed file variants in the
+// order of preference.
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// handleSite serves the file for the provided site relative path.
+func (p *StaticPlugin) handleSite(rw http.ResponseWriter, req *http.Request, site *Site, name string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if hasDotSegment(name) {
+		// Never serve hidden files like .git or .env.
+		http.Error(rw, "", http.StatusNotFound)
+		return
+	}
+
+	fn, fi, err := site.lookup(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			p.srv.Logger().WithError(err).Debugln("static: failed to stat file")
+		}
+		if !site.SPA || !wantsIndex(req, name) {
+			http.Error(rw, "", http.StatusNotFound)
+			return
+		}
+		// Single page application fallback.
+		name = "/" + site.Index
+		fn, fi, err = site.lookup(name)
+		if err != nil {
+			http.Error(rw, "", http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Cache-Control", "no-cache")
+	}
+	if cacheControl, ok := site.cacheControl(name); ok {
+		rw.Header().Set("Cache-Control", cacheControl)
+	}
+
+	p.serveFile(rw, req, site, fn, fi)
+}
+
+// lookup finds the file for the provided site relative path, resolving
+// directories to their index file.
+func (site *Site) lookup(name string) (string, os.FileInfo, error) {
+	fn := filepath.Join(site.Root, filepath.FromSlash(path.Clean("/"+name)))
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return "", nil, err
+	}
+	if fi.IsDir() {
+		fn = filepath.Join(fn, site.Index)
+		fi, err = os.Stat(fn)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	if !fi.Mode().IsRegular() || !site.contains(fn) {
+		return "", nil, os.ErrNotExist
+	}
+
+	return fn, fi, nil
+}
+
+// contains returns true if the provided file is inside of the site root after
+// resolving symbolic links, so links never lead outside of the root.
+func (site *Site) contains(fn string) bool {
+	resolved, err := filepath.EvalSymlinks(fn)
+	if err != nil {
+		return false
+	}
+	root, err := filepath.EvalSymlinks(site.Root)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(resolved, root+string(filepath.Separator))
+}
+
+// hasDotSegment returns true if any segment of the provided path starts with
+// a dot.
+func hasDotSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cacheControl returns the Cache-Control value of the first rule matching the
+// provided site relative path.
+func (site *Site) cacheControl(name string) (string, bool) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	base := path.Base(name)
+	for _, rule := range site.CacheControl {
+		subject := name
+		if !strings.Contains(rule.Pattern, "/") {
+			subject = base
+		}
+		if ok, _ := path.Match(rule.Pattern, subject); ok {
+			return rule.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// protected returns the protected path matching the provided site relative
+// path, if any.
+func (site *Site) protected(name string) *ProtectedPath {
+	name = path.Clean("/" + name)
+	for _, protected := range site.Protected {
+		prefix := strings.TrimSuffix(protected.Prefix, "/")
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return protected
+		}
+	}
+
+	return nil
+}
+
+// serveFile serves the provided file, using a precompressed variant if one
+// exists and the client accepts its encoding.
+func (p *StaticPlugin) serveFile(rw http.ResponseWriter, req *http.Request, site *Site, fn string, fi os.FileInfo) {
+	contentType := mime.TypeByExtension(filepath.Ext(fn))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	encoding := ""
+	acceptEncoding := req.Header.Get("Accept-Encoding")
+	for _, precompressed := range precompressedEncodings {
+		if !acceptsEncoding(acceptEncoding, precompressed.encoding) {
+			continue
+		}
+		if cfi, err := os.Stat(fn + precompressed.extension); err == nil && cfi.Mode().IsRegular() && site.contains(fn+precompressed.extension) {
+			fn = fn + precompressed.extension
+			fi = cfi
+			encoding = precompressed.encoding
+			break
+		}
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		p.srv.Logger().WithError(err).Debugln("static: failed to open file")
+		http.Error(rw, "", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	header := rw.Header()
+	header.Set("Content-Type", contentType)
+	header.Add("Vary", "Accept-Encoding")
+	etag := fmt.Sprintf("\"%x-%x", fi.ModTime().UnixNano(), fi.Size())
+	if encoding != "" {
+		header.Set("Content-Encoding", encoding)
+		etag += "-" + encoding
+	}
+	header.Set("ETag", etag+"\"")
+
+	http.ServeContent(rw, req, fn, fi.ModTime(), f)
+}
+
+// wantsIndex returns true if a missing file should fall back to the index,
+// which is the case for HTML requests and paths without file extension.
+func wantsIndex(req *http.Request, name string) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html") || path.Ext(name) == ""
+}
+
+func acceptsEncoding(acceptEncoding string, encoding string) bool {
+	for _, value := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(value, ";")
+		if strings.TrimSpace(parts[0]) != encoding {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
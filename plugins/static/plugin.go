@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/version"
+)
+
+var pluginInfo = &plugins.InfoV1{
+	ID:        "static",
+	Version:   version.Version,
+	BuildDate: version.BuildDate,
+}
+
+// StaticPlugin implements static file and single page application hosting
+// within Kopano API.
+type StaticPlugin struct {
+	ctx context.Context
+	srv plugins.ServerV1
+
+	config *Config
+}
+
+// Info returns the accociated plugins plugin.Info.
+func (p *StaticPlugin) Info() *plugins.InfoV1 {
+	return pluginInfo
+}
+
+// Initialize initizalizes the accociated plugin.
+func (p *StaticPlugin) Initialize(ctx context.Context, errCh chan<- error, srv plugins.ServerV1) error {
+	var err error
+
+	p.ctx = ctx
+	p.srv = srv
+
+	srv.Logger().Debugln("static: initialize")
+
+	configFile := os.Getenv("KOPANO_STATIC_CONFIG")
+	if configFile == "" {
+		return fmt.Errorf("KOPANO_STATIC_CONFIG environment variable is not set but required")
+	}
+	p.config, err = loadConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("static: %v", err)
+	}
+
+	for _, site := range p.config.Sites {
+		if fp, statErr := os.Stat(site.Root); statErr != nil || !fp.IsDir() {
+			p.srv.Logger().WithField("root", site.Root).Warnf("static: site root does not exist or is not a directory: %v", statErr)
+		}
+		p.srv.Logger().WithFields(logrus.Fields{
+			"prefix": site.Prefix,
+			"root":   site.Root,
+			"spa":    site.SPA,
+		}).Infoln("static: site set up")
+	}
+
+	return nil
+}
+
+// Close closes the accociated plugin.
+func (p *StaticPlugin) Close() error {
+	p.srv.Logger().Debugln("static: close")
+
+	return nil
+}
+
+// ServeHTTP serves HTTP requests.
+func (p *StaticPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) (bool, error) {
+	var site *Site
+	path := req.URL.Path
+	for _, s := range p.config.Sites {
+		if strings.HasPrefix(path, s.Prefix) {
+			site = s
+			break
+		}
+		if path == strings.TrimSuffix(s.Prefix, "/") {
+			// Redirect to the site prefix, so relative URLs work.
+			http.Redirect(rw, req, s.Prefix, http.StatusMovedPermanently)
+			return true, nil
+		}
+	}
+	if site == nil {
+		// Fast exit.
+		return false, nil
+	}
+
+	name := strings.TrimPrefix(path, strings.TrimSuffix(site.Prefix, "/"))
+	var handler http.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.handleSite(rw, req, site, name)
+	})
+	if protected := site.protected(name); protected != nil {
+		handler = p.srv.AccessTokenRequired(handler, protected.Scopes)
+	}
+
+	// Execute handler.
+	handler.ServeHTTP(rw, req)
+
+	return true, nil
+}
+
+// Register is the exported registration entry point as loaded by Kopano API to
+// register plugins.
+var Register plugins.RegisterPluginV1 = func() plugins.PluginV1 {
+	return &StaticPlugin{}
+}
+
+func init() {
+	err := plugins.RegisterV1("static", Register)
+	if err != nil {
+		panic(err)
+	}
+}
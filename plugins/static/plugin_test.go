@@ -0,0 +1,213 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins/pluginstest"
+)
+
+func newTestPlugin(t *testing.T) (*StaticPlugin, func()) {
+	dir, err := ioutil.TempDir("", "kapi-static-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "app")
+	if err = ioutil.WriteFile(filepath.Join(dir, "outside.txt"), []byte("outside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"index.html":         "<html>index</html>",
+		"assets/app.js":      "app",
+		"assets/app.js.gz":   "app-gzip",
+		"assets/app.js.br":   "app-brotli",
+		"private/secret.txt": "secret",
+		"privateer/open.txt": "open",
+		".env":               "env",
+		".git/config":        "config",
+	}
+	for name, content := range files {
+		fn := filepath.Join(root, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(fn, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"outside.txt":      "../outside.txt",
+		"outside":          "..",
+		"assets/linked.js": "app.js",
+		"assets/lib.js":    "app.js",
+		"assets/lib.js.gz": "../../outside.txt",
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config, _ := json.Marshal(&Config{
+		Sites: []*Site{
+			{
+				Prefix: "/app/",
+				Root:   root,
+				SPA:    true,
+				CacheControl: []*CacheControlRule{
+					{Pattern: "assets/*", Value: "public, max-age=31536000, immutable"},
+				},
+				Protected: []*ProtectedPath{
+					{Prefix: "/private/"},
+				},
+			},
+		},
+	})
+	configFile := filepath.Join(dir, "static.json")
+	if err = ioutil.WriteFile(configFile, config, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KOPANO_STATIC_CONFIG", configFile)
+	defer os.Unsetenv("KOPANO_STATIC_CONFIG")
+
+	srv := pluginstest.NewServer()
+	srv.Records["test"] = &auth.Record{
+		AuthenticatedUserID: "user1",
+	}
+
+	p := Register().(*StaticPlugin)
+	if err = p.Initialize(context.Background(), make(chan error, 1), srv); err != nil {
+		t.Fatal(err)
+	}
+
+	return p, func() {
+		p.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func request(t *testing.T, p *StaticPlugin, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rw := httptest.NewRecorder()
+	if handled, _ := p.ServeHTTP(rw, req); !handled {
+		rw.Code = http.StatusNotImplemented
+	}
+
+	return rw
+}
+
+func TestServeFiles(t *testing.T) {
+	p, cleanup := newTestPlugin(t)
+	defer cleanup()
+
+	for _, test := range []struct {
+		path         string
+		header       http.Header
+		status       int
+		body         string
+		encoding     string
+		cacheControl string
+	}{
+		{"/other/", nil, http.StatusNotImplemented, "", "", ""},
+		{"/app", nil, http.StatusMovedPermanently, "", "", ""},
+		{"/app/", nil, http.StatusOK, "<html>index</html>", "", ""},
+		{"/app/assets/app.js", nil, http.StatusOK, "app", "", "public, max-age=31536000, immutable"},
+		{"/app/assets/app.js", http.Header{"Accept-Encoding": {"gzip"}}, http.StatusOK, "app-gzip", "gzip", "public, max-age=31536000, immutable"},
+		{"/app/assets/app.js", http.Header{"Accept-Encoding": {"gzip, br"}}, http.StatusOK, "app-brotli", "br", "public, max-age=31536000, immutable"},
+		{"/app/assets/app.js", http.Header{"Accept-Encoding": {"gzip, br;q=0"}}, http.StatusOK, "app-gzip", "gzip", "public, max-age=31536000, immutable"},
+		{"/app/assets/missing.js", nil, http.StatusNotFound, "", "", ""},
+		{"/app/some/route", nil, http.StatusOK, "<html>index</html>", "", "no-cache"},
+		{"/app/../outside.txt", nil, http.StatusNotFound, "", "", ""},
+		{"/app/outside.txt", nil, http.StatusNotFound, "", "", ""},
+		{"/app/outside/outside.txt", nil, http.StatusNotFound, "", "", ""},
+		{"/app/assets/linked.js", nil, http.StatusOK, "app", "", "public, max-age=31536000, immutable"},
+		{"/app/assets/lib.js", http.Header{"Accept-Encoding": {"gzip"}}, http.StatusOK, "app", "", "public, max-age=31536000, immutable"},
+		{"/app/private/secret.txt", nil, http.StatusForbidden, "", "", ""},
+		{"/app/private/secret.txt", http.Header{"Authorization": {"Bearer test"}}, http.StatusOK, "secret", "", ""},
+		{"/app/privateer/open.txt", nil, http.StatusOK, "open", "", ""},
+		{"/app/.env", nil, http.StatusNotFound, "", "", ""},
+		{"/app/.git/config", nil, http.StatusNotFound, "", "", ""},
+		{"/app/.git/", http.Header{"Accept": {"text/html"}}, http.StatusNotFound, "", "", ""},
+	} {
+		rw := request(t, p, test.path, test.header)
+		if rw.Code != test.status {
+			t.Errorf("%s: unexpected status: %d", test.path, rw.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if body := rw.Body.String(); body != test.body {
+			t.Errorf("%s: unexpected body: %s", test.path, body)
+		}
+		if encoding := rw.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s: unexpected encoding: %s", test.path, encoding)
+		}
+		if cacheControl := rw.Header().Get("Cache-Control"); cacheControl != test.cacheControl {
+			t.Errorf("%s: unexpected cache control: %s", test.path, cacheControl)
+		}
+	}
+}
+
+func TestConfigReservedPrefixes(t *testing.T) {
+	for _, prefix := range []string{"/", "/api/", "/api/gc/", "/api/kvs/v1/", "/health-check/"} {
+		config := &Config{
+			Sites: []*Site{{Prefix: prefix, Root: "/tmp"}},
+		}
+		if err := config.validate(); err == nil {
+			t.Errorf("expected error for site prefix %s", prefix)
+		}
+	}
+}
+
+func TestETag(t *testing.T) {
+	p, cleanup := newTestPlugin(t)
+	defer cleanup()
+
+	rw := request(t, p, "/app/assets/app.js", nil)
+	etag := rw.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if ct := rw.Header().Get("Content-Type"); ct == "" {
+		t.Error("no Content-Type")
+	}
+
+	rw = request(t, p, "/app/assets/app.js", http.Header{"If-None-Match": {etag}})
+	if rw.Code != http.StatusNotModified {
+		t.Errorf("unexpected status: %d", rw.Code)
+	}
+
+	rw = request(t, p, "/app/assets/app.js", http.Header{"If-None-Match": {etag}, "Accept-Encoding": {"gzip"}})
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status for other encoding: %d", rw.Code)
+	}
+}
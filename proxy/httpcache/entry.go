@@ -0,0 +1,220 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpcache
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entry is a cached response. Entries are not modified once created, so they
+// can be served without locking.
+type entry struct {
+	key      string
+	resource string
+	element  *list.Element
+
+	header http.Header
+	body   []byte
+	size   int64
+
+	vary         map[string]string
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+func newEntry(key string, req *http.Request, header http.Header, body []byte, expires time.Time) *entry {
+	e := &entry{
+		key:      key,
+		resource: req.URL.Path,
+
+		header: cloneHeader(header),
+		body:   append([]byte(nil), body...),
+
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+		expires:      expires,
+	}
+
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				if e.vary == nil {
+					e.vary = make(map[string]string)
+				}
+				e.vary[name] = req.Header.Get(name)
+			}
+		}
+	}
+
+	e.size = int64(len(key) + len(body))
+	for name, values := range e.header {
+		for _, value := range values {
+			e.size += int64(len(name) + len(value))
+		}
+	}
+
+	return e
+}
+
+// matches returns true if the accociated entry can be used for the provided
+// request according to the Vary header of the cached response.
+func (e *entry) matches(req *http.Request) bool {
+	for name, value := range e.vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// refreshed returns a copy of the accociated entry with the headers of a not
+// modified response applied.
+func (e *entry) refreshed(header http.Header, now time.Time) *entry {
+	r := *e
+	r.element = nil
+	r.header = cloneHeader(e.header)
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if values, ok := header[name]; ok {
+			r.header[name] = append([]string(nil), values...)
+		}
+	}
+	r.etag = r.header.Get("ETag")
+	r.lastModified = r.header.Get("Last-Modified")
+	if expires, ok := expiration(r.header, now); ok {
+		r.expires = expires
+	} else {
+		r.expires = now
+	}
+
+	return &r
+}
+
+// serve writes the accociated response, or a not modified response if the
+// provided request is conditional and matches.
+func (e *entry) serve(rw http.ResponseWriter, req *http.Request) {
+	header := rw.Header()
+	for name, values := range e.header {
+		header[name] = append([]string(nil), values...)
+	}
+
+	if e.etag != "" && etagMatches(req.Header["If-None-Match"], e.etag) {
+		header.Del("Content-Length")
+		header.Del("Content-Type")
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		rw.Write(e.body)
+	}
+}
+
+// etagMatches returns true if the provided If-None-Match header values match
+// the provided entity tag, using weak comparison.
+func etagMatches(values []string, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// expiration returns until when a response with the provided header is fresh
+// and false if the response must not be stored at all. Responses without
+// freshness are stored as long as they can be revalidated.
+func expiration(header http.Header, now time.Time) (time.Time, bool) {
+	if _, ok := header["Set-Cookie"]; ok {
+		return now, false
+	}
+	for _, value := range header["Vary"] {
+		if strings.TrimSpace(value) == "*" {
+			return now, false
+		}
+	}
+
+	cacheControl := parseCacheControl(header)
+	if _, ok := cacheControl["no-store"]; ok {
+		return now, false
+	}
+
+	expires := now
+	if _, noCache := cacheControl["no-cache"]; !noCache {
+		if maxAge, ok := cacheControl["max-age"]; ok {
+			if seconds, err := strconv.ParseInt(maxAge, 10, 64); err == nil && seconds > 0 {
+				expires = now.Add(time.Duration(seconds) * time.Second)
+			}
+		} else if value := header.Get("Expires"); value != "" {
+			if t, err := http.ParseTime(value); err == nil {
+				// Relative to the Date of the response, if any.
+				if date, dateErr := http.ParseTime(header.Get("Date")); dateErr == nil {
+					t = now.Add(t.Sub(date))
+				}
+				expires = t
+			}
+		}
+	}
+
+	if !expires.After(now) && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		return now, false
+	}
+
+	return expires, true
+}
+
+// parseCacheControl returns the directives of all Cache-Control headers in
+// the provided header.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, argument := directive, ""
+			if sep := strings.IndexByte(directive, '='); sep >= 0 {
+				name, argument = directive[:sep], strings.Trim(directive[sep+1:], `"`)
+			}
+			directives[strings.ToLower(name)] = argument
+		}
+	}
+
+	return directives
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string(nil), values...)
+	}
+
+	return clone
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpcache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"stash.kopano.io/kc/kapi/proxy"
+)
+
+// Results of cache lookups as used in metrics.
+const (
+	resultHit         = "hit"
+	resultMiss        = "miss"
+	resultRevalidated = "revalidated"
+	resultBypass      = "bypass"
+)
+
+var (
+	requestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kapi",
+		Subsystem: "httpcache",
+		Name:      "requests_total",
+		Help:      "Total number of requests handled by the HTTP cache by result",
+	}, []string{"cache", "result"})
+	sizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kapi",
+		Subsystem: "httpcache",
+		Name:      "size_bytes",
+		Help:      "Size of the responses in the HTTP cache",
+	}, []string{"cache"})
+	entriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kapi",
+		Subsystem: "httpcache",
+		Name:      "entries",
+		Help:      "Number of responses in the HTTP cache",
+	}, []string{"cache"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsCounter, sizeGauge, entriesGauge)
+}
+
+// A KeyFunc returns the key of the user of a request. Requests for which it
+// returns an empty string are not cached.
+type KeyFunc func(req *http.Request) string
+
+// Cache is a private HTTP cache for responses of GET requests, which keeps
+// responses separate per user in memory. It honors Cache-Control, Expires
+// and Vary of responses, revalidates stale responses with their ETag or
+// Last-Modified and removes the least recently used responses when full.
+type Cache struct {
+	name         string
+	maxSize      int64
+	maxEntrySize int64
+
+	mutex     sync.Mutex
+	size      int64
+	lru       *list.List
+	entries   map[string]*entry
+	resources map[string]map[*entry]struct{}
+}
+
+// New creates a new Cache identified by the provided name, which holds up to
+// maxSize bytes of responses. Responses larger than maxEntrySize are not
+// cached.
+func New(name string, maxSize int64, maxEntrySize int64) *Cache {
+	if maxEntrySize <= 0 || maxEntrySize > maxSize {
+		maxEntrySize = maxSize
+	}
+
+	return &Cache{
+		name:         name,
+		maxSize:      maxSize,
+		maxEntrySize: maxEntrySize,
+
+		lru:       list.New(),
+		entries:   make(map[string]*entry),
+		resources: make(map[string]map[*entry]struct{}),
+	}
+}
+
+// Handler returns a proxy.HTTPProxyHandler which serves requests from the
+// accociated cache and forwards them to the provided next handler otherwise.
+// All requests with other methods than GET and HEAD invalidate the cached
+// responses of their URL path for all users.
+//
+// NOTE: Invalidation is not limited to the key of the writing user on
+// purpose. Users can address the same resource with the same URL path, like
+// delegates and shared folders, so a write of one user must evict the copies
+// of all others. For paths which differ per user, this only costs others a
+// cache miss but never serves stale responses.
+func (c *Cache) Handler(next proxy.HTTPProxyHandler, keyFunc KeyFunc) proxy.HTTPProxyHandler {
+	return proxy.HTTPProxyHandlerFunc(func(rw http.ResponseWriter, req *http.Request) (int, error) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			c.invalidate(req.URL.Path)
+			return next.ServeHTTP(rw, req)
+		}
+
+		user := keyFunc(req)
+		requestCacheControl := parseCacheControl(req.Header)
+		if _, noStore := requestCacheControl["no-store"]; user == "" || noStore {
+			requestsCounter.WithLabelValues(c.name, resultBypass).Inc()
+			return next.ServeHTTP(rw, req)
+		}
+
+		key := user + "\x00" + req.URL.RequestURI()
+		now := time.Now()
+		e := c.get(key, req)
+		_, noCache := requestCacheControl["no-cache"]
+		if e != nil && !noCache && now.Before(e.expires) {
+			requestsCounter.WithLabelValues(c.name, resultHit).Inc()
+			e.serve(rw, req)
+			return 0, nil
+		}
+
+		outreq := req
+		revalidate := e != nil && (e.etag != "" || e.lastModified != "")
+		if revalidate {
+			outreq = req.Clone(req.Context())
+			outreq.Header.Del("If-None-Match")
+			outreq.Header.Del("If-Modified-Since")
+			if e.etag != "" {
+				outreq.Header.Set("If-None-Match", e.etag)
+			} else {
+				outreq.Header.Set("If-Modified-Since", e.lastModified)
+			}
+		}
+
+		buffer := newResponseBuffer(rw, c.maxEntrySize)
+		status, err := next.ServeHTTP(buffer, outreq)
+		if err != nil {
+			buffer.finish()
+			return status, err
+		}
+
+		if revalidate && buffer.status == http.StatusNotModified && !buffer.passthrough {
+			requestsCounter.WithLabelValues(c.name, resultRevalidated).Inc()
+			e = e.refreshed(buffer.header, now)
+			c.store(e)
+			e.serve(rw, req)
+			return 0, nil
+		}
+
+		requestsCounter.WithLabelValues(c.name, resultMiss).Inc()
+		if req.Method == http.MethodGet && buffer.status == http.StatusOK && !buffer.passthrough {
+			if expires, ok := expiration(buffer.header, now); ok {
+				c.store(newEntry(key, req, buffer.header, buffer.body.Bytes(), expires))
+			} else if e != nil {
+				c.remove(e)
+			}
+		} else if e != nil && req.Method == http.MethodGet {
+			c.remove(e)
+		}
+		buffer.finish()
+
+		return 0, nil
+	})
+}
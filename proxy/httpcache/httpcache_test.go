@@ -0,0 +1,252 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"stash.kopano.io/kc/kapi/proxy"
+)
+
+// testUpstream is a proxy.HTTPProxyHandler which counts its requests.
+type testUpstream struct {
+	requests int
+	handler  http.HandlerFunc
+}
+
+func (u *testUpstream) ServeHTTP(rw http.ResponseWriter, req *http.Request) (int, error) {
+	u.requests++
+	u.handler(rw, req)
+	return 0, nil
+}
+
+func userKey(req *http.Request) string {
+	return req.Header.Get("X-User")
+}
+
+func request(handler proxy.HTTPProxyHandler, method string, target string, user string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestCacheFresh(t *testing.T) {
+	upstream := &testUpstream{handler: func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "private, max-age=60")
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Write([]byte("me:" + req.Header.Get("X-User")))
+	}}
+	c := New("test", 1024*1024, 0)
+	handler := c.Handler(upstream, userKey)
+
+	for i := 0; i < 3; i++ {
+		if rw := request(handler, http.MethodGet, "/me", "user1", nil); rw.Body.String() != "me:user1" {
+			t.Errorf("unexpected response: %s", rw.Body.String())
+		}
+	}
+	if upstream.requests != 1 {
+		t.Errorf("unexpected upstream requests: %d", upstream.requests)
+	}
+
+	// Users do not share responses.
+	if rw := request(handler, http.MethodGet, "/me", "user2", nil); rw.Body.String() != "me:user2" {
+		t.Errorf("unexpected response for other user: %s", rw.Body.String())
+	}
+	if upstream.requests != 2 {
+		t.Errorf("unexpected upstream requests: %d", upstream.requests)
+	}
+
+	// Conditional requests are answered from the cache.
+	rw := request(handler, http.MethodGet, "/me", "user1", http.Header{"If-None-Match": {`"v1"`}})
+	if rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+		t.Errorf("unexpected response to conditional request: %d", rw.Code)
+	}
+	rw = request(handler, http.MethodGet, "/me", "user1", http.Header{"If-None-Match": {`"v0", W/"v1"`}})
+	if rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+		t.Errorf("unexpected response to conditional request with weak entity tag: %d", rw.Code)
+	}
+	rw = request(handler, http.MethodGet, "/me", "user1", http.Header{"If-None-Match": {`"v0"`}})
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected response to conditional request with other entity tag: %d", rw.Code)
+	}
+
+	// HEAD requests are served from GET responses.
+	rw = request(handler, http.MethodHead, "/me", "user1", nil)
+	if rw.Code != http.StatusOK || rw.Body.Len() != 0 || upstream.requests != 2 {
+		t.Errorf("unexpected response to HEAD request: %d", rw.Code)
+	}
+
+	// Requests without user are not cached.
+	request(handler, http.MethodGet, "/me", "", nil)
+	request(handler, http.MethodGet, "/me", "", nil)
+	if upstream.requests != 4 {
+		t.Errorf("unexpected upstream requests: %d", upstream.requests)
+	}
+
+	// Modifying requests invalidate the resource for all users.
+	request(handler, http.MethodPatch, "/me", "user1", nil)
+	request(handler, http.MethodGet, "/me", "user1", nil)
+	request(handler, http.MethodGet, "/me", "user2", nil)
+	if upstream.requests != 7 {
+		t.Errorf("unexpected upstream requests after invalidation: %d", upstream.requests)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	etag := `"v1"`
+	upstream := &testUpstream{handler: func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "no-cache")
+		rw.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Write([]byte("photo " + etag))
+	}}
+	c := New("test", 1024*1024, 0)
+	handler := c.Handler(upstream, userKey)
+
+	request(handler, http.MethodGet, "/users/1/photo", "user1", nil)
+	rw := request(handler, http.MethodGet, "/users/1/photo", "user1", nil)
+	if rw.Code != http.StatusOK || rw.Body.String() != `photo "v1"` {
+		t.Errorf("unexpected revalidated response: %d %s", rw.Code, rw.Body.String())
+	}
+	if upstream.requests != 2 {
+		t.Errorf("unexpected upstream requests: %d", upstream.requests)
+	}
+
+	etag = `"v2"`
+	rw = request(handler, http.MethodGet, "/users/1/photo", "user1", nil)
+	if rw.Body.String() != `photo "v2"` {
+		t.Errorf("unexpected response after change: %s", rw.Body.String())
+	}
+	rw = request(handler, http.MethodGet, "/users/1/photo", "user1", nil)
+	if rw.Body.String() != `photo "v2"` || upstream.requests != 4 {
+		t.Errorf("unexpected response after revalidation: %s", rw.Body.String())
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	for name, header := range map[string]http.Header{
+		"no-store":   {"Cache-Control": {"no-store"}},
+		"set-cookie": {"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}},
+		"vary":       {"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		"no-expiry":  {},
+	} {
+		header := header
+		upstream := &testUpstream{handler: func(rw http.ResponseWriter, req *http.Request) {
+			for name, values := range header {
+				rw.Header()[name] = values
+			}
+			rw.Write([]byte("hello"))
+		}}
+		c := New("test", 1024*1024, 0)
+		handler := c.Handler(upstream, userKey)
+		request(handler, http.MethodGet, "/me", "user1", nil)
+		request(handler, http.MethodGet, "/me", "user1", nil)
+		if upstream.requests != 2 || c.Len() != 0 {
+			t.Errorf("%s: response was cached", name)
+		}
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	upstream := &testUpstream{handler: func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("Vary", "Accept")
+		rw.Write([]byte(req.Header.Get("Accept")))
+	}}
+	c := New("test", 1024*1024, 0)
+	handler := c.Handler(upstream, userKey)
+
+	request(handler, http.MethodGet, "/me", "user1", http.Header{"Accept": {"application/json"}})
+	rw := request(handler, http.MethodGet, "/me", "user1", http.Header{"Accept": {"text/plain"}})
+	if rw.Body.String() != "text/plain" || upstream.requests != 2 {
+		t.Errorf("unexpected response for other Accept: %s", rw.Body.String())
+	}
+	rw = request(handler, http.MethodGet, "/me", "user1", http.Header{"Accept": {"text/plain"}})
+	if rw.Body.String() != "text/plain" || upstream.requests != 2 {
+		t.Errorf("unexpected response for same Accept: %s", rw.Body.String())
+	}
+}
+
+func TestCacheLimits(t *testing.T) {
+	upstream := &testUpstream{handler: func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		if req.URL.Path == "/large" {
+			rw.Write([]byte(strings.Repeat("x", 300)))
+			return
+		}
+		rw.Write([]byte(strings.Repeat("x", 100)))
+	}}
+	c := New("test", 500, 200)
+	handler := c.Handler(upstream, userKey)
+
+	rw := request(handler, http.MethodGet, "/large", "user1", nil)
+	if rw.Body.Len() != 300 || c.Len() != 0 {
+		t.Errorf("large response not passed through: %d bytes, %d entries", rw.Body.Len(), c.Len())
+	}
+
+	for _, path := range []string{"/1", "/2", "/3", "/4", "/5"} {
+		request(handler, http.MethodGet, path, "user1", nil)
+	}
+	if c.Size() > 500 || c.Len() != 3 {
+		t.Errorf("unexpected cache size: %d bytes, %d entries", c.Size(), c.Len())
+	}
+
+	// Least recently used is gone.
+	requests := upstream.requests
+	request(handler, http.MethodGet, "/5", "user1", nil)
+	request(handler, http.MethodGet, "/1", "user1", nil)
+	if upstream.requests != requests+1 {
+		t.Errorf("unexpected upstream requests: %d", upstream.requests-requests)
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	upstream := &testUpstream{handler: func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "private, max-age=60")
+		rw.Write([]byte("hello"))
+		rw.(http.Flusher).Flush()
+		if flushed := rw.(*responseBuffer).rw.(*httptest.ResponseRecorder); !flushed.Flushed || flushed.Body.String() != "hello" {
+			t.Errorf("response was not flushed")
+		}
+		rw.Write([]byte(" world"))
+	}}
+	c := New("test", 1024*1024, 0)
+	handler := c.Handler(upstream, userKey)
+
+	rw := request(handler, http.MethodGet, "/me", "user1", nil)
+	if rw.Body.String() != "hello world" || rw.Header().Get("Cache-Control") != "private, max-age=60" {
+		t.Errorf("unexpected response: %s", rw.Body.String())
+	}
+	if c.Len() != 0 {
+		t.Errorf("streamed response was cached")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpcache
+
+import (
+	"net/http"
+)
+
+// get returns the entry for the provided key if it matches the provided
+// request and marks it as recently used.
+func (c *Cache) get(key string, req *http.Request) *entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || !e.matches(req) {
+		return nil
+	}
+	c.lru.MoveToFront(e.element)
+
+	return e
+}
+
+// store adds the provided entry, replacing an existing entry with the same
+// key and removing the least recently used entries when full.
+func (c *Cache) store(e *entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if existing, ok := c.entries[e.key]; ok {
+		c.removeLocked(existing)
+	}
+	if e.size > c.maxEntrySize {
+		c.updateMetricsLocked()
+		return
+	}
+
+	e.element = c.lru.PushFront(e)
+	c.entries[e.key] = e
+	resource, ok := c.resources[e.resource]
+	if !ok {
+		resource = make(map[*entry]struct{})
+		c.resources[e.resource] = resource
+	}
+	resource[e] = struct{}{}
+	c.size += e.size
+
+	for c.size > c.maxSize {
+		c.removeLocked(c.lru.Back().Value.(*entry))
+	}
+	c.updateMetricsLocked()
+}
+
+// remove removes the provided entry if it is still cached.
+func (c *Cache) remove(e *entry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries[e.key] == e {
+		c.removeLocked(e)
+		c.updateMetricsLocked()
+	}
+}
+
+// invalidate removes all entries of the provided resource.
+func (c *Cache) invalidate(resource string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for e := range c.resources[resource] {
+		c.removeLocked(e)
+	}
+	c.updateMetricsLocked()
+}
+
+func (c *Cache) removeLocked(e *entry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.key)
+	if resource, ok := c.resources[e.resource]; ok {
+		delete(resource, e)
+		if len(resource) == 0 {
+			delete(c.resources, e.resource)
+		}
+	}
+	c.size -= e.size
+}
+
+func (c *Cache) updateMetricsLocked() {
+	sizeGauge.WithLabelValues(c.name).Set(float64(c.size))
+	entriesGauge.WithLabelValues(c.name).Set(float64(len(c.entries)))
+}
+
+// Len returns the number of cached responses.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return len(c.entries)
+}
+
+// Size returns the size of the cached responses in bytes.
+func (c *Cache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.size
+}
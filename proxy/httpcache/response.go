@@ -0,0 +1,116 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpcache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// responseBuffer is a http.ResponseWriter which keeps the response in memory,
+// so it can be stored and does not reach the client when it is a response to
+// a revalidation. Responses which get larger than the limit are passed through
+// to the underlying writer.
+type responseBuffer struct {
+	rw     http.ResponseWriter
+	limit  int64
+	header http.Header
+
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	passthrough bool
+}
+
+func newResponseBuffer(rw http.ResponseWriter, limit int64) *responseBuffer {
+	return &responseBuffer{
+		rw:     rw,
+		limit:  limit,
+		header: cloneHeader(rw.Header()),
+	}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.wroteHeader {
+		return
+	}
+	b.wroteHeader = true
+	b.status = status
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	if !b.passthrough && int64(b.body.Len()+len(p)) > b.limit {
+		b.startPassthrough()
+	}
+	if b.passthrough {
+		return b.rw.Write(p)
+	}
+
+	return b.body.Write(p)
+}
+
+// Flush implements the http.Flusher interface for streamed responses, which
+// are passed through and not cached.
+func (b *responseBuffer) Flush() {
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	if !b.passthrough {
+		b.startPassthrough()
+	}
+	if flusher, ok := b.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (b *responseBuffer) startPassthrough() {
+	b.passthrough = true
+	b.writeHeader()
+	b.rw.Write(b.body.Bytes())
+	b.body.Reset()
+}
+
+func (b *responseBuffer) writeHeader() {
+	header := b.rw.Header()
+	for name := range header {
+		if _, ok := b.header[name]; !ok {
+			delete(header, name)
+		}
+	}
+	for name, values := range b.header {
+		header[name] = values
+	}
+	b.rw.WriteHeader(b.status)
+}
+
+// finish writes the buffered response to the underlying writer.
+func (b *responseBuffer) finish() {
+	if b.passthrough || !b.wroteHeader {
+		return
+	}
+
+	b.writeHeader()
+	b.rw.Write(b.body.Bytes())
+}
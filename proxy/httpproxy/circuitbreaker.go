@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for circuit breaker configuration values.
+const (
+	defaultCircuitBreakerTimeout = 10 * time.Second
+)
+
+type circuitState int
+
+// Circuit states.
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks consecutive failures of an upstream. The circuit opens
+// when the threshold is reached and no requests are let through until the
+// timeout has passed. Then the circuit is half-open and lets a single trial
+// request through, which either closes the circuit or opens it again.
+type circuitBreaker struct {
+	// NOTE: openUntil is accessed atomically and must stay the first field.
+	openUntil int64
+
+	failures int32
+	probing  int32
+
+	threshold int32
+	timeout   time.Duration
+}
+
+func newCircuitBreaker(threshold uint, timeout time.Duration) circuitBreaker {
+	if timeout <= 0 {
+		timeout = defaultCircuitBreakerTimeout
+	}
+
+	return circuitBreaker{
+		threshold: int32(threshold),
+		timeout:   timeout,
+	}
+}
+
+// state returns the circuit state at the provided time.
+func (b *circuitBreaker) state(now time.Time) circuitState {
+	if b.threshold == 0 || atomic.LoadInt32(&b.failures) < b.threshold {
+		return circuitClosed
+	}
+	if now.UnixNano() < atomic.LoadInt64(&b.openUntil) {
+		return circuitOpen
+	}
+
+	return circuitHalfOpen
+}
+
+// allow returns true if the circuit lets requests through.
+func (b *circuitBreaker) allow() bool {
+	switch b.state(time.Now()) {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		return atomic.LoadInt32(&b.probing) == 0
+	}
+
+	return true
+}
+
+// acquire returns true if the circuit lets the request through. Of a
+// half-open circuit, only a single caller gets through as trial request,
+// which is reported with trial set to true. The trial request must end with
+// release, success or failure.
+func (b *circuitBreaker) acquire() (ok bool, trial bool) {
+	switch b.state(time.Now()) {
+	case circuitOpen:
+		return false, false
+	case circuitHalfOpen:
+		if atomic.CompareAndSwapInt32(&b.probing, 0, 1) {
+			return true, true
+		}
+		return false, false
+	}
+
+	return true, false
+}
+
+// release ends a request without result, like when the client went away.
+func (b *circuitBreaker) release(trial bool) {
+	if trial {
+		atomic.StoreInt32(&b.probing, 0)
+	}
+}
+
+// success records a successful request and closes the circuit.
+func (b *circuitBreaker) success(trial bool) {
+	atomic.StoreInt32(&b.failures, 0)
+	if trial {
+		atomic.StoreInt32(&b.probing, 0)
+	}
+}
+
+// failure records a failed request and opens the circuit when the threshold
+// is reached.
+func (b *circuitBreaker) failure(trial bool) {
+	if b.threshold == 0 {
+		return
+	}
+	if atomic.AddInt32(&b.failures, 1) >= b.threshold {
+		atomic.StoreInt64(&b.openUntil, time.Now().Add(b.timeout).UnixNano())
+	}
+	if trial {
+		atomic.StoreInt32(&b.probing, 0)
+	}
+}
+
+// retryAfter returns how long the circuit stays open from the provided time.
+func (b *circuitBreaker) retryAfter(now time.Time) time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.openUntil) - now.UnixNano())
+}
+
+// circuitsOpen returns true if the circuits of all upstreams of the provided
+// pool are open or wait for their trial request, together with the time until
+// the first one becomes half-open.
+func circuitsOpen(pool []*Upstream) (time.Duration, bool) {
+	if len(pool) == 0 {
+		return 0, false
+	}
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for i, upstream := range pool {
+		if upstream.breaker.allow() {
+			return 0, false
+		}
+		d := upstream.breaker.retryAfter(now)
+		if d <= 0 {
+			// Half-open with the trial request in flight.
+			d = time.Second
+		}
+		if i == 0 || d < retryAfter {
+			retryAfter = d
+		}
+	}
+
+	return retryAfter, true
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for health check configuration values.
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 1
+	defaultUnhealthyThreshold  = 1
+)
+
+var (
+	upstreamHealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "upstream_healthy",
+		Help:      "Health check state of proxy upstreams, 1 when healthy",
+	}, []string{"proxy", "upstream"})
+	upstreamHealthChecksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "upstream_health_checks_total",
+		Help:      "Total number of proxy upstream health checks by result",
+	}, []string{"proxy", "upstream", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(upstreamHealthyGauge, upstreamHealthChecksCounter)
+}
+
+// Status describes the upstreams of a proxy.
+type Status struct {
+	Upstreams int `json:"upstreams"`
+	Healthy   int `json:"healthy"`
+}
+
+// Status returns the Status of the accociated proxy.
+func (p *Proxy) Status() *Status {
+	upstreams := p.Upstreams()
+	status := &Status{
+		Upstreams: len(upstreams),
+	}
+	for _, upstream := range upstreams {
+		if upstream.Healthy() {
+			status.Healthy++
+		}
+	}
+
+	return status
+}
+
+// healthCheck checks the health of all upstreams in the configured interval
+// until the accociated proxy is closed.
+func (p *Proxy) healthCheck() {
+	defer close(p.done)
+
+	interval := p.configuration.HealthCheckInterval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.quit
+		cancel()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, upstream := range p.Upstreams() {
+			wg.Add(1)
+			go func(upstream *Upstream) {
+				defer wg.Done()
+				p.checkUpstream(ctx, upstream)
+			}(upstream)
+		}
+		wg.Wait()
+
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Proxy) checkUpstream(ctx context.Context, upstream *Upstream) {
+	timeout := p.configuration.HealthCheckTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := upstream.checkHealth(ctx, p.configuration.HealthCheckPath)
+	if ctx.Err() != nil && p.closed() {
+		return
+	}
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	upstreamHealthChecksCounter.WithLabelValues(p.name, upstream.Name, result).Inc()
+
+	healthyThreshold := p.configuration.HealthyThreshold
+	if healthyThreshold == 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+	unhealthyThreshold := p.configuration.UnhealthyThreshold
+	if unhealthyThreshold == 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	upstream.reportHealth(err == nil, healthyThreshold, unhealthyThreshold)
+
+	healthy := 0.0
+	if upstream.Healthy() {
+		healthy = 1
+	}
+	upstreamHealthyGauge.WithLabelValues(p.name, upstream.Name).Set(healthy)
+}
+
+func (p *Proxy) closed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Proxy) removeUpstreamMetrics(upstream *Upstream) {
+	if p.configuration.HealthCheckPath == "" {
+		return
+	}
+
+	upstreamHealthyGauge.DeleteLabelValues(p.name, upstream.Name)
+	upstreamHealthChecksCounter.DeleteLabelValues(p.name, upstream.Name, "success")
+	upstreamHealthChecksCounter.DeleteLabelValues(p.name, upstream.Name, "failure")
+}
+
+// Healthy returns false if active health checks found the accociated upstream
+// to be unhealthy.
+func (u *Upstream) Healthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+// reportHealth records a health check result. Results of an upstream must be
+// reported sequentially.
+func (u *Upstream) reportHealth(success bool, healthyThreshold, unhealthyThreshold uint) {
+	if success {
+		u.healthFailures = 0
+		u.healthSuccesses++
+		if u.healthSuccesses >= healthyThreshold {
+			atomic.StoreInt32(&u.unhealthy, 0)
+		}
+	} else {
+		u.healthSuccesses = 0
+		u.healthFailures++
+		if u.healthFailures >= unhealthyThreshold {
+			atomic.StoreInt32(&u.unhealthy, 1)
+		}
+	}
+}
+
+// checkHealth requests the provided path from the accociated upstream.
+func (u *Upstream) checkHealth(ctx context.Context, path string) error {
+	target := &url.URL{
+		Scheme: u.target.Scheme,
+		Host:   u.target.Host,
+		Path:   strings.TrimSuffix(u.target.Path, "/") + "/" + strings.TrimPrefix(path, "/"),
+	}
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := u.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 4096))
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 400 {
+		return fmt.Errorf("health check failed with status: %d", response.StatusCode)
+	}
+
+	return nil
+}
@@ -18,49 +18,131 @@
 package httpproxy
 
 import (
-	"bytes"
-	"text/template"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/caddyserver/caddy/caddyfile"
-	caddyproxy "github.com/caddyserver/caddy/caddyhttp/proxy"
+	"stash.kopano.io/kgol/rndm"
 
 	"stash.kopano.io/kc/kapi/proxy"
 )
 
-var configurationTemplate = template.Must(template.New("Caddyfile").Parse(`
-	proxy / {
-		transparent
-
-		policy {{.C.Policy}}
-		fail_timeout {{.C.FailTimeout}}
-		max_fails {{.C.MaxFails}}
-		max_conns {{.C.MaxConns}}
-		keepalive {{.C.Keepalive}}
-		try_duration {{.C.TryDuration}}
-		try_interval {{.C.TryInterval}}
-
-		{{range .UpstreamURIs}}
-		upstream unix://{{.}}
-		{{end}}
-
-		{{range .C.Extra}}
-		{{.}}
-		{{end}}
-	}
-`))
+var (
+	errNoUpstreamAvailable = errors.New("no upstream available")
+	errCircuitOpen         = errors.New("circuits of all upstreams are open")
+	errResponseTooLarge    = errors.New("upstream response too large")
+	errRequestTooLarge     = errors.New("request body too large")
+)
 
 // Configuration defines configuration settings for a proxy.
 type Configuration struct {
-	Policy      string
+	// Policy selects the upstream for a request, see newPolicy for the
+	// supported values.
+	Policy string
+	// FailTimeout is how long a failed request counts against its upstream.
+	// Failures are not tracked if it is 0.
 	FailTimeout time.Duration
-	MaxFails    uint
-	MaxConns    uint
-	Keepalive   uint
+	// MaxFails is the number of counted failures after which an upstream is
+	// considered down. 0 disables the limit.
+	MaxFails uint
+	// MaxConns is the maximum number of concurrent requests per upstream.
+	// 0 disables the limit.
+	MaxConns uint
+	// Keepalive is the maximum number of idle connections kept open per
+	// upstream. 0 disables keep alive.
+	Keepalive uint
+	// TryDuration is how long to try selecting an upstream and retrying failed
+	// requests. 0 disables retries. Only requests with idempotent method are
+	// retried after they reached an upstream.
 	TryDuration time.Duration
+	// TryInterval is the time to wait between tries.
 	TryInterval time.Duration
-	Sticky      string
-	Extra       []string
+	// RetryBudget is the maximum ratio of retries to requests of the proxy.
+	// 0 disables the budget.
+	RetryBudget float64
+	// RetryBudgetMinPerSecond is the number of retries per second which are
+	// allowed regardless of the RetryBudget ratio.
+	RetryBudgetMinPerSecond uint
+	// Timeout is the maximum duration of a request including all tries.
+	// 0 means no timeout.
+	Timeout time.Duration
+	// ResponseHeaderTimeout is the maximum time to wait for the response
+	// headers of an upstream. 0 means no timeout. It can be overridden per
+	// request with WithResponseHeaderTimeout.
+	ResponseHeaderTimeout time.Duration
+	// IdleTimeout is the maximum time without data while streaming the
+	// response body of an upstream. 0 means no timeout.
+	IdleTimeout time.Duration
+	// MaxResponseSize is the maximum size of upstream response bodies in
+	// bytes. Larger responses fail with status 507 if their Content-Length
+	// is too large and are cut off otherwise. They do not count as failures
+	// of the upstream and are not retried. 0 means no limit. It can be
+	// overridden per request with WithMaxResponseSize.
+	MaxResponseSize int64
+	// MaxRequestSize is the maximum size of request bodies in bytes. Larger
+	// requests fail with status 413, early if their Content-Length is too
+	// large and while streaming otherwise. 0 means no limit. It can be
+	// overridden per request with WithMaxRequestSize.
+	MaxRequestSize int64
+	// FlushInterval is how often response data is flushed to the client
+	// while streaming. 0 means no periodic flushes and a negative value
+	// flushes after every write.
+	FlushInterval time.Duration
+	// PingInterval is the time without data from the upstream after which a
+	// ping is sent to the client of a WebSocket connection or server-sent
+	// event stream. 0 disables pings. Streams are not subject to
+	// MaxResponseSize and IdleTimeout.
+	PingInterval time.Duration
+
+	// TLSCAFile is the path to a PEM file with the CA certificates which are
+	// used to verify https upstreams instead of the system roots.
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are the paths to the PEM files of the client
+	// certificate and its key which are presented to https upstreams.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSServerName overrides the server name which is used to verify https
+	// upstreams.
+	TLSServerName string
+	// TLSInsecureSkipVerify disables verification of https upstreams.
+	TLSInsecureSkipVerify bool
+
+	// Sticky is the sticky rule, see newStickyProxyHandler for the supported
+	// values.
+	Sticky string
+	// StickySecret is the key used to sign sticky cookies which pin
+	// upstreams. A random key is used if empty, so pins do not survive
+	// restarts.
+	StickySecret []byte
+
+	// HealthCheckPath enables active health checks of all upstreams with GET
+	// requests to this path when set. Responses with 2xx or 3xx status are
+	// healthy, unhealthy upstreams get no requests.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	// HealthyThreshold is the number of consecutive successful health checks
+	// after which an unhealthy upstream becomes healthy again.
+	HealthyThreshold uint
+	// UnhealthyThreshold is the number of consecutive failed health checks
+	// after which an upstream becomes unhealthy.
+	UnhealthyThreshold uint
+
+	// CircuitBreakerThreshold is the number of consecutive failed requests
+	// after which the circuit of an upstream opens and it gets no requests.
+	// 0 disables the circuit breaker.
+	CircuitBreakerThreshold uint
+	// CircuitBreakerTimeout is how long an open circuit stays open before a
+	// single trial request is let through.
+	CircuitBreakerTimeout time.Duration
 }
 
 // DefaultConfiguration is the proxy configuration which is used by default.
@@ -74,9 +156,23 @@ var DefaultConfiguration = &Configuration{
 	TryInterval: time.Duration(250) * time.Millisecond,
 }
 
-type configurationWithUpstreams struct {
-	UpstreamURIs []string
-	C            *Configuration
+// Proxy is a reverse proxy which forwards requests to a pool of upstreams.
+type Proxy struct {
+	name          string
+	configuration *Configuration
+
+	policy      Policy
+	retryBudget *retryBudget
+	tlsConfig   *tls.Config
+
+	mutex     sync.RWMutex
+	upstreams []*Upstream
+
+	handler proxy.HTTPProxyHandler
+	streams *streams
+
+	quit chan struct{}
+	done chan struct{}
 }
 
 func makeProxyHandler(configuration *Configuration, next proxy.HTTPProxyHandler) (proxy.HTTPProxyHandler, error) {
@@ -88,35 +184,337 @@ func makeProxyHandler(configuration *Configuration, next proxy.HTTPProxyHandler)
 	if err != nil {
 		return nil, err
 	}
+	handler.secret = configuration.StickySecret
+	if handler.PinCookie && len(handler.secret) == 0 {
+		handler.secret = rndm.GenerateRandomBytes(32)
+	}
 
 	return handler.Handler(next), nil
 }
 
 // New creates a new proxy identified by the provided name to the provided
-// upstreamURIs..
-func New(name string, upstreamURIs []string, configuration *Configuration) (proxy.HTTPProxyHandler, error) {
+// upstreamURIs. Upstream URIs are either unix socket paths or URIs with scheme
+// like http://127.0.0.1:8080, https://grapi.example.com or
+// unix:///run/service.sock, which can be mixed in the same pool.
+func New(name string, upstreamURIs []string, configuration *Configuration) (*Proxy, error) {
 	if configuration == nil {
 		configuration = DefaultConfiguration
 	}
+	if len(upstreamURIs) == 0 {
+		return nil, errors.New("no upstreams")
+	}
 
-	var buf bytes.Buffer
-	err := configurationTemplate.Execute(&buf, &configurationWithUpstreams{
-		UpstreamURIs: upstreamURIs,
-		C:            configuration,
-	})
+	policy, err := newPolicy(configuration.Policy)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSClientConfig(configuration)
 	if err != nil {
 		return nil, err
 	}
 
-	// Setup proxy stuff, by creating a caddy file.
-	dispenser := caddyfile.NewDispenser(name, &buf)
-	upstreams, err := caddyproxy.NewStaticUpstreams(dispenser, "")
+	p := &Proxy{
+		name:          name,
+		configuration: configuration,
+
+		policy:      policy,
+		retryBudget: newRetryBudget(configuration.RetryBudget, configuration.RetryBudgetMinPerSecond),
+		tlsConfig:   tlsConfig,
+		streams:     newStreams(name, configuration),
+
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if err = p.SetUpstreams(upstreamURIs); err != nil {
+		return nil, err
+	}
+
+	p.handler, err = makeProxyHandler(configuration, proxy.HTTPProxyHandlerFunc(p.serveHTTP))
 	if err != nil {
 		return nil, err
 	}
 
-	return makeProxyHandler(configuration, &caddyproxy.Proxy{
-		Next:      nil,
-		Upstreams: upstreams,
-	})
+	if configuration.HealthCheckPath != "" {
+		go p.healthCheck()
+	} else {
+		close(p.done)
+	}
+
+	return p, nil
+}
+
+// Drain ends the streams of the accociated proxy cleanly. Server-sent event
+// streams end after their current event and WebSocket connections are closed
+// with status going away after their current frame. Requests to switch
+// protocols are rejected afterwards.
+func (p *Proxy) Drain() {
+	p.streams.startDrain()
+}
+
+// Close stops the active health checks of the accociated proxy and drains
+// its streams.
+func (p *Proxy) Close() error {
+	p.Drain()
+
+	select {
+	case <-p.quit:
+	default:
+		close(p.quit)
+	}
+	<-p.done
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, upstream := range p.upstreams {
+		p.removeUpstreamMetrics(upstream)
+	}
+
+	return nil
+}
+
+// Upstreams returns the upstreams of the accociated proxy.
+func (p *Proxy) Upstreams() []*Upstream {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.upstreams
+}
+
+// SetUpstreams replaces the upstreams of the accociated proxy with upstreams
+// for the provided upstreamURIs. Upstreams which already exist are kept with
+// their state. Requests in flight to removed upstreams are not interrupted.
+func (p *Proxy) SetUpstreams(upstreamURIs []string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	existing := make(map[string]*Upstream, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		existing[upstream.Name] = upstream
+	}
+
+	upstreams := make([]*Upstream, 0, len(upstreamURIs))
+	for _, uri := range upstreamURIs {
+		if upstream, ok := existing[uri]; ok {
+			upstreams = append(upstreams, upstream)
+			delete(existing, uri)
+			continue
+		}
+		upstream, err := newUpstream(uri, p.configuration, p.tlsConfig, p.streams)
+		if err != nil {
+			return err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	p.upstreams = upstreams
+
+	// Removed upstreams get no new requests, release their idle connections.
+	for _, upstream := range existing {
+		upstream.closeIdleConnections()
+		p.removeUpstreamMetrics(upstream)
+	}
+
+	return nil
+}
+
+// ServeHTTP implements the proxy.HTTPProxyHandler interface.
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) (int, error) {
+	return p.handler.ServeHTTP(rw, req)
+}
+
+func (p *Proxy) serveHTTP(rw http.ResponseWriter, req *http.Request) (int, error) {
+	maxRequestSize := p.configuration.MaxRequestSize
+	if limit, ok := req.Context().Value(maxRequestSizeContextKey).(int64); ok {
+		maxRequestSize = limit
+	}
+	if maxRequestSize > 0 && req.ContentLength > maxRequestSize {
+		return http.StatusRequestEntityTooLarge, errRequestTooLarge
+	}
+	if isUpgrade(req) && p.streams.draining() {
+		return http.StatusServiceUnavailable, errDraining
+	}
+
+	var body *requestBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &requestBody{
+			ReadCloser: req.Body,
+			limit:      maxRequestSize,
+		}
+		req.Body = body
+	}
+	p.retryBudget.request()
+
+	if p.configuration.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), p.configuration.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	var err error
+	start := time.Now()
+	for {
+		var failed bool
+		pool := p.Upstreams()
+		upstream := selectPinned(pool, req)
+		if upstream == nil {
+			upstream = p.policy.Select(pool, req)
+		}
+		var trial bool
+		if upstream != nil {
+			var ok bool
+			if ok, trial = upstream.breaker.acquire(); !ok {
+				// Another request won the trial of the half-open circuit.
+				upstream = nil
+			}
+		}
+		if upstream == nil {
+			if retryAfter, open := circuitsOpen(pool); open {
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				return http.StatusServiceUnavailable, errCircuitOpen
+			}
+			err = errNoUpstreamAvailable
+		} else {
+			pinUpstream(rw, req, upstream)
+			err = upstream.serve(rw, req, trial)
+			if err == nil {
+				return 0, nil
+			}
+			if body != nil && body.tooLarge() {
+				// Client error, this tells nothing about the upstream.
+				return http.StatusRequestEntityTooLarge, errRequestTooLarge
+			}
+			if errors.Is(err, errResponseTooLarge) {
+				// Other upstreams return the same response, so this is
+				// neither a failure of the upstream nor worth a retry.
+				return http.StatusInsufficientStorage, errResponseTooLarge
+			}
+			upstream.fail(p.configuration.FailTimeout)
+			if body != nil && body.consumed() {
+				// Retry is not possible, since the request body is gone.
+				break
+			}
+			if !isIdempotent(req) && !isDialError(err) {
+				// Retry is not safe, since the upstream might have
+				// processed the request.
+				break
+			}
+			failed = true
+		}
+
+		if time.Since(start) >= p.configuration.TryDuration {
+			break
+		}
+		if failed && !p.retryBudget.withdraw() {
+			break
+		}
+		select {
+		case <-req.Context().Done():
+			return statusFromError(req.Context().Err()), req.Context().Err()
+		case <-time.After(p.configuration.TryInterval):
+			// retry.
+		}
+	}
+
+	return statusFromError(err), err
+}
+
+// isIdempotent returns true if the provided request can be sent more than
+// once, following the rules of net/http.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	if _, ok := req.Header["X-Idempotency-Key"]; ok {
+		return true
+	}
+
+	return false
+}
+
+// isDialError returns true if the provided error happened while connecting,
+// which means the request was not sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// statusFromError returns the HTTP status code for the provided proxy error.
+func statusFromError(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// requestBody wraps a request body to track if it was read, since requests
+// can only be retried as long as their body was not consumed. Closing is left
+// to the server, so the body survives failed tries. Reading fails when the
+// body gets larger than a limit.
+type requestBody struct {
+	io.ReadCloser
+	read     int32
+	exceeded int32
+
+	limit int64
+	n     int64
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	if b.limit > 0 {
+		if remaining := b.limit - b.n; int64(len(p)) > remaining+1 {
+			p = p[:remaining+1]
+		}
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 || err != nil {
+		atomic.StoreInt32(&b.read, 1)
+	}
+	if b.limit > 0 {
+		b.n += int64(n)
+		if b.n > b.limit {
+			atomic.StoreInt32(&b.exceeded, 1)
+			return n - int(b.n-b.limit), errRequestTooLarge
+		}
+	}
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	return nil
+}
+
+func (b *requestBody) consumed() bool {
+	return atomic.LoadInt32(&b.read) == 1
+}
+
+func (b *requestBody) tooLarge() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// WithMaxRequestSize returns a shallow copy of the provided request, whose
+// body is limited to the provided size in bytes instead of the
+// MaxRequestSize of the proxy configuration. 0 means no limit.
+func WithMaxRequestSize(req *http.Request, limit int64) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), maxRequestSizeContextKey, limit))
+}
+
+// WithMaxResponseSize returns a shallow copy of the provided request, whose
+// upstream response body is limited to the provided size in bytes instead of
+// the MaxResponseSize of the proxy configuration. 0 means no limit.
+func WithMaxResponseSize(req *http.Request, limit int64) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), maxResponseSizeContextKey, limit))
+}
+
+// WithResponseHeaderTimeout returns a shallow copy of the provided request,
+// which waits for the response headers of the upstream for the provided
+// duration instead of the ResponseHeaderTimeout of the proxy configuration. 0
+// means no timeout.
+func WithResponseHeaderTimeout(req *http.Request, timeout time.Duration) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), responseHeaderTimeoutContextKey, timeout))
 }
@@ -0,0 +1,1389 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testUpstream is a HTTP server listening on a unix socket.
+type testUpstream struct {
+	name       string
+	socketPath string
+	server     *http.Server
+}
+
+func newTestUpstream(t *testing.T, dir string, name string, handler http.HandlerFunc) *testUpstream {
+	socketPath := filepath.Join(dir, name+".sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &testUpstream{
+		name:       name,
+		socketPath: socketPath,
+	}
+	u.server = &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-Upstream", name)
+			if handler != nil {
+				handler(rw, req)
+			}
+		}),
+	}
+	go u.server.Serve(listener)
+
+	return u
+}
+
+func (u *testUpstream) Close() {
+	u.server.Close()
+}
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kapi-httpproxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func request(t *testing.T, p *Proxy, req *http.Request) (*httptest.ResponseRecorder, int, error) {
+	rw := httptest.NewRecorder()
+	status, err := p.ServeHTTP(rw, req)
+
+	return rw, status, err
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(rw, "%s %s %s %s %s %s", req.Method, req.URL.RequestURI(), req.Host, req.Header.Get("X-Real-IP"), req.Header.Get("X-Forwarded-For"), body)
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://kapi.local/api/test?a=b", strings.NewReader("hello"))
+	req.RemoteAddr = "192.0.2.1:1234"
+	rw, status, err := request(t, p, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v (%d)", err, status)
+	}
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rw.Code)
+	}
+	if body := rw.Body.String(); body != "POST /api/test?a=b kapi.local 192.0.2.1 192.0.2.1 hello" {
+		t.Errorf("unexpected response: %s", body)
+	}
+	if rw.Header().Get("X-Upstream") != "rest0" {
+		t.Errorf("unexpected upstream: %s", rw.Header().Get("X-Upstream"))
+	}
+}
+
+func TestProxyUpstreamURIs(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "rest0", nil)
+	defer upstream.Close()
+
+	for _, uri := range []string{upstream.socketPath, "unix://" + upstream.socketPath} {
+		p, err := New("test", []string{uri}, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", uri, err)
+		}
+		rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil || rw.Code != http.StatusOK {
+			t.Errorf("%s: request failed: %v", uri, err)
+		}
+	}
+
+	for _, uri := range []string{"ftp://127.0.0.1", "http://", "unix://"} {
+		if _, err := New("test", []string{uri}, nil); err == nil {
+			t.Errorf("%s: expected error", uri)
+		}
+	}
+}
+
+// newTestCertificate creates a self signed certificate and writes it and its
+// key as PEM files into the provided directory.
+func newTestCertificate(t *testing.T, dir string, name string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	return certificate, certFile, keyFile
+}
+
+func TestProxyMixedUpstreams(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	unixUpstream := newTestUpstream(t, dir, "rest0", nil)
+	defer unixUpstream.Close()
+
+	httpUpstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Upstream", "http")
+	}))
+	defer httpUpstream.Close()
+
+	clientCertificate, certFile, keyFile := newTestCertificate(t, dir, "client")
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate)
+	httpsUpstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(req.TLS.PeerCertificates) == 0 || req.TLS.PeerCertificates[0].Subject.CommonName != "client" {
+			rw.WriteHeader(http.StatusForbidden)
+		}
+		rw.Header().Set("X-Upstream", "https")
+	}))
+	httpsUpstream.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	httpsUpstream.StartTLS()
+	defer httpsUpstream.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: httpsUpstream.Certificate().Raw}), 0600)
+
+	configuration := &Configuration{
+		Policy:        "round_robin",
+		Keepalive:     8,
+		TLSCAFile:     caFile,
+		TLSCertFile:   certFile,
+		TLSKeyFile:    keyFile,
+		TLSServerName: "example.com",
+	}
+	p, err := New("test", []string{"unix://" + unixUpstream.socketPath, httpUpstream.URL, httpsUpstream.URL}, configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil || rw.Code != http.StatusOK {
+			t.Fatalf("request failed: %v (%d)", err, rw.Code)
+		}
+		seen[rw.Header().Get("X-Upstream")] = true
+	}
+	for _, name := range []string{"rest0", "http", "https"} {
+		if !seen[name] {
+			t.Errorf("no request to %s upstream", name)
+		}
+	}
+
+	// Without client certificate the https upstream rejects the connection.
+	configuration.TLSCertFile = ""
+	configuration.TLSKeyFile = ""
+	if _, err = New("test", []string{httpsUpstream.URL}, &Configuration{TLSCertFile: certFile}); err == nil {
+		t.Error("expected error for client certificate without key")
+	}
+	p, err = New("test", []string{httpsUpstream.URL}, configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = request(t, p, httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Error("expected error without client certificate")
+	}
+}
+
+func TestProxyNoUpstreamAvailable(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	p, err := New("test", []string{filepath.Join(dir, "missing.sock")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if status != http.StatusBadGateway {
+		t.Errorf("unexpected status: %d", status)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "rest1", func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write(body)
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{filepath.Join(dir, "rest0.sock"), upstream.socketPath}, &Configuration{
+		Policy:      "first",
+		FailTimeout: 1 * time.Second,
+		MaxFails:    1,
+		Keepalive:   8,
+		TryDuration: 1 * time.Second,
+		TryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw, status, err := request(t, p, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v (%d)", err, status)
+	}
+	if rw.Header().Get("X-Upstream") != "rest1" || rw.Body.String() != "hello" {
+		t.Errorf("unexpected response from %s: %s", rw.Header().Get("X-Upstream"), rw.Body.String())
+	}
+
+	if fails := p.Upstreams()[0].Fails(); fails != 1 {
+		t.Errorf("unexpected fails of failed upstream: %d", fails)
+	}
+	if p.Upstreams()[0].Available() {
+		t.Error("failed upstream is still available")
+	}
+}
+
+func TestProxyNoRetryAfterBodyRead(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	body := &requestBody{ReadCloser: ioutil.NopCloser(strings.NewReader("hello"))}
+	if body.consumed() {
+		t.Fatal("body consumed before read")
+	}
+	buf := make([]byte, 1)
+	body.Read(buf)
+	if !body.consumed() {
+		t.Fatal("body not consumed after read")
+	}
+
+	// Upstream which closes the connection after reading the request body.
+	listener, err := net.Listen("unix", filepath.Join(dir, "rest0.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			ioutil.ReadAll(conn)
+			conn.Close()
+		}
+	}()
+
+	tries := 0
+	p, err := New("test", []string{filepath.Join(dir, "rest0.sock")}, &Configuration{
+		Policy:      "first",
+		Keepalive:   0,
+		TryDuration: 500 * time.Millisecond,
+		TryInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.policy = policyFunc(func(pool []*Upstream, req *http.Request) *Upstream {
+		tries++
+		return pool[0]
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+	req.ContentLength = -1
+	req.Header.Set("Connection", "close")
+	_, _, err = request(t, p, req)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if tries != 1 {
+		t.Errorf("unexpected number of tries: %d", tries)
+	}
+}
+
+type policyFunc func(pool []*Upstream, req *http.Request) *Upstream
+
+func (f policyFunc) Select(pool []*Upstream, req *http.Request) *Upstream {
+	return f(pool, req)
+}
+
+func TestProxyMaxConns(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{
+		Policy:    "random",
+		MaxConns:  1,
+		Keepalive: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, requestErr := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- requestErr
+	}()
+	<-started
+
+	if _, _, err = request(t, p, httptest.NewRequest(http.MethodGet, "/", nil)); err != errNoUpstreamAvailable {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	close(release)
+	if err = <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var socketPaths []string
+	for i := 0; i < 4; i++ {
+		upstream := newTestUpstream(t, dir, fmt.Sprintf("rest%d", i), nil)
+		defer upstream.Close()
+		socketPaths = append(socketPaths, upstream.socketPath)
+	}
+
+	selected := func(p *Proxy, req *http.Request) string {
+		rw, _, err := request(t, p, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rw.Header().Get("X-Upstream")
+	}
+
+	t.Run("first", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "first", Keepalive: 8})
+		for i := 0; i < 5; i++ {
+			if name := selected(p, httptest.NewRequest(http.MethodGet, "/", nil)); name != "rest0" {
+				t.Errorf("unexpected upstream: %s", name)
+			}
+		}
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "round_robin", Keepalive: 8})
+		for i := 0; i < 8; i++ {
+			if name := selected(p, httptest.NewRequest(http.MethodGet, "/", nil)); name != fmt.Sprintf("rest%d", i%4) {
+				t.Errorf("unexpected upstream: %s", name)
+			}
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "random", Keepalive: 8})
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			seen[selected(p, httptest.NewRequest(http.MethodGet, "/", nil))] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("random policy used only %d upstreams", len(seen))
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "header X-Kopano-UserEntryID", Keepalive: 8})
+		for _, user := range []string{"user1", "user2", "user3"} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Kopano-UserEntryID", user)
+			first := selected(p, req)
+			for i := 0; i < 5; i++ {
+				if name := selected(p, req); name != first {
+					t.Errorf("%s: upstream changed from %s to %s", user, first, name)
+				}
+			}
+		}
+	})
+
+	t.Run("ip_hash", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "ip_hash", Keepalive: 8})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		first := selected(p, req)
+		req.RemoteAddr = "192.0.2.1:5678"
+		if name := selected(p, req); name != first {
+			t.Errorf("upstream changed from %s to %s", first, name)
+		}
+	})
+
+	t.Run("least_conn", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "least_conn", Keepalive: 8})
+		for _, u := range p.Upstreams()[1:] {
+			u.conns = 1
+		}
+		if name := selected(p, httptest.NewRequest(http.MethodGet, "/", nil)); name != "rest0" {
+			t.Errorf("unexpected upstream: %s", name)
+		}
+	})
+
+	t.Run("consistent_header", func(t *testing.T) {
+		p, _ := New("test", socketPaths, &Configuration{Policy: "consistent_header X-Kopano-UserEntryID", Keepalive: 8})
+		for _, user := range []string{"user1", "user2", "user3"} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Kopano-UserEntryID", user)
+			first := selected(p, req)
+			for i := 0; i < 5; i++ {
+				if name := selected(p, req); name != first {
+					t.Errorf("%s: upstream changed from %s to %s", user, first, name)
+				}
+			}
+		}
+	})
+
+	for _, rule := range []string{"header", "unknown", "header a b", "consistent_header"} {
+		if _, err := newPolicy(rule); err == nil {
+			t.Errorf("%s: expected error", rule)
+		}
+	}
+}
+
+func TestSticky(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "rest0", nil)
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{
+		Policy:    "random",
+		Keepalive: 8,
+		Sticky:    "nocache",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rw.Header().Get("Cache-Control") != "nocache" {
+		t.Errorf("unexpected Cache-Control: %s", rw.Header().Get("Cache-Control"))
+	}
+}
+
+func TestStickyPin(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var socketPaths []string
+	for i := 0; i < 2; i++ {
+		upstream := newTestUpstream(t, dir, fmt.Sprintf("rest%d", i), nil)
+		defer upstream.Close()
+		socketPaths = append(socketPaths, upstream.socketPath)
+	}
+
+	p, err := New("test", socketPaths, &Configuration{
+		Policy:       "round_robin",
+		Keepalive:    8,
+		Sticky:       "pin-cookie kapi_sticky cookie-secure cookie-samesite lax cookie-max-age 3600 cookie-domain example.com",
+		StickySecret: []byte("secret"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rw, _, err := request(t, p, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var setCookie *http.Cookie
+		for _, c := range rw.Result().Cookies() {
+			if c.Name == "kapi_sticky" {
+				setCookie = c
+			}
+		}
+		return rw.Header().Get("X-Upstream"), setCookie
+	}
+
+	first, cookie := pinned(nil)
+	if cookie == nil {
+		t.Fatal("no sticky cookie set")
+	}
+	if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.MaxAge != 3600 || cookie.Domain != "example.com" {
+		t.Errorf("unexpected cookie attributes: %s", cookie)
+	}
+	for i := 0; i < 4; i++ {
+		name, setCookie := pinned(cookie)
+		if name != first {
+			t.Errorf("pinned upstream changed from %s to %s", first, name)
+		}
+		if setCookie != nil {
+			t.Error("sticky cookie set again for pinned upstream")
+		}
+	}
+
+	// Tampered cookies are ignored.
+	tampered := &http.Cookie{Name: "kapi_sticky", Value: strings.Replace(cookie.Value, ".", "0.", 1)}
+	if _, setCookie := pinned(tampered); setCookie == nil {
+		t.Error("no new sticky cookie set for tampered cookie")
+	}
+
+	// Unavailable pinned upstream falls back and pins another one.
+	for _, upstream := range p.Upstreams() {
+		if strings.HasSuffix(upstream.Name, first+".sock") {
+			atomic.StoreInt32(&upstream.unhealthy, 1)
+		}
+	}
+	name, setCookie := pinned(cookie)
+	if name == first || setCookie == nil {
+		t.Fatalf("no fallback from unavailable pinned upstream: %s", name)
+	}
+	if again, _ := pinned(setCookie); again != name {
+		t.Errorf("new pin not honored: %s", again)
+	}
+
+	for _, rule := range []string{"pin-cookie", "cookie-max-age x", "cookie-samesite maybe", "cookie-domain"} {
+		if _, err := newStickyProxyHandler(rule); err == nil {
+			t.Errorf("%s: expected error", rule)
+		}
+	}
+}
+
+func TestSetUpstreams(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream0 := newTestUpstream(t, dir, "rest0", nil)
+	defer upstream0.Close()
+	upstream1 := newTestUpstream(t, dir, "rest1", nil)
+	defer upstream1.Close()
+
+	p, err := New("test", []string{upstream0.socketPath}, &Configuration{
+		Policy:      "first",
+		FailTimeout: 10 * time.Second,
+		MaxFails:    2,
+		Keepalive:   8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := p.Upstreams()[0]
+	existing.fail(10 * time.Second)
+
+	if err = p.SetUpstreams([]string{upstream1.socketPath, upstream0.socketPath}); err != nil {
+		t.Fatal(err)
+	}
+	upstreams := p.Upstreams()
+	if len(upstreams) != 2 {
+		t.Fatalf("unexpected number of upstreams: %d", len(upstreams))
+	}
+	if upstreams[1] != existing || upstreams[1].Fails() != 1 {
+		t.Error("existing upstream was not kept with its state")
+	}
+	rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil || rw.Header().Get("X-Upstream") != "rest1" {
+		t.Errorf("request not forwarded to new upstream: %v", err)
+	}
+
+	if err = p.SetUpstreams(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil)); err != errNoUpstreamAvailable || status != http.StatusBadGateway {
+		t.Errorf("unexpected result without upstreams: %v (%d)", err, status)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var healthy int32
+	upstream0 := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health-check" && atomic.LoadInt32(&healthy) == 0 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	defer upstream0.Close()
+	upstream1 := newTestUpstream(t, dir, "rest1", nil)
+	defer upstream1.Close()
+
+	p, err := New("test", []string{upstream0.socketPath, upstream1.socketPath}, &Configuration{
+		Policy:              "first",
+		Keepalive:           8,
+		HealthCheckPath:     "/health-check",
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthCheckTimeout:  1 * time.Second,
+		HealthyThreshold:    2,
+		UnhealthyThreshold:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	waitFor := func(condition func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for health check")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor(func() bool {
+		return !p.Upstreams()[0].Healthy()
+	})
+	if p.Upstreams()[0].Available() {
+		t.Error("unhealthy upstream is available")
+	}
+	if status := p.Status(); status.Upstreams != 2 || status.Healthy != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil || rw.Header().Get("X-Upstream") != "rest1" {
+		t.Errorf("request not forwarded to healthy upstream: %v", err)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	waitFor(func() bool {
+		return p.Upstreams()[0].Healthy()
+	})
+	if status := p.Status(); status.Healthy != 2 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	rw, _, err = request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil || rw.Header().Get("X-Upstream") != "rest0" {
+		t.Errorf("request not forwarded to recovered upstream: %v", err)
+	}
+
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsistentHeaderPolicy(t *testing.T) {
+	const users = 10000
+
+	newPool := func(n int) []*Upstream {
+		var pool []*Upstream
+		for i := 0; i < n; i++ {
+			upstream, err := newUpstream(fmt.Sprintf("/run/kopano-grapi/rest%d.sock", i), DefaultConfiguration, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool = append(pool, upstream)
+		}
+		return pool
+	}
+	assign := func(pool []*Upstream) map[string]string {
+		policy := &consistentHeaderPolicy{Name: "X-Kopano-UserEntryID"}
+		assignment := make(map[string]string, users)
+		for i := 0; i < users; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Kopano-UserEntryID", fmt.Sprintf("user%d", i))
+			assignment[fmt.Sprintf("user%d", i)] = policy.Select(pool, req).Name
+		}
+		return assignment
+	}
+	moved := func(a, b map[string]string) int {
+		count := 0
+		for user, name := range a {
+			if b[user] != name {
+				count++
+			}
+		}
+		return count
+	}
+
+	pool := newPool(5)
+	assignment := assign(pool)
+
+	// Distribution, every upstream gets its share within 15%.
+	counts := make(map[string]int)
+	for _, name := range assignment {
+		counts[name]++
+	}
+	for _, upstream := range pool {
+		if share := float64(counts[upstream.Name]) / (users / 5); share < 0.85 || share > 1.15 {
+			t.Errorf("unbalanced share of %s: %d users", upstream.Name, counts[upstream.Name])
+		}
+	}
+
+	// Order of the pool does not matter.
+	reversed := make([]*Upstream, len(pool))
+	for i, upstream := range pool {
+		reversed[len(pool)-1-i] = upstream
+	}
+	if n := moved(assignment, assign(reversed)); n != 0 {
+		t.Errorf("%d users moved after reordering the pool", n)
+	}
+
+	// Adding an upstream moves about 1/6 of the users, all to the new one.
+	grown := append(newPool(5), newPool(6)[5])
+	grownAssignment := assign(grown)
+	n := moved(assignment, grownAssignment)
+	if n > users/6*115/100 || n < users/6*85/100 {
+		t.Errorf("unexpected number of users moved after adding an upstream: %d", n)
+	}
+	for user, name := range grownAssignment {
+		if assignment[user] != name && name != grown[5].Name {
+			t.Errorf("%s moved between existing upstreams", user)
+			break
+		}
+	}
+
+	// Removing an upstream moves only its users.
+	shrunk := newPool(5)[1:]
+	shrunkAssignment := assign(shrunk)
+	n = moved(assignment, shrunkAssignment)
+	if n != counts[pool[0].Name] {
+		t.Errorf("unexpected number of users moved after removing an upstream: %d, expected %d", n, counts[pool[0].Name])
+	}
+
+	// An unavailable upstream moves only its users.
+	pool[1].fails = 1
+	pool[1].maxFails = 1
+	unavailableAssignment := assign(pool)
+	n = moved(assignment, unavailableAssignment)
+	if n != counts[pool[1].Name] {
+		t.Errorf("unexpected number of users moved while an upstream is unavailable: %d, expected %d", n, counts[pool[1].Name])
+	}
+
+	// Compared to the plain header policy, which remaps most users.
+	policy := &headerPolicy{Name: "X-Kopano-UserEntryID"}
+	pool = newPool(5)
+	plainMoved := 0
+	for i := 0; i < users; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Kopano-UserEntryID", fmt.Sprintf("user%d", i))
+		if policy.Select(pool, req).Name != policy.Select(grown, req).Name {
+			plainMoved++
+		}
+	}
+	t.Logf("users moved after adding an upstream: consistent_header %d, header %d (of %d)", moved(assignment, grownAssignment), plainMoved, users)
+}
+
+func TestProxyRetryIdempotentOnly(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	// Upstream which closes the connection without response.
+	upstream0 := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		conn, _, err := rw.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	})
+	defer upstream0.Close()
+	upstream1 := newTestUpstream(t, dir, "rest1", nil)
+	defer upstream1.Close()
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		p, err := New("test", []string{upstream0.socketPath, upstream1.socketPath}, &Configuration{
+			Policy:      "first",
+			FailTimeout: 1 * time.Second,
+			MaxFails:    1,
+			TryDuration: 1 * time.Second,
+			TryInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rw, status, err := request(t, p, httptest.NewRequest(method, "/", nil))
+		switch method {
+		case http.MethodGet:
+			if err != nil || rw.Header().Get("X-Upstream") != "rest1" {
+				t.Errorf("%s: request not retried: %v (%d)", method, err, status)
+			}
+		default:
+			if err == nil || status != http.StatusBadGateway {
+				t.Errorf("%s: request retried: %v (%d)", method, err, status)
+			}
+		}
+	}
+}
+
+func TestProxyCircuitBreaker(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var overloaded int32 = 1
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&overloaded) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{
+		Policy:                  "first",
+		Keepalive:               8,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerTimeout:   200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil || rw.Code != http.StatusServiceUnavailable {
+			t.Fatalf("unexpected result before circuit opened: %v (%d)", err, rw.Code)
+		}
+	}
+
+	// Circuit is open.
+	rw, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != errCircuitOpen || status != http.StatusServiceUnavailable {
+		t.Errorf("unexpected result with open circuit: %v (%d)", err, status)
+	}
+	if retryAfter := rw.Header().Get("Retry-After"); retryAfter != "1" {
+		t.Errorf("unexpected Retry-After: %s", retryAfter)
+	}
+
+	// Circuit becomes half-open, a failed trial opens it again.
+	time.Sleep(250 * time.Millisecond)
+	if state := p.Upstreams()[0].breaker.state(time.Now()); state != circuitHalfOpen {
+		t.Errorf("unexpected circuit state: %d", state)
+	}
+	request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if state := p.Upstreams()[0].breaker.state(time.Now()); state != circuitOpen {
+		t.Errorf("unexpected circuit state after failed trial: %d", state)
+	}
+
+	// Successful trial closes it.
+	atomic.StoreInt32(&overloaded, 0)
+	time.Sleep(250 * time.Millisecond)
+	rw, _, err = request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil || rw.Code != http.StatusOK {
+		t.Errorf("unexpected result of trial: %v (%d)", err, rw.Code)
+	}
+	if state := p.Upstreams()[0].breaker.state(time.Now()); state != circuitClosed {
+		t.Errorf("unexpected circuit state after successful trial: %d", state)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	if budget := newRetryBudget(0, 10); budget != nil || !budget.withdraw() {
+		t.Error("disabled budget limits retries")
+	}
+
+	budget := newRetryBudget(0.5, 0)
+	for i := 0; i < 4; i++ {
+		budget.request()
+	}
+	for i := 0; i < 2; i++ {
+		if !budget.withdraw() {
+			t.Errorf("retry %d not allowed", i)
+		}
+	}
+	if budget.withdraw() {
+		t.Error("retry allowed after budget is spent")
+	}
+	budget.request()
+	budget.request()
+	if !budget.withdraw() {
+		t.Error("retry not allowed after more requests")
+	}
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow":
+			time.Sleep(300 * time.Millisecond)
+		case "/large":
+			rw.Header().Set("Content-Length", "11")
+			rw.Write([]byte("hello world"))
+		case "/stream":
+			rw.Write([]byte("hello"))
+			rw.(http.Flusher).Flush()
+			rw.Write([]byte(" world"))
+		case "/idle":
+			rw.Write([]byte("a"))
+			rw.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			rw.Write([]byte("b"))
+		}
+	})
+	defer upstream.Close()
+
+	for _, configuration := range []*Configuration{
+		{Timeout: 50 * time.Millisecond},
+		{ResponseHeaderTimeout: 50 * time.Millisecond},
+	} {
+		p, err := New("test", []string{upstream.socketPath}, configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/slow", nil)); err == nil || status != http.StatusGatewayTimeout {
+			t.Errorf("unexpected result for slow upstream: %v (%d)", err, status)
+		}
+	}
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{MaxResponseSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/large", nil)); err != errResponseTooLarge || status != http.StatusInsufficientStorage {
+		t.Errorf("unexpected result for large response: %v (%d)", err, status)
+	}
+	rw, _, err := request(t, p, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if err != nil || rw.Body.String() != "hello" {
+		t.Errorf("unexpected result for large streamed response: %v (%s)", err, rw.Body.String())
+	}
+
+	p, err = New("test", []string{upstream.socketPath}, &Configuration{IdleTimeout: 50 * time.Millisecond, FlushInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	rw, _, _ = request(t, p, httptest.NewRequest(http.MethodGet, "/idle", nil))
+	if rw.Body.String() != "a" || time.Since(start) >= 250*time.Millisecond {
+		t.Errorf("idle response not cut off: %s after %v", rw.Body.String(), time.Since(start))
+	}
+	rw, _, err = request(t, p, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	if err != nil || rw.Body.String() != "hello world" {
+		t.Errorf("unexpected result for streamed response: %v (%s)", err, rw.Body.String())
+	}
+}
+
+func TestProxyRequestLimits(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("hello world"))
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{
+		ResponseHeaderTimeout: 50 * time.Millisecond,
+		MaxResponseSize:       5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil)); status != http.StatusGatewayTimeout {
+		t.Errorf("unexpected result with default limits: %v (%d)", err, status)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = WithResponseHeaderTimeout(req, time.Second)
+	req = WithMaxResponseSize(req, 1024)
+	rw, status, err := request(t, p, req)
+	if err != nil || rw.Body.String() != "hello world" {
+		t.Errorf("unexpected result with raised limits: %v (%d)", err, status)
+	}
+}
+
+func TestProxyMaxResponseSize(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var hits [2]int32
+	var upstreams []string
+	for i := range hits {
+		i := i
+		upstream := newTestUpstream(t, dir, fmt.Sprintf("rest%d", i), func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			rw.Header().Set("Content-Length", "11")
+			rw.Write([]byte("hello world"))
+		})
+		defer upstream.Close()
+		upstreams = append(upstreams, upstream.socketPath)
+	}
+
+	p, err := New("test", upstreams, &Configuration{
+		Policy:          "first",
+		MaxResponseSize: 5,
+
+		FailTimeout:             10 * time.Second,
+		MaxFails:                1,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerTimeout:   10 * time.Second,
+		TryDuration:             time.Second,
+		TryInterval:             10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/attachment", nil)); err != errResponseTooLarge || status != http.StatusInsufficientStorage {
+			t.Errorf("unexpected result for large response: %v (%d)", err, status)
+		}
+	}
+	if hits := atomic.LoadInt32(&hits[0]); hits != 3 {
+		t.Errorf("unexpected requests of first upstream: %d", hits)
+	}
+	if hits := atomic.LoadInt32(&hits[1]); hits != 0 {
+		t.Errorf("large response was retried on second upstream %d times", hits)
+	}
+	first := p.Upstreams()[0]
+	if first.Fails() != 0 || !first.Available() {
+		t.Errorf("first upstream failed: %d fails, available %v", first.Fails(), first.Available())
+	}
+}
+
+func TestProxyMaxRequestSize(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var hits int32
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write(body)
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{
+		MaxRequestSize: 16,
+
+		FailTimeout:             10 * time.Second,
+		MaxFails:                1,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerTimeout:   10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Early rejection by Content-Length.
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 100)))
+	if _, status, err := request(t, p, req); err != errRequestTooLarge || status != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected result for large request: %v (%d)", err, status)
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Errorf("large request reached upstream")
+	}
+
+	// Rejection while streaming.
+	req = httptest.NewRequest(http.MethodPost, "/upload", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+	req.ContentLength = -1
+	if _, status, err := request(t, p, req); err != errRequestTooLarge || status != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected result for large streamed request: %v (%d)", err, status)
+	}
+
+	// Upstream stays available and limits can be raised per request.
+	for _, size := range []int{16, 100} {
+		req = httptest.NewRequest(http.MethodPost, "/upload", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", size))))
+		req.ContentLength = -1
+		if size > 16 {
+			req = WithMaxRequestSize(req, 1024)
+		}
+		rw, status, err := request(t, p, req)
+		if err != nil || rw.Body.Len() != size {
+			t.Errorf("unexpected result for request of %d bytes: %v (%d)", size, err, status)
+		}
+	}
+}
+
+func TestProxyWebSocket(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	received := make(chan []byte, 1)
+	upstream := newTestUpstream(t, dir, "notify0", func(rw http.ResponseWriter, req *http.Request) {
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		// Text frame with a payload of 130 bytes, sent in two parts.
+		brw.Write([]byte{0x81, 126, 0x00, 130})
+		brw.WriteString(strings.Repeat("a", 100))
+		brw.Flush()
+		time.Sleep(100 * time.Millisecond)
+		brw.WriteString(strings.Repeat("b", 30))
+		brw.Flush()
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(brw, buf); err == nil {
+			received <- buf
+		}
+		ioutil.ReadAll(brw)
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{PingInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.ServeHTTP(rw, req)
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /notify HTTP/1.1\r\nHost: kapi.local\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	response, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %d", response.StatusCode)
+	}
+
+	// The ping comes after the frame, not inside it.
+	frame := make([]byte, 4+130)
+	if _, err = io.ReadFull(br, frame); err != nil {
+		t.Fatal(err)
+	}
+	if string(frame[4:]) != strings.Repeat("a", 100)+strings.Repeat("b", 30) {
+		t.Errorf("unexpected frame: %q", frame)
+	}
+	ping := make([]byte, 2)
+	if _, err = io.ReadFull(br, ping); err != nil || ping[0] != 0x89 || ping[1] != 0x00 {
+		t.Errorf("unexpected ping: %v %v", ping, err)
+	}
+
+	// Masked pong frame to the upstream.
+	conn.Write([]byte{0x8a, 0x80, 1, 2, 3, 4})
+	select {
+	case data := <-received:
+		if data[0] != 0x8a {
+			t.Errorf("unexpected upstream data: %v", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("no data received by upstream")
+	}
+
+	p.Drain()
+	rest, _ := ioutil.ReadAll(br)
+	for len(rest) >= 2 && rest[0] == 0x89 {
+		rest = rest[2:]
+	}
+	if string(rest) != string([]byte{0x88, 0x02, 0x03, 0xe9}) {
+		t.Errorf("unexpected data after drain: %v", rest)
+	}
+
+	// No new upgrades after drain.
+	req := httptest.NewRequest(http.MethodGet, "/notify", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if _, status, err := request(t, p, req); err != errDraining || status != http.StatusServiceUnavailable {
+		t.Errorf("unexpected result for upgrade after drain: %v (%d)", err, status)
+	}
+}
+
+func TestProxyEventStream(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	upstream := newTestUpstream(t, dir, "notify0", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte("data: one\n"))
+		rw.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("\n"))
+		rw.(http.Flusher).Flush()
+		<-req.Context().Done()
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{PingInterval: 30 * time.Millisecond, FlushInterval: -1, IdleTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		p.Drain()
+	}()
+
+	rw, status, err := request(t, p, httptest.NewRequest(http.MethodGet, "/notify", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v (%d)", err, status)
+	}
+	body := rw.Body.String()
+	if !strings.HasPrefix(body, "data: one\n\n: ping\n\n") {
+		t.Errorf("unexpected event stream: %q", body)
+	}
+	if strings.Replace(body[len("data: one\n\n"):], ": ping\n\n", "", -1) != "" {
+		t.Errorf("ping inside of event: %q", body)
+	}
+}
+
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+	breaker := newCircuitBreaker(1, 10*time.Millisecond)
+	breaker.failure(false)
+	time.Sleep(20 * time.Millisecond)
+	if state := breaker.state(time.Now()); state != circuitHalfOpen {
+		t.Fatalf("unexpected circuit state: %d", state)
+	}
+
+	var wg sync.WaitGroup
+	var allowed, trials int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, trial := breaker.acquire()
+			if ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+			if trial {
+				atomic.AddInt32(&trials, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 1 || trials != 1 {
+		t.Fatalf("half-open circuit let %d requests through (%d trials)", allowed, trials)
+	}
+	if breaker.allow() {
+		t.Error("circuit allows requests while the trial is in flight")
+	}
+
+	breaker.success(true)
+	if ok, trial := breaker.acquire(); !ok || trial {
+		t.Errorf("unexpected result of closed circuit: %v %v", ok, trial)
+	}
+}
+
+func TestProxyCircuitBreakerConcurrentTrial(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	var requests int32
+	var overloaded int32 = 1
+	release := make(chan struct{})
+	upstream := newTestUpstream(t, dir, "rest0", func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&overloaded) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		<-release
+	})
+	defer upstream.Close()
+
+	p, err := New("test", []string{upstream.socketPath}, &Configuration{
+		Policy:                  "first",
+		Keepalive:               8,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerTimeout:   50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request(t, p, httptest.NewRequest(http.MethodGet, "/", nil))
+	atomic.StoreInt32(&overloaded, 0)
+	time.Sleep(100 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	var rejected int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, status, _ := request(t, p, httptest.NewRequest(http.MethodGet, "/", nil)); status == http.StatusServiceUnavailable {
+				atomic.AddInt32(&rejected, 1)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if requests != 1 || rejected != 9 {
+		t.Errorf("unexpected requests through half-open circuit: %d (%d rejected)", requests, rejected)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// A Policy selects an upstream for a request.
+type Policy interface {
+	// Select returns an available upstream from the provided pool or nil
+	// if there is none.
+	Select(pool []*Upstream, req *http.Request) *Upstream
+}
+
+// newPolicy creates the Policy for the provided policy rule. Supported are
+// random (the default), least_conn, round_robin, first, ip_hash, uri_hash,
+// header <name> and consistent_header <name>.
+func newPolicy(rule string) (Policy, error) {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return &randomPolicy{}, nil
+	}
+
+	switch fields[0] {
+	case "random":
+		return &randomPolicy{}, nil
+	case "least_conn":
+		return &leastConnPolicy{}, nil
+	case "round_robin":
+		return &roundRobinPolicy{}, nil
+	case "first":
+		return &firstPolicy{}, nil
+	case "ip_hash":
+		return &ipHashPolicy{}, nil
+	case "uri_hash":
+		return &uriHashPolicy{}, nil
+	case "header":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("policy header requires a header name")
+		}
+		return &headerPolicy{Name: fields[1]}, nil
+	case "consistent_header":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("policy consistent_header requires a header name")
+		}
+		return &consistentHeaderPolicy{Name: fields[1]}, nil
+	}
+
+	return nil, fmt.Errorf("unknown policy: %s", fields[0])
+}
+
+// randomPolicy selects a random available upstream.
+type randomPolicy struct{}
+
+func (r *randomPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	var selected *Upstream
+	count := 0
+	for _, upstream := range pool {
+		if !upstream.Available() {
+			continue
+		}
+		// Reservoir sampling.
+		count++
+		if rand.Intn(count) == 0 {
+			selected = upstream
+		}
+	}
+
+	return selected
+}
+
+// leastConnPolicy selects the available upstream with the least active
+// requests, choosing randomly among equals.
+type leastConnPolicy struct{}
+
+func (r *leastConnPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	var selected *Upstream
+	var least int64
+	count := 0
+	for _, upstream := range pool {
+		if !upstream.Available() {
+			continue
+		}
+		conns := upstream.Conns()
+		switch {
+		case selected == nil || conns < least:
+			selected = upstream
+			least = conns
+			count = 1
+		case conns == least:
+			count++
+			if rand.Intn(count) == 0 {
+				selected = upstream
+			}
+		}
+	}
+
+	return selected
+}
+
+// roundRobinPolicy selects the available upstreams in turn.
+type roundRobinPolicy struct {
+	robin uint32
+}
+
+func (r *roundRobinPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	n := uint32(len(pool))
+	if n == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&r.robin, 1) - 1
+	for i := uint32(0); i < n; i++ {
+		upstream := pool[(start+i)%n]
+		if upstream.Available() {
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+// firstPolicy selects the first available upstream.
+type firstPolicy struct{}
+
+func (r *firstPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	for _, upstream := range pool {
+		if upstream.Available() {
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+// ipHashPolicy selects the upstream by hashing the client IP.
+type ipHashPolicy struct{}
+
+func (r *ipHashPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+
+	return selectByHash(pool, clientIP)
+}
+
+// uriHashPolicy selects the upstream by hashing the request URI.
+type uriHashPolicy struct{}
+
+func (r *uriHashPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	return selectByHash(pool, req.URL.RequestURI())
+}
+
+// headerPolicy selects the upstream by hashing the value of a request header.
+// Requests without the header get a random upstream.
+type headerPolicy struct {
+	Name string
+}
+
+func (r *headerPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	value := req.Header.Get(r.Name)
+	if value == "" {
+		return (&randomPolicy{}).Select(pool, req)
+	}
+
+	return selectByHash(pool, value)
+}
+
+// selectByHash selects the upstream at the index given by the hash of the
+// provided value. If that upstream is not available, the next available one
+// is selected.
+func selectByHash(pool []*Upstream, value string) *Upstream {
+	n := uint32(len(pool))
+	if n == 0 {
+		return nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	start := h.Sum32() % n
+	for i := uint32(0); i < n; i++ {
+		upstream := pool[(start+i)%n]
+		if upstream.Available() {
+			return upstream
+		}
+	}
+
+	return nil
+}
+
+// consistentHeaderPolicy selects the upstream by rendezvous hashing of the
+// value of a request header. Unlike headerPolicy, only the values of added or
+// removed upstreams move when the pool changes. Requests without the header
+// get a random upstream.
+type consistentHeaderPolicy struct {
+	Name string
+}
+
+func (r *consistentHeaderPolicy) Select(pool []*Upstream, req *http.Request) *Upstream {
+	value := req.Header.Get(r.Name)
+	if value == "" {
+		return (&randomPolicy{}).Select(pool, req)
+	}
+
+	return selectByRendezvousHash(pool, value)
+}
+
+// selectByRendezvousHash selects the available upstream with the highest
+// score for the provided value. The score is derived from the value and the
+// upstream name only, so the selection does not depend on the pool order and
+// an unavailable upstream moves only its own values.
+func selectByRendezvousHash(pool []*Upstream, value string) *Upstream {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	valueHash := h.Sum64()
+
+	var selected *Upstream
+	var highest uint64
+	for _, upstream := range pool {
+		if !upstream.Available() {
+			continue
+		}
+		score := mix64(valueHash ^ upstream.nameHash)
+		if selected == nil || score > highest {
+			selected = upstream
+			highest = score
+		}
+	}
+
+	return selected
+}
+
+// mix64 is the finalizer of the 64-bit MurmurHash3, it spreads the bits of
+// the combined hashes evenly.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
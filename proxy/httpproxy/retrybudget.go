@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"sync"
+	"time"
+)
+
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudget limits the number of retries to a ratio of the requests in a
+// window, so failing upstreams do not get multiplied load.
+type retryBudget struct {
+	mutex sync.Mutex
+
+	ratio      float64
+	minRetries float64
+
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func newRetryBudget(ratio float64, minPerSecond uint) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+
+	return &retryBudget{
+		ratio:      ratio,
+		minRetries: float64(minPerSecond) * retryBudgetWindow.Seconds(),
+	}
+}
+
+func (b *retryBudget) roll(now time.Time) {
+	if now.Sub(b.start) >= retryBudgetWindow {
+		b.start = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request records a request.
+func (b *retryBudget) request() {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	b.roll(time.Now())
+	b.requests++
+	b.mutex.Unlock()
+}
+
+// withdraw returns true and records a retry if the budget allows it.
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.roll(time.Now())
+	if float64(b.retries) >= b.minRetries+b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+
+	return true
+}
@@ -19,8 +19,13 @@ package httpproxy
 
 import (
 	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"stash.kopano.io/kgol/rndm"
@@ -28,15 +33,40 @@ import (
 	"stash.kopano.io/kc/kapi/proxy"
 )
 
+const (
+	stickyPinContextKey contextKey = "stickyPin"
+)
+
 type stickyProxyHandler struct {
 	CookieName        string
 	CookiePath        string
+	CookieDomain      string
+	CookieMaxAge      int
+	CookieSecure      bool
+	CookieSameSite    http.SameSite
 	HeaderName        string
 	Nocache           bool
 	SetUpstreamHeader bool
 	SetCookie         bool
+	PinCookie         bool
+
+	secret []byte
 }
 
+// stickyPin carries the pinned upstream of a request from the sticky handler
+// to the upstream selection.
+type stickyPin struct {
+	sph      *stickyProxyHandler
+	upstream string
+}
+
+// newStickyProxyHandler creates a sticky handler from the provided rule. The
+// rule is a space separated list of the tokens cookie <name>, set-cookie
+// <name>, pin-cookie <name>, set-upstream-header <name>, nocache, cookie-path
+// <path>, cookie-domain <domain>, cookie-max-age <seconds>, cookie-secure and
+// cookie-samesite <lax|strict|none>. With pin-cookie, the selected upstream is
+// recorded in a signed cookie and used for following requests as long as it
+// is available.
 func newStickyProxyHandler(stickyRule string) (*stickyProxyHandler, error) {
 	scanner := bufio.NewScanner(strings.NewReader(stickyRule))
 	scanner.Split(bufio.ScanWords)
@@ -48,6 +78,14 @@ func newStickyProxyHandler(stickyRule string) (*stickyProxyHandler, error) {
 	for scanner.Scan() {
 		t := scanner.Text()
 		switch t {
+		case "pin-cookie":
+			sph.PinCookie = true
+			scanner.Scan()
+			sph.CookieName = scanner.Text()
+			if sph.CookieName == "" {
+				return nil, fmt.Errorf("sticky rule pin-cookie is missing an argument")
+			}
+
 		case "set-cookie":
 			sph.SetCookie = true
 			fallthrough
@@ -77,6 +115,37 @@ func newStickyProxyHandler(stickyRule string) (*stickyProxyHandler, error) {
 				return nil, fmt.Errorf("sticky rule path is missing an argument")
 			}
 
+		case "cookie-domain":
+			scanner.Scan()
+			sph.CookieDomain = scanner.Text()
+			if sph.CookieDomain == "" {
+				return nil, fmt.Errorf("sticky rule cookie-domain is missing an argument")
+			}
+
+		case "cookie-max-age":
+			scanner.Scan()
+			maxAge, err := strconv.Atoi(scanner.Text())
+			if err != nil || maxAge < 0 {
+				return nil, fmt.Errorf("sticky rule cookie-max-age is missing a valid argument")
+			}
+			sph.CookieMaxAge = maxAge
+
+		case "cookie-secure":
+			sph.CookieSecure = true
+
+		case "cookie-samesite":
+			scanner.Scan()
+			switch strings.ToLower(scanner.Text()) {
+			case "lax":
+				sph.CookieSameSite = http.SameSiteLaxMode
+			case "strict":
+				sph.CookieSameSite = http.SameSiteStrictMode
+			case "none":
+				sph.CookieSameSite = http.SameSiteNoneMode
+			default:
+				return nil, fmt.Errorf("sticky rule cookie-samesite is missing a valid argument")
+			}
+
 		default:
 			return nil, fmt.Errorf("unknown sticky rule token: %v", t)
 		}
@@ -90,7 +159,17 @@ func (sph *stickyProxyHandler) Handler(next proxy.HTTPProxyHandler) proxy.HTTPPr
 		// Prepare our way of operation.
 		var setCookie bool
 		var stickyValue string
-		if sph.CookieName != "" {
+		if sph.PinCookie {
+			// Pin to the upstream from the cookie, the upstream selection
+			// sets a new cookie when it selects a different one.
+			pin := &stickyPin{
+				sph: sph,
+			}
+			if cookie, _ := req.Cookie(sph.CookieName); cookie != nil {
+				pin.upstream = sph.verify(cookie.Value)
+			}
+			req = req.WithContext(context.WithValue(req.Context(), stickyPinContextKey, pin))
+		} else if sph.CookieName != "" {
 			// If a cookie name is set, check if it was sent.
 			cookie, _ := req.Cookie(sph.CookieName)
 			if cookie != nil {
@@ -114,15 +193,106 @@ func (sph *stickyProxyHandler) Handler(next proxy.HTTPProxyHandler) proxy.HTTPPr
 			}
 		}
 		if setCookie {
-			// NOTE(longsleep): Cookie is set without domain.
-			http.SetCookie(rw, &http.Cookie{
-				Name:     sph.CookieName,
-				Value:    stickyValue,
-				Path:     sph.CookiePath,
-				HttpOnly: false,
-			})
+			http.SetCookie(rw, sph.cookie(stickyValue, false))
 		}
 		// Execute.
 		return next.ServeHTTP(rw, req)
 	})
 }
+
+// cookie creates the sticky cookie with the provided value.
+func (sph *stickyProxyHandler) cookie(value string, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     sph.CookieName,
+		Value:    value,
+		Path:     sph.CookiePath,
+		Domain:   sph.CookieDomain,
+		MaxAge:   sph.CookieMaxAge,
+		Secure:   sph.CookieSecure,
+		SameSite: sph.CookieSameSite,
+		HttpOnly: httpOnly,
+	}
+}
+
+// sign returns the cookie value which pins the provided upstream. It contains
+// the hash of the upstream name, so the name itself is not exposed.
+func (sph *stickyProxyHandler) sign(upstream *Upstream) string {
+	id := strconv.FormatUint(upstream.nameHash, 16)
+	mac := hmac.New(sha256.New, sph.secret)
+	mac.Write([]byte(id))
+
+	return id + "." + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// verify returns the upstream id of the provided cookie value or an empty
+// string if its signature is invalid.
+func (sph *stickyProxyHandler) verify(value string) string {
+	sep := strings.IndexByte(value, '.')
+	if sep < 0 {
+		return ""
+	}
+	signature, err := hex.DecodeString(value[sep+1:])
+	if err != nil {
+		return ""
+	}
+
+	id := value[:sep]
+	mac := hmac.New(sha256.New, sph.secret)
+	mac.Write([]byte(id))
+	if !hmac.Equal(signature, mac.Sum(nil)[:16]) {
+		return ""
+	}
+
+	return id
+}
+
+// selectPinned returns the upstream the provided request is pinned to, if it
+// is in the provided pool and available.
+func selectPinned(pool []*Upstream, req *http.Request) *Upstream {
+	pin, ok := req.Context().Value(stickyPinContextKey).(*stickyPin)
+	if !ok || pin.upstream == "" {
+		return nil
+	}
+
+	for _, upstream := range pool {
+		if strconv.FormatUint(upstream.nameHash, 16) == pin.upstream {
+			if upstream.Available() {
+				return upstream
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// pinUpstream sets the sticky cookie for the provided upstream, unless the
+// provided request is already pinned to it.
+func pinUpstream(rw http.ResponseWriter, req *http.Request, upstream *Upstream) {
+	pin, ok := req.Context().Value(stickyPinContextKey).(*stickyPin)
+	if !ok {
+		return
+	}
+
+	header := rw.Header()
+	if cookies := header["Set-Cookie"]; len(cookies) > 0 {
+		// Remove the cookie of a previous try.
+		prefix := pin.sph.CookieName + "="
+		kept := cookies[:0]
+		for _, cookie := range cookies {
+			if !strings.HasPrefix(cookie, prefix) {
+				kept = append(kept, cookie)
+			}
+		}
+		if len(kept) == 0 {
+			header.Del("Set-Cookie")
+		} else {
+			header["Set-Cookie"] = kept
+		}
+	}
+
+	if strconv.FormatUint(upstream.nameHash, 16) == pin.upstream {
+		return
+	}
+	http.SetCookie(rw, pin.sph.cookie(pin.sph.sign(upstream), true))
+}
@@ -0,0 +1,462 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	streamTypeWebSocket   = "websocket"
+	streamTypeEventStream = "eventstream"
+	streamTypeUpgrade     = "upgrade"
+
+	streamBufferSize = 32 * 1024
+)
+
+var errDraining = errors.New("proxy is draining")
+
+var (
+	streamsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "streams",
+		Help:      "Number of open streaming connections by type",
+	}, []string{"proxy", "type"})
+	streamDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "stream_duration_seconds",
+		Help:      "Duration of streaming connections by type",
+		Buckets:   []float64{1, 10, 60, 300, 900, 3600, 14400, 86400},
+	}, []string{"proxy", "type"})
+	streamBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "stream_bytes_total",
+		Help:      "Total number of bytes of streaming connections by type and direction",
+	}, []string{"proxy", "type", "direction"})
+	streamPingsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "stream_pings_total",
+		Help:      "Total number of pings sent to clients of idle streaming connections by type",
+	}, []string{"proxy", "type"})
+	streamClosesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kapi",
+		Subsystem: "proxy",
+		Name:      "stream_closes_total",
+		Help:      "Total number of closed streaming connections by type and reason",
+	}, []string{"proxy", "type", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(streamsGauge, streamDurationHistogram, streamBytesCounter, streamPingsCounter, streamClosesCounter)
+}
+
+// streams tracks the streaming connections of a proxy, which are WebSocket
+// and other protocol upgrades as well as server-sent event streams.
+type streams struct {
+	name         string
+	pingInterval time.Duration
+
+	drainOnce sync.Once
+	drain     chan struct{}
+}
+
+func newStreams(name string, configuration *Configuration) *streams {
+	return &streams{
+		name:         name,
+		pingInterval: configuration.PingInterval,
+
+		drain: make(chan struct{}),
+	}
+}
+
+// startDrain makes all streams end at their next boundary.
+func (s *streams) startDrain() {
+	s.drainOnce.Do(func() {
+		close(s.drain)
+	})
+}
+
+func (s *streams) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// wrap returns the body of the provided response wrapped as stream, if the
+// response starts one.
+func (s *streams) wrap(response *http.Response) (io.ReadCloser, bool) {
+	switch {
+	case response.StatusCode == http.StatusSwitchingProtocols:
+		backConn, ok := response.Body.(io.ReadWriteCloser)
+		if !ok {
+			// Leave the error to the reverse proxy.
+			return nil, false
+		}
+		if strings.EqualFold(upgradeType(response.Header), "websocket") {
+			return s.newStream(streamTypeWebSocket, backConn, &webSocketFramer{}), true
+		}
+		return s.newStream(streamTypeUpgrade, backConn, nil), true
+
+	case isEventStream(response):
+		return s.newStream(streamTypeEventStream, response.Body, &eventStreamFramer{}), true
+	}
+
+	return nil, false
+}
+
+// isUpgrade returns true if the provided request asks to switch protocols.
+func isUpgrade(req *http.Request) bool {
+	return upgradeType(req.Header) != ""
+}
+
+func upgradeType(header http.Header) string {
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+
+	return ""
+}
+
+func isEventStream(response *http.Response) bool {
+	if response.StatusCode != http.StatusOK {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// A streamFramer knows the message boundaries of the data which is streamed to
+// the client, since pings and the final close can only be sent between
+// messages.
+type streamFramer interface {
+	// consume tracks the provided data sent to the client.
+	consume(p []byte)
+	// boundary returns true if the data sent so far ends with a complete
+	// message.
+	boundary() bool
+	// ping returns the ping message.
+	ping() []byte
+	// close returns the message which is sent before the stream ends.
+	close() []byte
+}
+
+type streamChunk struct {
+	data []byte
+	err  error
+}
+
+// stream is the body of a streaming response. It is read by the reverse proxy
+// and sends pings to the client when no data arrives from the upstream for
+// the ping interval. When the proxy drains, it ends at the next message
+// boundary. For protocol upgrades, it also is the connection to the upstream
+// which receives the data of the client.
+type stream struct {
+	streams    *streams
+	streamType string
+	framer     streamFramer
+
+	upstream io.ReadCloser
+	chunks   chan streamChunk
+	closed   chan struct{}
+
+	closeOnce sync.Once
+	started   time.Time
+
+	mutex  sync.Mutex
+	reason string
+
+	pending  []byte
+	err      error
+	draining bool
+	timer    *time.Timer
+
+	downstream prometheus.Counter
+	writes     prometheus.Counter
+}
+
+func (s *streams) newStream(streamType string, upstream io.ReadCloser, framer streamFramer) *stream {
+	st := &stream{
+		streams:    s,
+		streamType: streamType,
+		framer:     framer,
+
+		upstream: upstream,
+		chunks:   make(chan streamChunk),
+		closed:   make(chan struct{}),
+
+		started: time.Now(),
+		reason:  "done",
+
+		downstream: streamBytesCounter.WithLabelValues(s.name, streamType, "downstream"),
+		writes:     streamBytesCounter.WithLabelValues(s.name, streamType, "upstream"),
+	}
+	if framer != nil && s.pingInterval > 0 {
+		st.timer = time.NewTimer(s.pingInterval)
+	}
+	streamsGauge.WithLabelValues(s.name, streamType).Inc()
+
+	go st.pump()
+
+	return st
+}
+
+// pump reads from the upstream, so reading the stream can wait for upstream
+// data, pings and draining at the same time.
+func (st *stream) pump() {
+	for {
+		buf := make([]byte, streamBufferSize)
+		n, err := st.upstream.Read(buf)
+		select {
+		case st.chunks <- streamChunk{data: buf[:n], err: err}:
+		case <-st.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (st *stream) Read(p []byte) (int, error) {
+	for len(st.pending) == 0 {
+		if st.err != nil {
+			return 0, st.err
+		}
+		if st.draining && st.boundary() {
+			st.setReason("drain")
+			st.err = io.EOF
+			if st.framer != nil {
+				st.pending = st.framer.close()
+			}
+			continue
+		}
+
+		var ping <-chan time.Time
+		if st.timer != nil {
+			ping = st.timer.C
+		}
+		var drain <-chan struct{}
+		if !st.draining {
+			drain = st.streams.drain
+		}
+		select {
+		case chunk := <-st.chunks:
+			st.pending = chunk.data
+			if chunk.err != nil {
+				st.err = chunk.err
+			}
+			st.downstream.Add(float64(len(chunk.data)))
+			st.resetTimer()
+		case <-ping:
+			if st.boundary() {
+				st.pending = st.framer.ping()
+				streamPingsCounter.WithLabelValues(st.streams.name, st.streamType).Inc()
+			}
+			st.timer.Reset(st.streams.pingInterval)
+		case <-drain:
+			st.draining = true
+		case <-st.closed:
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, st.pending)
+	if st.framer != nil {
+		st.framer.consume(p[:n])
+	}
+	st.pending = st.pending[n:]
+
+	return n, nil
+}
+
+// Write sends the provided data of the client to the upstream of a protocol
+// upgrade.
+func (st *stream) Write(p []byte) (int, error) {
+	writer, ok := st.upstream.(io.Writer)
+	if !ok {
+		return 0, errors.New("stream is not writable")
+	}
+	n, err := writer.Write(p)
+	st.writes.Add(float64(n))
+
+	return n, err
+}
+
+func (st *stream) Close() error {
+	var err error
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		err = st.upstream.Close()
+
+		streamsGauge.WithLabelValues(st.streams.name, st.streamType).Dec()
+		streamDurationHistogram.WithLabelValues(st.streams.name, st.streamType).Observe(time.Since(st.started).Seconds())
+		st.mutex.Lock()
+		reason := st.reason
+		st.mutex.Unlock()
+		streamClosesCounter.WithLabelValues(st.streams.name, st.streamType, reason).Inc()
+	})
+
+	return err
+}
+
+func (st *stream) setReason(reason string) {
+	st.mutex.Lock()
+	st.reason = reason
+	st.mutex.Unlock()
+}
+
+func (st *stream) boundary() bool {
+	return st.framer == nil || st.framer.boundary()
+}
+
+func (st *stream) resetTimer() {
+	if st.timer == nil {
+		return
+	}
+	if !st.timer.Stop() {
+		select {
+		case <-st.timer.C:
+		default:
+		}
+	}
+	st.timer.Reset(st.streams.pingInterval)
+}
+
+// eventStreamFramer tracks server-sent events, which end with an empty line.
+type eventStreamFramer struct {
+	started  bool
+	newlines int
+}
+
+func (f *eventStreamFramer) consume(p []byte) {
+	for _, b := range p {
+		f.started = true
+		switch b {
+		case '\n':
+			f.newlines++
+		case '\r':
+		default:
+			f.newlines = 0
+		}
+	}
+}
+
+func (f *eventStreamFramer) boundary() bool {
+	return !f.started || f.newlines >= 2
+}
+
+func (f *eventStreamFramer) ping() []byte {
+	// NOTE: Lines starting with a colon are comments, which clients ignore.
+	return []byte(": ping\n\n")
+}
+
+func (f *eventStreamFramer) close() []byte {
+	return nil
+}
+
+// webSocketFramer tracks the frames which the upstream sends to the client,
+// see RFC 6455 section 5.2. Control frames may be sent between the frames of
+// fragmented messages, so every frame boundary is a boundary.
+type webSocketFramer struct {
+	header    []byte
+	remaining uint64
+}
+
+func (f *webSocketFramer) consume(p []byte) {
+	for len(p) > 0 {
+		if f.remaining > 0 {
+			n := uint64(len(p))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			p = p[n:]
+			continue
+		}
+
+		f.header = append(f.header, p[0])
+		p = p[1:]
+		if len(f.header) < 2 {
+			continue
+		}
+		size := 2
+		switch f.header[1] & 0x7f {
+		case 126:
+			size += 2
+		case 127:
+			size += 8
+		}
+		if f.header[1]&0x80 != 0 {
+			// Masking key.
+			size += 4
+		}
+		if len(f.header) < size {
+			continue
+		}
+
+		var length uint64
+		switch f.header[1] & 0x7f {
+		case 126:
+			length = uint64(f.header[2])<<8 | uint64(f.header[3])
+		case 127:
+			for _, b := range f.header[2:10] {
+				length = length<<8 | uint64(b)
+			}
+		default:
+			length = uint64(f.header[1] & 0x7f)
+		}
+		f.header = f.header[:0]
+		f.remaining = length
+	}
+}
+
+func (f *webSocketFramer) boundary() bool {
+	return len(f.header) == 0 && f.remaining == 0
+}
+
+func (f *webSocketFramer) ping() []byte {
+	// Unmasked ping frame without payload.
+	return []byte{0x89, 0x00}
+}
+
+func (f *webSocketFramer) close() []byte {
+	// Unmasked close frame with status 1001 (going away).
+	return []byte{0x88, 0x02, 0x03, 0xe9}
+}
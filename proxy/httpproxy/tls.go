@@ -0,0 +1,63 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newTLSClientConfig creates the TLS client configuration for https upstreams
+// from the provided configuration. It returns nil if the defaults should be
+// used.
+func newTLSClientConfig(configuration *Configuration) (*tls.Config, error) {
+	if configuration.TLSCAFile == "" && configuration.TLSCertFile == "" && configuration.TLSKeyFile == "" && configuration.TLSServerName == "" && !configuration.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         configuration.TLSServerName,
+		InsecureSkipVerify: configuration.TLSInsecureSkipVerify,
+	}
+
+	if configuration.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(configuration.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", configuration.TLSCAFile)
+		}
+	}
+
+	if configuration.TLSCertFile != "" || configuration.TLSKeyFile != "" {
+		if configuration.TLSCertFile == "" || configuration.TLSKeyFile == "" {
+			return nil, fmt.Errorf("client certificate requires both cert and key file")
+		}
+		certificate, err := tls.LoadX509KeyPair(configuration.TLSCertFile, configuration.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
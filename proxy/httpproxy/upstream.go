@@ -0,0 +1,417 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type contextKey string
+
+const (
+	serveResultContextKey           contextKey = "serveResult"
+	maxRequestSizeContextKey        contextKey = "maxRequestSize"
+	maxResponseSizeContextKey       contextKey = "maxResponseSize"
+	responseHeaderTimeoutContextKey contextKey = "responseHeaderTimeout"
+)
+
+// serveResult is filled by the reverse proxy hooks of an upstream.
+type serveResult struct {
+	err    error
+	status int
+	cancel context.CancelFunc
+}
+
+// Upstream is a backend of a proxy.
+type Upstream struct {
+	// NOTE: 64-bit fields accessed atomically come first to keep
+	// them aligned on 32-bit platforms.
+	conns    int64
+	maxConns int64
+	breaker  circuitBreaker
+
+	// Name is the URI the upstream was created from.
+	Name string
+	// nameHash is the hash of Name used by hash based policies.
+	nameHash uint64
+
+	target    *url.URL
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	maxFails  int32
+
+	// transports are the clones of transport with the response header
+	// timeouts requested with WithResponseHeaderTimeout.
+	transportsMutex sync.Mutex
+	transports      map[time.Duration]*http.Transport
+
+	fails     int32
+	unhealthy int32
+
+	idleTimeout     time.Duration
+	maxResponseSize int64
+	streams         *streams
+
+	healthSuccesses uint
+	healthFailures  uint
+}
+
+func newUpstream(uri string, configuration *Configuration, tlsConfig *tls.Config, streams *streams) (*Upstream, error) {
+	var target *url.URL
+	if strings.Contains(uri, "://") {
+		var err error
+		target, err = url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %s: %v", uri, err)
+		}
+	} else {
+		// Upstreams without scheme are unix socket paths.
+		target = &url.URL{
+			Scheme: "unix",
+			Path:   uri,
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		MaxIdleConnsPerHost:   int(configuration.Keepalive),
+		DisableKeepAlives:     configuration.Keepalive == 0,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: configuration.ResponseHeaderTimeout,
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+
+	switch target.Scheme {
+	case "unix":
+		socketPath := target.Path
+		if socketPath == "" {
+			return nil, fmt.Errorf("invalid upstream %s: no socket path", uri)
+		}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		// NOTE: The host is only used to identify connections, the
+		// Host header of the request is forwarded unchanged.
+		target = &url.URL{
+			Scheme: "http",
+			Host:   "unix",
+		}
+	case "http", "https":
+		if target.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %s: no host", uri)
+		}
+	default:
+		return nil, fmt.Errorf("invalid upstream %s: unsupported scheme %s", uri, target.Scheme)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(uri))
+
+	u := &Upstream{
+		Name:     uri,
+		nameHash: h.Sum64(),
+
+		target:    target,
+		transport: transport,
+		maxFails:  int32(configuration.MaxFails),
+		maxConns:  int64(configuration.MaxConns),
+		breaker:   newCircuitBreaker(configuration.CircuitBreakerThreshold, configuration.CircuitBreakerTimeout),
+
+		idleTimeout:     configuration.IdleTimeout,
+		maxResponseSize: configuration.MaxResponseSize,
+		streams:         streams,
+	}
+	u.proxy = &httputil.ReverseProxy{
+		Director:       u.director,
+		Transport:      roundTripperFunc(u.roundTrip),
+		ModifyResponse: u.modifyResponse,
+		ErrorHandler:   u.errorHandler,
+		FlushInterval:  configuration.FlushInterval,
+	}
+
+	return u, nil
+}
+
+// Available returns true if the accociated upstream can take requests.
+func (u *Upstream) Available() bool {
+	if !u.Healthy() {
+		return false
+	}
+	if !u.breaker.allow() {
+		return false
+	}
+	if u.maxFails > 0 && atomic.LoadInt32(&u.fails) >= u.maxFails {
+		return false
+	}
+	if u.maxConns > 0 && atomic.LoadInt64(&u.conns) >= u.maxConns {
+		return false
+	}
+
+	return true
+}
+
+// Conns returns the number of active requests of the accociated upstream.
+func (u *Upstream) Conns() int64 {
+	return atomic.LoadInt64(&u.conns)
+}
+
+// Fails returns the number of currently counted failures of the accociated
+// upstream.
+func (u *Upstream) Fails() int32 {
+	return atomic.LoadInt32(&u.fails)
+}
+
+// fail counts a failure for the provided duration.
+func (u *Upstream) fail(timeout time.Duration) {
+	if timeout == 0 {
+		return
+	}
+
+	atomic.AddInt32(&u.fails, 1)
+	time.AfterFunc(timeout, func() {
+		atomic.AddInt32(&u.fails, -1)
+	})
+}
+
+func (u *Upstream) closeIdleConnections() {
+	u.transport.CloseIdleConnections()
+
+	u.transportsMutex.Lock()
+	for _, transport := range u.transports {
+		transport.CloseIdleConnections()
+	}
+	u.transportsMutex.Unlock()
+}
+
+// roundTripperFunc is a function which implements the http.RoundTripper
+// interface.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// roundTrip sends the provided request with the transport of its response
+// header timeout. The timeout is a setting of the transport, so requests with
+// their own timeout use a clone of the default transport.
+func (u *Upstream) roundTrip(req *http.Request) (*http.Response, error) {
+	timeout, ok := req.Context().Value(responseHeaderTimeoutContextKey).(time.Duration)
+	if !ok || timeout == u.transport.ResponseHeaderTimeout {
+		return u.transport.RoundTrip(req)
+	}
+
+	u.transportsMutex.Lock()
+	transport, ok := u.transports[timeout]
+	if !ok {
+		transport = u.transport.Clone()
+		transport.ResponseHeaderTimeout = timeout
+		if u.transports == nil {
+			u.transports = make(map[time.Duration]*http.Transport)
+		}
+		u.transports[timeout] = transport
+	}
+	u.transportsMutex.Unlock()
+
+	return transport.RoundTrip(req)
+}
+
+// serve forwards the provided request to the accociated upstream. Errors are
+// returned only if nothing was written to the provided response writer yet.
+// The request must have passed the circuit breaker of the upstream, with trial
+// set if it is the trial request of the half-open circuit.
+func (u *Upstream) serve(rw http.ResponseWriter, req *http.Request, trial bool) error {
+	atomic.AddInt64(&u.conns, 1)
+	defer atomic.AddInt64(&u.conns, -1)
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	result := &serveResult{
+		cancel: cancel,
+	}
+
+	// NOTE: Accounting is deferred, since the reverse proxy aborts the
+	// handler with a panic when copying the response body fails.
+	defer func() {
+		switch {
+		case errors.Is(req.Context().Err(), context.Canceled):
+			// Client is gone, this tells nothing about the upstream.
+			u.breaker.release(trial)
+		case isRequestTooLarge(req):
+			// Client error, this tells nothing about the upstream.
+			u.breaker.release(trial)
+		case errors.Is(result.err, errResponseTooLarge):
+			// Limit of the request, this tells nothing about the upstream.
+			u.breaker.release(trial)
+		case result.err != nil:
+			u.breaker.failure(trial)
+		case result.status == http.StatusBadGateway || result.status == http.StatusServiceUnavailable || result.status == http.StatusGatewayTimeout:
+			// Overloaded or broken upstream, the response is forwarded as is.
+			u.breaker.failure(trial)
+		default:
+			u.breaker.success(trial)
+		}
+	}()
+
+	u.proxy.ServeHTTP(rw, req.WithContext(context.WithValue(ctx, serveResultContextKey, result)))
+
+	return result.err
+}
+
+func (u *Upstream) director(req *http.Request) {
+	req.URL.Scheme = u.target.Scheme
+	req.URL.Host = u.target.Host
+	if u.target.Path != "" {
+		req.URL.Path = strings.TrimSuffix(u.target.Path, "/") + "/" + strings.TrimPrefix(req.URL.Path, "/")
+		req.URL.RawPath = ""
+	}
+
+	// Transparent proxy headers. The Host header stays unchanged and
+	// X-Forwarded-For is added by httputil.ReverseProxy.
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		req.Header.Set("X-Real-IP", clientIP)
+	}
+	if req.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(localAddr.String()); err == nil {
+			req.Header.Set("X-Forwarded-Port", port)
+		}
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// Avoid the default User-Agent of the Go HTTP client.
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+func (u *Upstream) modifyResponse(response *http.Response) error {
+	result, ok := response.Request.Context().Value(serveResultContextKey).(*serveResult)
+	if !ok {
+		return nil
+	}
+
+	result.status = response.StatusCode
+
+	if body, ok := u.streams.wrap(response); ok {
+		// Streams are long lived and handle idle connections with pings.
+		response.Body = body
+		return nil
+	}
+
+	maxResponseSize := u.maxResponseSize
+	if limit, ok := response.Request.Context().Value(maxResponseSizeContextKey).(int64); ok {
+		maxResponseSize = limit
+	}
+	if maxResponseSize > 0 {
+		if response.ContentLength > maxResponseSize {
+			return errResponseTooLarge
+		}
+		response.Body = &limitedBody{
+			ReadCloser: response.Body,
+			remaining:  maxResponseSize,
+		}
+	}
+	if u.idleTimeout > 0 {
+		response.Body = &idleTimeoutBody{
+			ReadCloser: response.Body,
+			timeout:    u.idleTimeout,
+			timer:      time.AfterFunc(u.idleTimeout, result.cancel),
+		}
+	}
+
+	return nil
+}
+
+func (u *Upstream) errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	if result, ok := req.Context().Value(serveResultContextKey).(*serveResult); ok {
+		result.err = err
+	}
+}
+
+func isRequestTooLarge(req *http.Request) bool {
+	body, ok := req.Body.(*requestBody)
+	return ok && body.tooLarge()
+}
+
+// limitedBody fails reading a response body after the remaining bytes.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		err = errResponseTooLarge
+	}
+	b.remaining -= int64(n)
+
+	return n, err
+}
+
+// idleTimeoutBody cancels a response when no data arrives within timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+
+	return b.ReadCloser.Close()
+}
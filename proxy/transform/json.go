@@ -0,0 +1,84 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// removeFields removes the fields with the provided dot separated paths from
+// the JSON document body. Arrays on the way are traversed. If collection is
+// true, the fields are also removed from the entries of the `value` array of
+// the document.
+func removeFields(body []byte, fields []string, collection bool) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+
+	var entries []interface{}
+	if collection {
+		if object, ok := document.(map[string]interface{}); ok {
+			entries, _ = object["value"].([]interface{})
+		}
+	}
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		removePath(document, path)
+		for _, entry := range entries {
+			removePath(entry, path)
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func removePath(value interface{}, path []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		removePath(v[path[0]], path[1:])
+	case []interface{}:
+		for _, entry := range v {
+			removePath(entry, path)
+		}
+	}
+}
+
+// isJSON returns true if the provided header has a JSON content type.
+func isJSON(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package transform
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseTransformer is a http.ResponseWriter which applies response
+// transformations. Responses with JSON bodies, whose fields are removed, are
+// buffered up to a limit. All other responses are streamed.
+type responseTransformer struct {
+	rw           http.ResponseWriter
+	rules        []*Response
+	removeFields bool
+	limit        int64
+
+	header      http.Header
+	status      int
+	wroteHeader bool
+	buffering   bool
+	body        bytes.Buffer
+	err         error
+}
+
+func newResponseTransformer(rw http.ResponseWriter, rules []*Response, limit int64) *responseTransformer {
+	w := &responseTransformer{
+		rw:    rw,
+		rules: rules,
+		limit: limit,
+
+		header: make(http.Header),
+	}
+	for _, rule := range rules {
+		if len(rule.RemoveFields) > 0 {
+			w.removeFields = true
+		}
+	}
+
+	return w
+}
+
+func (w *responseTransformer) Header() http.Header {
+	return w.header
+}
+
+func (w *responseTransformer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+
+	if w.removeFields && isJSON(w.header) {
+		if encoding := w.header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+			// Fail closed, fields to remove must never pass.
+			w.err = errBodyEncoded
+			return
+		}
+		w.buffering = true
+		return
+	}
+
+	w.writeHeader()
+}
+
+func (w *responseTransformer) writeHeader() {
+	header := w.rw.Header()
+	for name, values := range w.header {
+		header[name] = values
+	}
+	for _, rule := range w.rules {
+		if rule.Headers != nil {
+			rule.Headers.apply(header)
+		}
+	}
+	w.rw.WriteHeader(w.status)
+}
+
+func (w *responseTransformer) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.err != nil {
+		// Discard, finish reports the error. Returning it would abort the
+		// connection in the reverse proxy.
+		return len(p), nil
+	}
+	if !w.buffering {
+		return w.rw.Write(p)
+	}
+	if int64(w.body.Len()+len(p)) > w.limit {
+		w.err = errBodyTooLarge
+		w.body.Reset()
+		return len(p), nil
+	}
+
+	return w.body.Write(p)
+}
+
+// Flush implements the http.Flusher interface for streamed responses.
+func (w *responseTransformer) Flush() {
+	if w.buffering || w.err != nil {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish transforms and writes buffered responses. If it returns an error,
+// nothing has been written.
+func (w *responseTransformer) finish() error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		return nil
+	}
+
+	body := w.body.Bytes()
+	if len(body) > 0 {
+		fields := make([]string, 0)
+		for _, rule := range w.rules {
+			fields = append(fields, rule.RemoveFields...)
+		}
+		var err error
+		if body, err = removeFields(body, fields, true); err != nil {
+			return err
+		}
+		// The representation changed, so validators can only be weak.
+		if etag := w.header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			w.header.Set("ETag", "W/"+etag)
+		}
+	}
+	if len(body) > 0 {
+		w.header.Set("Content-Length", strconv.Itoa(len(body)))
+	} else {
+		w.header.Del("Content-Length")
+	}
+
+	w.writeHeader()
+	_, err := w.rw.Write(body)
+
+	return err
+}
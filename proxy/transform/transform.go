@@ -0,0 +1,303 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package transform provides declarative transformations of proxied requests
+// and responses, like removing fields from JSON bodies, adding or removing
+// headers and rewriting query parameters.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/proxy"
+)
+
+// DefaultMaxBodySize is the default limit of bodies which are transformed.
+const DefaultMaxBodySize = 4 * 1024 * 1024
+
+var (
+	errBodyTooLarge = errors.New("body too large to transform")
+	errBodyEncoded  = errors.New("encoded body cannot be transformed")
+)
+
+// Configuration is the declarative definition of transformations.
+type Configuration struct {
+	// MaxBodySize limits the size of JSON bodies which are transformed.
+	// Larger bodies fail instead of passing untransformed.
+	MaxBodySize int64   `json:"max_body_size,omitempty"`
+	Rules       []*Rule `json:"rules"`
+}
+
+// Rule defines transformations of requests and their responses, which match
+// all of its methods, path and clients. Empty matchers match everything.
+type Rule struct {
+	Methods []string `json:"methods,omitempty"`
+	// Path is a regular expression which must match the request path.
+	Path string `json:"path,omitempty"`
+	// Clients are the IDs of the clients to which the access tokens of the
+	// requests were issued.
+	Clients []string `json:"clients,omitempty"`
+
+	Request  *Request  `json:"request,omitempty"`
+	Response *Response `json:"response,omitempty"`
+
+	path *regexp.Regexp
+}
+
+// Request defines transformations of requests.
+type Request struct {
+	Headers *Headers `json:"headers,omitempty"`
+	Query   *Query   `json:"query,omitempty"`
+	// RemoveFields are dot separated paths of fields to remove from JSON
+	// bodies.
+	RemoveFields []string `json:"remove_fields,omitempty"`
+}
+
+// Response defines transformations of responses.
+type Response struct {
+	Headers *Headers `json:"headers,omitempty"`
+	// RemoveFields are dot separated paths of fields to remove from JSON
+	// bodies. Fields are removed from the body and from all objects in its
+	// `value` array, which holds the entries of collections.
+	RemoveFields []string `json:"remove_fields,omitempty"`
+}
+
+// Headers defines header transformations.
+type Headers struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// Query defines query parameter transformations. Default parameters are only
+// set if not in the request already.
+type Query struct {
+	Set     map[string]string `json:"set,omitempty"`
+	Default map[string]string `json:"default,omitempty"`
+	Remove  []string          `json:"remove,omitempty"`
+}
+
+// Transformer applies the rules of a Configuration.
+type Transformer struct {
+	maxBodySize int64
+	rules       []*Rule
+}
+
+// New creates a new Transformer with the provided configuration.
+func New(configuration *Configuration) (*Transformer, error) {
+	t := &Transformer{
+		maxBodySize: configuration.MaxBodySize,
+		rules:       configuration.Rules,
+	}
+	if t.maxBodySize <= 0 {
+		t.maxBodySize = DefaultMaxBodySize
+	}
+
+	for idx, rule := range t.rules {
+		if rule == nil {
+			return nil, fmt.Errorf("rule %d is empty", idx)
+		}
+		if rule.Path != "" {
+			var err error
+			if rule.path, err = regexp.Compile(rule.Path); err != nil {
+				return nil, fmt.Errorf("rule %d path is invalid: %v", idx, err)
+			}
+		}
+		for i, method := range rule.Methods {
+			rule.Methods[i] = strings.ToUpper(method)
+		}
+	}
+
+	return t, nil
+}
+
+// Load creates a new Transformer with the configuration of the JSON file with
+// the provided name.
+func Load(fn string) (*Transformer, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	configuration := &Configuration{}
+	if err = json.Unmarshal(data, configuration); err != nil {
+		return nil, fmt.Errorf("failed to parse transform rules: %v", err)
+	}
+
+	return New(configuration)
+}
+
+// Handler returns a proxy.HTTPProxyHandler which transforms requests and their
+// responses as defined by the rules of the accociated Transformer, before
+// forwarding them to the provided next handler.
+func (t *Transformer) Handler(next proxy.HTTPProxyHandler) proxy.HTTPProxyHandler {
+	return proxy.HTTPProxyHandlerFunc(func(rw http.ResponseWriter, req *http.Request) (int, error) {
+		rules := t.match(req)
+		if len(rules) == 0 {
+			return next.ServeHTTP(rw, req)
+		}
+
+		outreq := req.Clone(req.Context())
+		responseRules := make([]*Response, 0, len(rules))
+		for _, rule := range rules {
+			if rule.Request != nil {
+				if err := t.transformRequest(outreq, rule.Request); err != nil {
+					if err == errBodyTooLarge {
+						return http.StatusRequestEntityTooLarge, err
+					}
+					return http.StatusBadRequest, err
+				}
+			}
+			if rule.Response != nil {
+				responseRules = append(responseRules, rule.Response)
+			}
+		}
+		if len(responseRules) == 0 {
+			return next.ServeHTTP(rw, outreq)
+		}
+
+		w := newResponseTransformer(rw, responseRules, t.maxBodySize)
+		if w.removeFields {
+			// Bodies can only be transformed when not encoded.
+			outreq.Header.Del("Accept-Encoding")
+		}
+		status, err := next.ServeHTTP(w, outreq)
+		if err != nil {
+			return status, err
+		}
+		if err = w.finish(); err != nil {
+			return http.StatusBadGateway, err
+		}
+
+		return 0, nil
+	})
+}
+
+// match returns the rules of the accociated Transformer which match the
+// provided request.
+func (t *Transformer) match(req *http.Request) []*Rule {
+	var rules []*Rule
+	var clientID *string
+
+	for _, rule := range t.rules {
+		if len(rule.Methods) > 0 && !containsString(rule.Methods, req.Method) {
+			continue
+		}
+		if rule.path != nil && !rule.path.MatchString(req.URL.Path) {
+			continue
+		}
+		if len(rule.Clients) > 0 {
+			if clientID == nil {
+				id := ClientID(req)
+				clientID = &id
+			}
+			if *clientID == "" || !containsString(rule.Clients, *clientID) {
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+func (t *Transformer) transformRequest(req *http.Request, transform *Request) error {
+	if transform.Headers != nil {
+		transform.Headers.apply(req.Header)
+	}
+
+	if transform.Query != nil {
+		query := req.URL.Query()
+		for _, name := range transform.Query.Remove {
+			query.Del(name)
+		}
+		for name, value := range transform.Query.Default {
+			if _, ok := query[name]; !ok {
+				query.Set(name, value)
+			}
+		}
+		for name, value := range transform.Query.Set {
+			query.Set(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	if len(transform.RemoveFields) > 0 && req.Body != nil && isJSON(req.Header) {
+		if req.Header.Get("Content-Encoding") != "" {
+			return errBodyEncoded
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, t.maxBodySize))
+		req.Body.Close()
+		if err != nil {
+			return errBodyTooLarge
+		}
+		if len(body) > 0 {
+			if body, err = removeFields(body, transform.RemoveFields, false); err != nil {
+				return err
+			}
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Length")
+	}
+
+	return nil
+}
+
+func (h *Headers) apply(header http.Header) {
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+}
+
+// ClientID returns the ID of the client to which the access token of the
+// provided request was issued.
+func ClientID(req *http.Request) string {
+	record, _ := auth.RecordFromContext(req.Context())
+	if record == nil {
+		return ""
+	}
+	if record.ServicePrincipal != nil {
+		return record.ServicePrincipal.ClientID
+	}
+	var audience string
+	if record.StandardClaims != nil {
+		audience = record.StandardClaims.Audience
+	}
+
+	return auth.ClientIDFromClaims(audience, record.ExtraClaims)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package transform
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/proxy"
+)
+
+func newTestTransformer(t *testing.T) *Transformer {
+	transformer, err := New(&Configuration{
+		MaxBodySize: 1024,
+		Rules: []*Rule{
+			{
+				Path:    "^/api/gc/v1/(me|users)",
+				Clients: []string{"external-app"},
+				Request: &Request{
+					Query: &Query{
+						Default: map[string]string{"$select": "displayName,mobilePhone"},
+						Remove:  []string{"$expand"},
+					},
+					Headers: &Headers{
+						Set: map[string]string{"X-Client": "external"},
+					},
+				},
+				Response: &Response{
+					Headers: &Headers{
+						Set:    map[string]string{"X-Transformed": "1"},
+						Remove: []string{"X-Internal"},
+					},
+					RemoveFields: []string{"mobilePhone", "manager.mobilePhone"},
+				},
+			},
+			{
+				Methods: []string{"post"},
+				Path:    "^/api/gc/v1/me/events$",
+				Request: &Request{
+					RemoveFields: []string{"attendees.emailAddress.name"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transformer
+}
+
+func newTestRequest(method string, target string, body string, clientID string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if clientID != "" {
+		req = req.WithContext(auth.ContextWithRecord(req.Context(), &auth.Record{
+			AuthenticatedUserID: "user1",
+			StandardClaims:      &jwt.StandardClaims{Audience: clientID},
+		}))
+	}
+
+	return req
+}
+
+func serve(handler proxy.HTTPProxyHandler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	if status, err := handler.ServeHTTP(rec, req); err != nil {
+		http.Error(rec, "", status)
+	}
+
+	return rec
+}
+
+func TestTransformResponse(t *testing.T) {
+	var lastRequest *http.Request
+	var responseBody string
+	handler := newTestTransformer(t).Handler(proxy.HTTPProxyHandlerFunc(func(rw http.ResponseWriter, req *http.Request) (int, error) {
+		lastRequest = req
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.Header().Set("X-Internal", "secret")
+		rw.Header().Set("ETag", `"1"`)
+		rw.Header().Set("Content-Length", "1000")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(responseBody))
+		return 0, nil
+	}))
+
+	responseBody = `{"displayName":"Jonas <x>","mobilePhone":"123","id":12345678901234567890,"manager":{"mobilePhone":"456","displayName":"Boss"}}`
+	rec := serve(handler, newTestRequest(http.MethodGet, "/api/gc/v1/me?$expand=manager", "", "external-app"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if body := rec.Body.String(); body != `{"displayName":"Jonas <x>","id":12345678901234567890,"manager":{"displayName":"Boss"}}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+	if rec.Header().Get("X-Internal") != "" || rec.Header().Get("X-Transformed") != "1" || rec.Header().Get("ETag") != `W/"1"` {
+		t.Errorf("unexpected headers: %v", rec.Header())
+	}
+	if rec.Header().Get("Content-Length") != "86" {
+		t.Errorf("unexpected content length: %s", rec.Header().Get("Content-Length"))
+	}
+	query := lastRequest.URL.Query()
+	if query.Get("$select") != "displayName,mobilePhone" || query.Get("$expand") != "" || lastRequest.Header.Get("X-Client") != "external" {
+		t.Errorf("unexpected request: %s %v", lastRequest.URL, lastRequest.Header)
+	}
+
+	// Collections.
+	responseBody = `{"value":[{"displayName":"a","mobilePhone":"1"},{"displayName":"b","mobilePhone":"2"}]}`
+	rec = serve(handler, newTestRequest(http.MethodGet, "/api/gc/v1/users?$select=displayName", "", "external-app"))
+	if body := rec.Body.String(); body != `{"value":[{"displayName":"a"},{"displayName":"b"}]}` {
+		t.Errorf("unexpected collection body: %s", body)
+	}
+	if lastRequest.URL.Query().Get("$select") != "displayName" {
+		t.Errorf("default query overrode request: %s", lastRequest.URL)
+	}
+
+	// Other clients are not transformed.
+	rec = serve(handler, newTestRequest(http.MethodGet, "/api/gc/v1/users", "", "webapp"))
+	if !strings.Contains(rec.Body.String(), "mobilePhone") || rec.Header().Get("X-Internal") == "" {
+		t.Errorf("response of other client was transformed: %s", rec.Body.String())
+	}
+
+	// Too large responses fail.
+	responseBody = `{"value":"` + strings.Repeat("x", 2048) + `"}`
+	rec = serve(handler, newTestRequest(http.MethodGet, "/api/gc/v1/me", "", "external-app"))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected bad gateway for too large response, got %d", rec.Code)
+	}
+}
+
+func TestTransformResponseStreaming(t *testing.T) {
+	handler := newTestTransformer(t).Handler(proxy.HTTPProxyHandlerFunc(func(rw http.ResponseWriter, req *http.Request) (int, error) {
+		if req.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("accept encoding was not removed")
+		}
+		if req.URL.Path == "/api/gc/v1/me/photo/$value" {
+			rw.Header().Set("Content-Type", "image/png")
+			rw.Write([]byte(strings.Repeat("x", 2048)))
+		} else {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.Write([]byte("gzipped"))
+		}
+		return 0, nil
+	}))
+
+	req := newTestRequest(http.MethodGet, "/api/gc/v1/me/photo/$value", "", "external-app")
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := serve(handler, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 2048 || rec.Header().Get("X-Transformed") != "1" {
+		t.Errorf("unexpected streamed response: %d %d %v", rec.Code, rec.Body.Len(), rec.Header())
+	}
+
+	rec = serve(handler, newTestRequest(http.MethodGet, "/api/gc/v1/me", "", "external-app"))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected bad gateway for encoded response, got %d", rec.Code)
+	}
+}
+
+func TestTransformRequestBody(t *testing.T) {
+	var body string
+	handler := newTestTransformer(t).Handler(proxy.HTTPProxyHandlerFunc(func(rw http.ResponseWriter, req *http.Request) (int, error) {
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+		if req.ContentLength != int64(len(data)) {
+			t.Errorf("unexpected content length: %d", req.ContentLength)
+		}
+		rw.WriteHeader(http.StatusCreated)
+		return 0, nil
+	}))
+
+	rec := serve(handler, newTestRequest(http.MethodPost, "/api/gc/v1/me/events", `{"subject":"a","attendees":[{"emailAddress":{"name":"x","address":"x@example.com"}}]}`, ""))
+	if rec.Code != http.StatusCreated || body != `{"attendees":[{"emailAddress":{"address":"x@example.com"}}],"subject":"a"}` {
+		t.Errorf("unexpected request body: %d %s", rec.Code, body)
+	}
+
+	rec = serve(handler, newTestRequest(http.MethodPost, "/api/gc/v1/me/events", `{"subject":"`+strings.Repeat("x", 2048)+`"}`, ""))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected request entity too large, got %d", rec.Code)
+	}
+
+	rec = serve(handler, newTestRequest(http.MethodPost, "/api/gc/v1/me/events", `{"subject":`, ""))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request for invalid JSON, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,388 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	defaultCompressionEncodings = "br gzip"
+	defaultCompressionMinSize   = 1024
+	defaultCompressionTypes     = "application/json text/plain text/html text/css text/javascript application/javascript image/svg+xml"
+
+	// NOTE: Responses are compressed on the fly, so the brotli
+	// level trades some ratio for speed compared to its default.
+	compressionBrotliLevel = 4
+)
+
+// A compressWriter compresses the data written to it into the writer it was
+// last reset to.
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressEncoders maps the supported content codings to the constructors of
+// their writers.
+var compressEncoders = map[string]func() compressWriter{
+	"br": func() compressWriter {
+		return brotli.NewWriterLevel(nil, compressionBrotliLevel)
+	},
+	"gzip": func() compressWriter {
+		return gzip.NewWriter(nil)
+	},
+}
+
+type compressEncoding struct {
+	name string
+	pool sync.Pool
+}
+
+// compression negotiates the content coding of responses with the
+// Accept-Encoding header of requests and compresses responses of the allowed
+// content types which are at least of the minimum size.
+type compression struct {
+	encodings []*compressEncoding
+	minSize   int
+	types     []string
+}
+
+// newCompression creates a compression with the provided space separated
+// content codings in order of preference and content types. Types ending with
+// /* match all subtypes.
+func newCompression(encodings string, minSize int, types string) (*compression, error) {
+	c := &compression{
+		minSize: minSize,
+		types:   strings.Fields(strings.ToLower(types)),
+	}
+	for _, name := range strings.Fields(strings.ToLower(encodings)) {
+		newWriter, ok := compressEncoders[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported encoding: %v", name)
+		}
+		c.encodings = append(c.encodings, &compressEncoding{
+			name: name,
+			pool: sync.Pool{
+				New: func() interface{} {
+					return newWriter()
+				},
+			},
+		})
+	}
+	if len(c.encodings) == 0 {
+		return nil, errors.New("no encodings")
+	}
+
+	return c, nil
+}
+
+// Handler returns a http.Handler which compresses the responses of the
+// provided handler.
+func (c *compression) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Compressed responses have weak entity tags, which upstreams and
+		// caches compare with their strong ones, so pass them on strong.
+		if values, ok := req.Header["If-None-Match"]; ok {
+			req.Header["If-None-Match"] = strongETags(values)
+		}
+
+		if req.Method == http.MethodHead || isUpgrade(req) {
+			// Nothing to compress, WebSocket and other upgraded connections
+			// take over the connection.
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		cr := &compressResponse{
+			rw:          rw,
+			compression: c,
+			encoding:    c.negotiate(req.Header.Get("Accept-Encoding")),
+		}
+		next.ServeHTTP(cr, req)
+		cr.finish()
+	})
+}
+
+// negotiate returns the encoding with the highest quality value in the
+// provided Accept-Encoding header value, or nil if none is acceptable. Equal
+// quality values are resolved by the configured preference.
+func (c *compression) negotiate(acceptEncoding string) *compressEncoding {
+	if acceptEncoding == "" {
+		return nil
+	}
+
+	accepted := make(map[string]float64)
+	for _, value := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(value, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		accepted[name] = q
+	}
+
+	var best *compressEncoding
+	var bestQ float64
+	for _, encoding := range c.encodings {
+		q, ok := accepted[encoding.name]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best = encoding
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// allowed returns true if the provided content type may be compressed.
+func (c *compression) allowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// strongETags returns the provided If-None-Match header values with weak
+// entity tags made strong. If-None-Match uses weak comparison, so this does
+// not change which representations match.
+func strongETags(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		tags := strings.Split(value, ",")
+		for idx, tag := range tags {
+			tags[idx] = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		}
+		result = append(result, strings.Join(tags, ", "))
+	}
+
+	return result
+}
+
+// isUpgrade returns true if the provided request asks to switch protocols.
+func isUpgrade(req *http.Request) bool {
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// compressResponse is a http.ResponseWriter which buffers the start of the
+// response until it knows whether to compress it. Responses which are already
+// encoded, have a content type which is not allowed or are smaller than the
+// minimum size are written as they are.
+type compressResponse struct {
+	rw          http.ResponseWriter
+	compression *compression
+	encoding    *compressEncoding
+
+	status      int
+	wroteHeader bool
+	decided     bool
+	hijacked    bool
+	eligible    bool
+	buf         []byte
+	writer      compressWriter
+}
+
+func (r *compressResponse) Header() http.Header {
+	return r.rw.Header()
+}
+
+func (r *compressResponse) WriteHeader(status int) {
+	if r.wroteHeader || r.hijacked {
+		return
+	}
+	r.wroteHeader = true
+	r.status = status
+
+	header := r.rw.Header()
+	switch {
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified, status == http.StatusPartialContent:
+	case header.Get("Content-Encoding") != "", header.Get("Content-Range") != "":
+		// Already compressed upstream or a range of the representation.
+	default:
+		r.eligible = true
+	}
+	if !r.eligible {
+		r.decide(false)
+		return
+	}
+
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		if size, err := strconv.ParseInt(contentLength, 10, 64); err == nil {
+			r.decide(size >= int64(r.compression.minSize))
+		}
+	}
+}
+
+func (r *compressResponse) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.decided {
+		if r.writer != nil {
+			return r.writer.Write(p)
+		}
+		return r.rw.Write(p)
+	}
+
+	r.buf = append(r.buf, p...)
+	if len(r.buf) >= r.compression.minSize {
+		if err := r.decide(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// decide writes the header and the buffered data, compressed if requested
+// and the response is of an allowed content type.
+func (r *compressResponse) decide(compress bool) error {
+	if r.decided {
+		return nil
+	}
+	r.decided = true
+
+	header := r.rw.Header()
+	if r.eligible {
+		contentType := header.Get("Content-Type")
+		if contentType == "" && len(r.buf) > 0 {
+			// Sniff now like the http.Server would, since it can not sniff
+			// compressed data.
+			contentType = http.DetectContentType(r.buf)
+			header.Set("Content-Type", contentType)
+		}
+		if r.compression.allowed(contentType) {
+			// The response depends on the Accept-Encoding of the request.
+			header.Add("Vary", "Accept-Encoding")
+			if compress && r.encoding != nil {
+				header.Del("Content-Length")
+				header.Del("Accept-Ranges")
+				header.Set("Content-Encoding", r.encoding.name)
+				// The representation changed, so validators can only be weak.
+				if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+					header.Set("ETag", "W/"+etag)
+				}
+				r.writer = r.encoding.pool.Get().(compressWriter)
+				r.writer.Reset(r.rw)
+			}
+		}
+	}
+	r.rw.WriteHeader(r.status)
+
+	buf := r.buf
+	r.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if r.writer != nil {
+		_, err = r.writer.Write(buf)
+	} else {
+		_, err = r.rw.Write(buf)
+	}
+
+	return err
+}
+
+// Flush implements the http.Flusher interface for streamed responses. Flushing
+// before the minimum size is reached writes the response uncompressed.
+func (r *compressResponse) Flush() {
+	if r.hijacked {
+		return
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.decided {
+		r.decide(len(r.buf) >= r.compression.minSize)
+	}
+	if r.writer != nil {
+		r.writer.Flush()
+	}
+	if flusher, ok := r.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements the http.Hijacker interface.
+func (r *compressResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+
+	return conn, brw, err
+}
+
+// finish writes what is left of the response when the handler is done.
+func (r *compressResponse) finish() {
+	if r.hijacked || !r.wroteHeader {
+		return
+	}
+	if !r.decided {
+		r.decide(len(r.buf) >= r.compression.minSize)
+	}
+	if r.writer != nil {
+		r.writer.Close()
+		r.writer.Reset(nil)
+		r.encoding.pool.Put(r.writer)
+		r.writer = nil
+	}
+}
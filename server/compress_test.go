@@ -0,0 +1,268 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompressionNegotiate(t *testing.T) {
+	c, err := newCompression(defaultCompressionEncodings, defaultCompressionMinSize, defaultCompressionTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br"},
+		{"*;q=0.1, br;q=0", "gzip"},
+		{"zstd", ""},
+		{"gzip;q=0.5, zstd", "gzip"},
+		{"deflate", ""},
+	} {
+		var name string
+		if encoding := c.negotiate(test.acceptEncoding); encoding != nil {
+			name = encoding.name
+		}
+		if name != test.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", test.acceptEncoding, test.expected, name)
+		}
+	}
+
+	if _, err = newCompression("deflate", 0, ""); err == nil {
+		t.Errorf("expected error for unsupported encoding")
+	}
+}
+
+func TestCompressionSettings(t *testing.T) {
+	defer os.Unsetenv("KOPANO_KAPI_ENABLE_COMPRESSION")
+	defer os.Unsetenv("KOPANO_KAPI_COMPRESSION_ENCODINGS")
+	defer os.Unsetenv("KOPANO_KAPI_COMPRESSION_MIN_SIZE")
+	defer os.Unsetenv("KOPANO_KAPI_COMPRESSION_TYPES")
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	for _, test := range []struct {
+		env      map[string]string
+		enabled  bool
+		variable string
+	}{
+		{map[string]string{}, false, ""},
+		{map[string]string{"KOPANO_KAPI_COMPRESSION_ENCODINGS": "deflate"}, false, ""},
+		{map[string]string{"KOPANO_KAPI_ENABLE_COMPRESSION": "1"}, true, ""},
+		{map[string]string{"KOPANO_KAPI_ENABLE_COMPRESSION": "1", "KOPANO_KAPI_COMPRESSION_ENCODINGS": "deflate"}, false, "KOPANO_KAPI_COMPRESSION_ENCODINGS"},
+		{map[string]string{"KOPANO_KAPI_ENABLE_COMPRESSION": "1", "KOPANO_KAPI_COMPRESSION_MIN_SIZE": "-1"}, false, "KOPANO_KAPI_COMPRESSION_MIN_SIZE"},
+		{map[string]string{"KOPANO_KAPI_ENABLE_COMPRESSION": "1", "KOPANO_KAPI_COMPRESSION_MIN_SIZE": "1k"}, false, "KOPANO_KAPI_COMPRESSION_MIN_SIZE"},
+		{map[string]string{"KOPANO_KAPI_ENABLE_COMPRESSION": "1", "KOPANO_KAPI_COMPRESSION_TYPES": " "}, false, "KOPANO_KAPI_COMPRESSION_TYPES"},
+	} {
+		for _, name := range []string{"KOPANO_KAPI_ENABLE_COMPRESSION", "KOPANO_KAPI_COMPRESSION_ENCODINGS", "KOPANO_KAPI_COMPRESSION_MIN_SIZE", "KOPANO_KAPI_COMPRESSION_TYPES"} {
+			os.Unsetenv(name)
+		}
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+
+		s, err := NewServer("127.0.0.1:0", "", nil, nil, logger, nil, &Options{
+			Validator: testTokenValidator{},
+		})
+		if test.variable != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.variable+" ") {
+				t.Errorf("%v: expected error for %s, got %v", test.env, test.variable, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.env, err)
+		}
+		if enabled := s.compression != nil; enabled != test.enabled {
+			t.Errorf("%v: expected compression enabled %v, got %v", test.env, test.enabled, enabled)
+		}
+	}
+}
+
+func TestCompressionHandler(t *testing.T) {
+	c, err := newCompression(defaultCompressionEncodings, 64, defaultCompressionTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat(`{"id":"AAMkAGI2THVSAAA=","subject":"Hello"}`, 20)
+
+	for _, test := range []struct {
+		name           string
+		acceptEncoding string
+		header         http.Header
+		body           string
+		upgrade        bool
+		encoding       string
+		vary           bool
+	}{
+		{"gzip", "gzip", http.Header{"Content-Type": {"application/json"}}, body, false, "gzip", true},
+		{"br", "gzip, br", http.Header{"Content-Type": {"application/json; charset=utf-8"}}, body, false, "br", true},
+		{"not accepted", "", http.Header{"Content-Type": {"application/json"}}, body, false, "", true},
+		{"small", "gzip", http.Header{"Content-Type": {"application/json"}}, `{}`, false, "", true},
+		{"content length", "gzip", http.Header{"Content-Type": {"application/json"}, "Content-Length": {"2"}}, `{}`, false, "", true},
+		{"sniffed", "gzip", http.Header{}, "<html>" + body, false, "gzip", true},
+		{"type", "gzip", http.Header{"Content-Type": {"image/png"}}, body, false, "", false},
+		{"encoded", "gzip", http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"br"}}, body, false, "br", false},
+		{"upgrade", "gzip", http.Header{"Content-Type": {"application/json"}}, body, true, "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			handler := c.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				for name, values := range test.header {
+					rw.Header()[name] = values
+				}
+				rw.Header().Set("ETag", `"1"`)
+				rw.Write([]byte(test.body[:len(test.body)/2]))
+				rw.Write([]byte(test.body[len(test.body)/2:]))
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			if test.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if encoding := rec.Header().Get("Content-Encoding"); encoding != test.encoding {
+				t.Fatalf("expected Content-Encoding %q, got %q", test.encoding, encoding)
+			}
+			if vary := rec.Header().Get("Vary") == "Accept-Encoding"; vary != test.vary {
+				t.Errorf("expected Vary %v, got %v", test.vary, vary)
+			}
+
+			data := rec.Body.Bytes()
+			switch {
+			case test.encoding == test.header.Get("Content-Encoding"):
+				if etag := rec.Header().Get("ETag"); etag != `"1"` {
+					t.Errorf("expected unchanged ETag, got %v", etag)
+				}
+			case test.encoding == "gzip":
+				r, gzipErr := gzip.NewReader(bytes.NewReader(data))
+				if gzipErr != nil {
+					t.Fatal(gzipErr)
+				}
+				data, _ = ioutil.ReadAll(r)
+			case test.encoding == "br":
+				data, _ = ioutil.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+			}
+			if test.encoding != test.header.Get("Content-Encoding") {
+				if etag := rec.Header().Get("ETag"); etag != `W/"1"` {
+					t.Errorf("expected weak ETag, got %v", etag)
+				}
+			}
+			if string(data) != test.body {
+				t.Errorf("unexpected body: %q", data)
+			}
+			if rec.Header().Get("Content-Type") == "" {
+				t.Errorf("expected Content-Type")
+			}
+		})
+	}
+}
+
+func TestCompressionFlush(t *testing.T) {
+	c, err := newCompression(defaultCompressionEncodings, 64, "text/event-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan string, 1)
+	handler := c.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Write([]byte("data: 1\n\n"))
+		rw.(http.Flusher).Flush()
+		flushed <- rw.(*compressResponse).rw.(*httptest.ResponseRecorder).Body.String()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if data := <-flushed; data != "data: 1\n\n" {
+		t.Errorf("expected flushed event, got %q", data)
+	}
+	if !rec.Flushed {
+		t.Errorf("expected flush")
+	}
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("expected no Content-Encoding, got %q", encoding)
+	}
+}
+
+func TestCompressionConditional(t *testing.T) {
+	c, err := newCompression(defaultCompressionEncodings, 64, defaultCompressionTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat(`{"id":"AAMkAGI2THVSAAA=","subject":"Hello"}`, 20)
+	handler := c.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("ETag", `"1"`)
+		if req.Header.Get("If-None-Match") == `"1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Write([]byte(body))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	etag := rec.Header().Get("ETag")
+	if etag != `W/"1"` {
+		t.Fatalf("expected weak ETag, got %v", etag)
+	}
+
+	// The weak entity tag of the compressed response matches upstream.
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("expected status 304, got %d", rec.Code)
+	}
+
+	if tags := strongETags([]string{`W/"1", "2"`, `*`}); tags[0] != `"1", "2"` || tags[1] != `*` {
+		t.Errorf("unexpected strong entity tags: %v", tags)
+	}
+}
@@ -18,7 +18,9 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -26,6 +28,7 @@ import (
 	kcoidc "stash.kopano.io/kc/libkcoidc"
 
 	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins"
 	"stash.kopano.io/kc/kapi/proxy"
 )
 
@@ -34,15 +37,46 @@ func (s *Server) HealthCheckHandler(rw http.ResponseWriter, req *http.Request) {
 	rw.WriteHeader(http.StatusOK)
 }
 
+// HealthReportHandler is a http handler returning the health reports of the
+// plugins which provide them as JSON. The reports include details about the
+// upstreams of plugins, so this handler is not served on the public listener.
+func (s *Server) HealthReportHandler(rw http.ResponseWriter, req *http.Request) {
+	reports := make(map[string]*plugins.HealthV1)
+	for _, p := range s.plugins {
+		reporter, ok := p.(plugins.HealthReporterV1)
+		if !ok {
+			continue
+		}
+		if pluginV1, ok := p.(plugins.PluginV1); ok {
+			reports[pluginV1.Info().ID] = reporter.HealthV1()
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(map[string]interface{}{
+		"plugins": reports,
+	})
+}
+
 // AccessTokenRequired parses incoming bearer authentication and injects the
 // subject of the token into the request as header.
 func (s *Server) AccessTokenRequired(next http.Handler, requiredScopes []string) http.Handler {
+	return s.accessTokenRequired(next, requiredScopes, "")
+}
+
+// accessTokenRequired implements AccessTokenRequired. Service principals are
+// only let through when allowed to access the plugin with the provided ID.
+func (s *Server) accessTokenRequired(next http.Handler, requiredScopes []string, pluginID string) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		var err error
 
 		var standardClaims *jwt.StandardClaims
 		var extraClaims *kcoidc.ExtraClaimsWithType
 		var authenticatedUserID string
+		var servicePrincipal *auth.ServicePrincipal
 
 		// TODO(longsleep): This code should be at a central location. It can
 		// also be found in konnect.
@@ -53,18 +87,17 @@ func (s *Server) AccessTokenRequired(next http.Handler, requiredScopes []string)
 				err = errors.New("invalid Bearer authorization header format")
 				break
 			}
-			authenticatedUserID, standardClaims, extraClaims, err = s.provider.ValidateTokenString(req.Context(), authHeader[1])
+			authenticatedUserID, standardClaims, extraClaims, err = s.validator.ValidateAccessToken(req.Context(), authHeader[1])
 
 		default:
 			err = errors.New("bearer authorization required")
 		}
 
-		if err == nil {
-			if extraClaims != nil && extraClaims.KCTokenType() == kcoidc.TokenTypeKCAccess {
-				// TODO(longsleep): Support cases where the Subject is not a user entry ID.
-				err = extraClaims.Valid()
-			} else {
-				err = errors.New("missing access token claim")
+		if err == nil && standardClaims != nil {
+			// Tokens of the client credentials grant have the client as
+			// subject instead of a user entry ID.
+			if clientID := auth.ClientIDFromClaims(standardClaims.Audience, extraClaims); clientID != "" && clientID == authenticatedUserID {
+				servicePrincipal, err = s.servicePrincipal(clientID, pluginID)
 			}
 		}
 
@@ -73,11 +106,27 @@ func (s *Server) AccessTokenRequired(next http.Handler, requiredScopes []string)
 			err = kcoidc.RequireScopesInClaims(extraClaims, requiredScopes)
 		}
 
+		if err == nil && servicePrincipal != nil {
+			// Service clients can only use their allowed scopes, also on
+			// routes which require none.
+			scopes := append([]string(nil), requiredScopes...)
+			if extraClaims != nil {
+				for scope := range auth.KCAuthorizedScopesFromClaims(extraClaims) {
+					scopes = append(scopes, scope)
+				}
+			}
+			if !servicePrincipal.AllowsScopes(scopes) {
+				err = errors.New("scopes not allowed for service client")
+			}
+		}
+
 		if err == nil && authenticatedUserID != "" {
 			req = req.WithContext(auth.ContextWithRecord(req.Context(), &auth.Record{
 				AuthenticatedUserID: authenticatedUserID,
 				StandardClaims:      standardClaims,
 				ExtraClaims:         extraClaims,
+
+				ServicePrincipal: servicePrincipal,
 			}))
 		}
 
@@ -91,6 +140,20 @@ func (s *Server) AccessTokenRequired(next http.Handler, requiredScopes []string)
 	})
 }
 
+// servicePrincipal returns the configured service principal of the client
+// with the provided ID, if it is allowed to access the provided plugin.
+func (s *Server) servicePrincipal(clientID string, pluginID string) (*auth.ServicePrincipal, error) {
+	servicePrincipal, ok := s.servicePrincipals[clientID]
+	if !ok {
+		return nil, errors.New("unknown service client")
+	}
+	if !servicePrincipal.AllowsPlugin(pluginID) {
+		return nil, fmt.Errorf("service client not allowed for plugin %s", pluginID)
+	}
+
+	return servicePrincipal, nil
+}
+
 // HandleWithProxy returns a http handler to proxy requests to workers using the
 // provided proxy.
 func (s *Server) HandleWithProxy(proxy proxy.HTTPProxyHandler, next http.Handler) http.Handler {
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/plugins"
+)
+
+type testHealthPlugin struct {
+	testPlugin
+}
+
+func (p *testHealthPlugin) HealthV1() *plugins.HealthV1 {
+	return &plugins.HealthV1{
+		Healthy: true,
+		Details: map[string]int{"upstreams": 2},
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	s := &Server{
+		plugins: []plugins.Plugin{
+			&testHealthPlugin{testPlugin{info: &plugins.InfoV1{ID: "test"}}},
+		},
+	}
+
+	rw := httptest.NewRecorder()
+	s.HealthCheckHandler(rw, httptest.NewRequest(http.MethodGet, "/health-check", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected health check status: %d", rw.Code)
+	}
+	if rw.Body.Len() != 0 {
+		t.Errorf("health check must not expose details: %s", rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	s.HealthReportHandler(rw, httptest.NewRequest(http.MethodGet, "/health-report", nil))
+	var report struct {
+		Plugins map[string]*plugins.HealthV1 `json:"plugins"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if health := report.Plugins["test"]; health == nil || !health.Healthy || health.Details == nil {
+		t.Errorf("unexpected health report: %s", rw.Body.String())
+	}
+}
+
+type testTokenValidator map[string][]interface{}
+
+func (v testTokenValidator) ValidateAccessToken(ctx context.Context, token string) (string, *jwt.StandardClaims, *kcoidc.ExtraClaimsWithType, error) {
+	scopes, ok := v[token]
+	if !ok {
+		return "", nil, nil, errors.New("invalid token")
+	}
+
+	return token, &jwt.StandardClaims{
+		Subject:  token,
+		Audience: token,
+	}, &kcoidc.ExtraClaimsWithType{
+		auth.AuthorizedScopesClaim: scopes,
+	}, nil
+}
+
+func TestAccessTokenRequiredServicePrincipal(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	s := &Server{
+		logger: logger,
+		validator: testTokenValidator{
+			"allowed":   []interface{}{"kvs"},
+			"forbidden": []interface{}{"kvs", "admin"},
+			"unknown":   []interface{}{"kvs"},
+		},
+		servicePrincipals: auth.ServicePrincipals{
+			"allowed":   {ClientID: "allowed", Scopes: []string{"kvs"}, Plugins: []string{"*"}},
+			"forbidden": {ClientID: "forbidden", Scopes: []string{"kvs"}, Plugins: []string{"*"}},
+		},
+	}
+
+	for _, requiredScopes := range [][]string{nil, {"kvs"}} {
+		handler := s.accessTokenRequired(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}), requiredScopes, "test")
+
+		for token, expected := range map[string]int{
+			"allowed":   http.StatusOK,
+			"forbidden": http.StatusForbidden,
+			"unknown":   http.StatusForbidden,
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			if rw.Code != expected {
+				t.Errorf("token %s with required scopes %v: expected status %d, got %d", token, requiredScopes, expected, rw.Code)
+			}
+		}
+	}
+}
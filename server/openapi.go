@@ -0,0 +1,126 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"stash.kopano.io/kc/kapi/openapi"
+	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/version"
+)
+
+const (
+	openAPIDocumentPath  = "/api/openapi.json"
+	openAPISwaggerUIPath = "/api/openapi/"
+)
+
+var swaggerUITemplate = template.Must(template.New("swagger-ui").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Kopano API</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@3/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@3/swagger-ui-bundle.js"></script>
+	<script>
+		window.ui = SwaggerUIBundle({
+			url: {{.}},
+			dom_id: '#swagger-ui'
+		});
+	</script>
+</body>
+</html>
+`))
+
+// initializeOpenAPI merges the OpenAPI document fragments of all loaded
+// plugins into the server OpenAPI document.
+func (s *Server) initializeOpenAPI() error {
+	doc := openapi.New(&openapi.Info{
+		Title:   "Kopano API",
+		Version: version.Version,
+	})
+
+	if s.iss != nil {
+		// All plugins use the same OpenID Connect issuer for authentication.
+		scheme, err := json.Marshal(map[string]string{
+			"type":             "openIdConnect",
+			"openIdConnectUrl": strings.TrimSuffix(s.iss.String(), "/") + "/.well-known/openid-configuration",
+		})
+		if err != nil {
+			return err
+		}
+		doc.Components = &openapi.Components{
+			SecuritySchemes: map[string]json.RawMessage{
+				"oidc": scheme,
+			},
+		}
+	}
+
+	for _, plugin := range s.plugins {
+		provider, ok := plugin.(plugins.OpenAPIProviderV1)
+		if !ok {
+			continue
+		}
+		fragment, err := provider.OpenAPIV1()
+		if err != nil {
+			return fmt.Errorf("failed to get OpenAPI document of plugin %T: %v", plugin, err)
+		}
+		if err = doc.Merge(fragment); err != nil {
+			return fmt.Errorf("failed to merge OpenAPI document of plugin %T: %v", plugin, err)
+		}
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	s.openAPIDocument = data
+
+	return nil
+}
+
+// OpenAPIHandler is a http handler returning the OpenAPI document of the
+// accociated server.
+func (s *Server) OpenAPIHandler(rw http.ResponseWriter, req *http.Request) {
+	if s.openAPIDocument == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(s.openAPIDocument)
+}
+
+// SwaggerUIHandler is a http handler returning a Swagger UI page for the
+// OpenAPI document of the accociated server.
+func (s *Server) SwaggerUIHandler(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	err := swaggerUITemplate.Execute(rw, openAPIDocumentPath)
+	if err != nil {
+		s.logger.WithError(err).Errorln("failed to render swagger ui")
+	}
+}
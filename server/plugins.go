@@ -18,9 +18,34 @@
 package server
 
 import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
 	"stash.kopano.io/kc/kapi/plugins"
+	"stash.kopano.io/kc/kapi/plugins/external"
 )
 
+// pluginServer is the plugins.ServerV1 passed to a plugin. It binds access
+// checks to the ID of that plugin.
+type pluginServer struct {
+	*Server
+	pluginID string
+}
+
+func (s *Server) pluginServer(pluginID string) *pluginServer {
+	return &pluginServer{
+		Server:   s,
+		pluginID: pluginID,
+	}
+}
+
+// AccessTokenRequired implements the plugins.ServerV1 interface.
+func (ps *pluginServer) AccessTokenRequired(next http.Handler, requiredScopes []string) http.Handler {
+	return ps.Server.accessTokenRequired(next, requiredScopes, ps.pluginID)
+}
+
 func (s *Server) loadPlugins(enabledPlugins []string) error {
 	var enabledPluginsMap map[string]bool
 	if len(enabledPlugins) > 0 {
@@ -30,8 +55,13 @@ func (s *Server) loadPlugins(enabledPlugins []string) error {
 		}
 	}
 
+	registered := plugins.Registered()
+	if err := s.registerExternalPlugins(registered); err != nil {
+		return err
+	}
+
 	loadedPlugins := make(map[string]plugins.Plugin)
-	for id, register := range plugins.Registered() {
+	for id, register := range registered {
 		if enabledPluginsMap != nil {
 			if !enabledPluginsMap[id] {
 				// Skip plugin when not enabled.
@@ -46,14 +76,114 @@ func (s *Server) loadPlugins(enabledPlugins []string) error {
 		loadedPlugins[id] = register()
 	}
 
+	foundPlugins := make([]string, 0, len(enabledPlugins))
 	for _, id := range enabledPlugins {
-		if p, ok := loadedPlugins[id]; ok {
-			s.plugins = append(s.plugins, p)
-			s.logger.WithField("plugin", id).Infoln("plugin registered")
+		if _, ok := loadedPlugins[id]; ok {
+			foundPlugins = append(foundPlugins, id)
 		} else {
 			s.logger.WithField("plugin", id).Warnln("plugin not found")
 		}
 	}
 
+	sortedPlugins, err := sortPlugins(foundPlugins, loadedPlugins)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range sortedPlugins {
+		s.plugins = append(s.plugins, loadedPlugins[id])
+		s.logger.WithField("plugin", id).Infoln("plugin registered")
+	}
+
+	return nil
+}
+
+// registerExternalPlugins adds the external plugins described by the manifests
+// in the accociated server's plugins path to the provided registered plugins.
+func (s *Server) registerExternalPlugins(registered map[string]func() plugins.Plugin) error {
+	if s.pluginsPath == "" {
+		return nil
+	}
+	if fp, err := os.Stat(s.pluginsPath); err != nil || !fp.IsDir() {
+		s.logger.WithField("path", s.pluginsPath).Debugln("plugins path not found, no external plugins")
+		return nil
+	}
+
+	manifests, err := external.LoadManifests(s.pluginsPath)
+	if err != nil {
+		return err
+	}
+	for _, manifest := range manifests {
+		if _, exists := registered[manifest.ID]; exists {
+			return fmt.Errorf("external plugin %s conflicts with already registered plugin", manifest.ID)
+		}
+		m := manifest
+		registered[m.ID] = func() plugins.Plugin {
+			return external.New(m)
+		}
+		s.logger.WithField("plugin", m.ID).Debugln("external plugin found")
+	}
+
 	return nil
 }
+
+// sortPlugins sorts the provided plugin IDs so that every plugin comes after
+// its dependencies. Plugins without dependencies between them keep their
+// relative order.
+func sortPlugins(ids []string, loadedPlugins map[string]plugins.Plugin) ([]string, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+
+	state := make(map[string]int)
+	sorted := make([]string, 0, len(ids))
+	path := make([]string, 0)
+
+	var visit func(id string) error
+	visit = func(id string) error {
+		switch state[id] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("plugin dependency cycle: %s -> %s", strings.Join(path, " -> "), id)
+		}
+
+		state[id] = visiting
+		path = append(path, id)
+
+		if p, ok := loadedPlugins[id].(plugins.PluginV1); ok {
+			info := p.Info()
+			for _, dependency := range info.Dependencies {
+				if _, ok := loadedPlugins[dependency]; !ok {
+					return fmt.Errorf("plugin %s requires plugin %s which is not enabled", id, dependency)
+				}
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+			for _, dependency := range info.OptionalDependencies {
+				if _, ok := loadedPlugins[dependency]; !ok {
+					continue
+				}
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[id] = visited
+		sorted = append(sorted, id)
+
+		return nil
+	}
+
+	for _, id := range ids {
+		if err := visit(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
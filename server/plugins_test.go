@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"stash.kopano.io/kc/kapi/plugins"
+)
+
+type testPlugin struct {
+	info *plugins.InfoV1
+}
+
+func (p *testPlugin) ServeHTTP(rw http.ResponseWriter, req *http.Request) (bool, error) {
+	return false, nil
+}
+
+func (p *testPlugin) Close() error {
+	return nil
+}
+
+func (p *testPlugin) Info() *plugins.InfoV1 {
+	return p.info
+}
+
+func (p *testPlugin) Initialize(ctx context.Context, errCh chan<- error, srv plugins.ServerV1) error {
+	return nil
+}
+
+func newTestPlugins(infos ...*plugins.InfoV1) map[string]plugins.Plugin {
+	loaded := make(map[string]plugins.Plugin)
+	for _, info := range infos {
+		loaded[info.ID] = &testPlugin{info: info}
+	}
+	return loaded
+}
+
+func TestSortPlugins(t *testing.T) {
+	loaded := newTestPlugins(
+		&plugins.InfoV1{ID: "a", Dependencies: []string{"c"}},
+		&plugins.InfoV1{ID: "b"},
+		&plugins.InfoV1{ID: "c", OptionalDependencies: []string{"b", "missing"}},
+		&plugins.InfoV1{ID: "d"},
+	)
+
+	sorted, err := sortPlugins([]string{"d", "a", "b", "c"}, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"d", "b", "c", "a"}; !reflect.DeepEqual(sorted, expected) {
+		t.Fatalf("unexpected order %v, expected %v", sorted, expected)
+	}
+}
+
+func TestSortPluginsMissingDependency(t *testing.T) {
+	loaded := newTestPlugins(
+		&plugins.InfoV1{ID: "a", Dependencies: []string{"missing"}},
+	)
+
+	if _, err := sortPlugins([]string{"a"}, loaded); err == nil {
+		t.Fatal("missing dependency must fail")
+	}
+}
+
+func TestSortPluginsCycle(t *testing.T) {
+	loaded := newTestPlugins(
+		&plugins.InfoV1{ID: "a", Dependencies: []string{"b"}},
+		&plugins.InfoV1{ID: "b", OptionalDependencies: []string{"c"}},
+		&plugins.InfoV1{ID: "c", Dependencies: []string{"a"}},
+	)
+
+	if _, err := sortPlugins([]string{"a", "b", "c"}, loaded); err == nil {
+		t.Fatal("dependency cycle must fail")
+	}
+}
@@ -25,6 +25,9 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -33,6 +36,7 @@ import (
 	"github.com/sirupsen/logrus"
 	kcoidc "stash.kopano.io/kc/libkcoidc"
 
+	"stash.kopano.io/kc/kapi/auth"
 	"stash.kopano.io/kc/kapi/plugins"
 )
 
@@ -45,36 +49,65 @@ type Server struct {
 
 	plugins []plugins.Plugin
 
-	iss      *url.URL
-	provider *kcoidc.Provider
+	services      map[string]interface{}
+	servicesMutex sync.RWMutex
 
-	requestLog bool
+	iss       *url.URL
+	provider  *kcoidc.Provider
+	validator TokenValidator
+	listener  net.Listener
+
+	servicePrincipals auth.ServicePrincipals
+
+	requestLog  bool
+	swaggerUI   bool
+	compression *compression
+
+	openAPIDocument []byte
+}
+
+// Options are optional settings of a Server.
+type Options struct {
+	// Validator validates access tokens instead of the OIDC provider of the
+	// issuer, for example to run the server in tests without an issuer.
+	Validator TokenValidator
+
+	// Listener is used instead of listening on the listen address.
+	Listener net.Listener
 }
 
-// NewServer creates a new Server with the provided parameters.
-func NewServer(listenAddr string, pluginsPath string, iss *url.URL, enabledPlugins []string, logger logrus.FieldLogger, client *http.Client) (*Server, error) {
+// NewServer creates a new Server with the provided parameters. The options
+// can be nil.
+func NewServer(listenAddr string, pluginsPath string, iss *url.URL, enabledPlugins []string, logger logrus.FieldLogger, client *http.Client, options *Options) (*Server, error) {
 	var err error
 
 	if client == nil {
 		client = http.DefaultClient
 	}
-
-	var kcoidcLogger *debugLogger
-	kcoidcDebug := os.Getenv("KCOIDC_DEBUG") == "1"
-	if kcoidcDebug && logger != nil {
-		kcoidcLogger = &debugLogger{
-			logger: logger,
-			prefix: "kcoidc debug ",
-		}
+	if options == nil {
+		options = &Options{}
 	}
+
 	var provider *kcoidc.Provider
-	if kcoidcLogger != nil {
-		provider, err = kcoidc.NewProvider(client, kcoidcLogger, kcoidcDebug)
-	} else {
-		provider, err = kcoidc.NewProvider(client, nil, kcoidcDebug)
-	}
-	if err != nil {
-		return nil, fmt.Errorf("failed to create kcoidc provider for server: %v", err)
+	validator := options.Validator
+	if validator == nil {
+		var kcoidcLogger *debugLogger
+		kcoidcDebug := os.Getenv("KCOIDC_DEBUG") == "1"
+		if kcoidcDebug && logger != nil {
+			kcoidcLogger = &debugLogger{
+				logger: logger,
+				prefix: "kcoidc debug ",
+			}
+		}
+		if kcoidcLogger != nil {
+			provider, err = kcoidc.NewProvider(client, kcoidcLogger, kcoidcDebug)
+		} else {
+			provider, err = kcoidc.NewProvider(client, nil, kcoidcDebug)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kcoidc provider for server: %v", err)
+		}
+		validator = &providerTokenValidator{provider: provider}
 	}
 
 	s := &Server{
@@ -85,10 +118,50 @@ func NewServer(listenAddr string, pluginsPath string, iss *url.URL, enabledPlugi
 
 		plugins: make([]plugins.Plugin, 0),
 
-		iss:      iss,
-		provider: provider,
+		services: make(map[string]interface{}),
+
+		iss:       iss,
+		provider:  provider,
+		validator: validator,
+		listener:  options.Listener,
 
 		requestLog: os.Getenv("KOPANO_DEBUG_SERVER_REQUEST_LOG") == "1",
+		swaggerUI:  os.Getenv("KOPANO_KAPI_ENABLE_SWAGGER_UI") == "1",
+	}
+
+	if fn := os.Getenv("KOPANO_KAPI_SERVICE_CLIENTS"); fn != "" {
+		s.servicePrincipals, err = auth.LoadServicePrincipals(fn)
+		if err != nil {
+			return nil, fmt.Errorf("KOPANO_KAPI_SERVICE_CLIENTS value is invalid: %v", err)
+		}
+		logger.WithField("clients", len(s.servicePrincipals)).Infoln("service clients enabled")
+	}
+
+	if os.Getenv("KOPANO_KAPI_ENABLE_COMPRESSION") == "1" {
+		compressionEncodings := defaultCompressionEncodings
+		if v := os.Getenv("KOPANO_KAPI_COMPRESSION_ENCODINGS"); v != "" {
+			compressionEncodings = v
+		}
+		compressionMinSize := defaultCompressionMinSize
+		if v := os.Getenv("KOPANO_KAPI_COMPRESSION_MIN_SIZE"); v != "" {
+			if compressionMinSize, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("KOPANO_KAPI_COMPRESSION_MIN_SIZE value is invalid: %v", err)
+			}
+			if compressionMinSize < 0 {
+				return nil, fmt.Errorf("KOPANO_KAPI_COMPRESSION_MIN_SIZE value is invalid: must not be negative")
+			}
+		}
+		compressionTypes := defaultCompressionTypes
+		if v := os.Getenv("KOPANO_KAPI_COMPRESSION_TYPES"); v != "" {
+			if len(strings.Fields(v)) == 0 {
+				return nil, fmt.Errorf("KOPANO_KAPI_COMPRESSION_TYPES value is invalid: no types")
+			}
+			compressionTypes = v
+		}
+		if s.compression, err = newCompression(compressionEncodings, compressionMinSize, compressionTypes); err != nil {
+			return nil, fmt.Errorf("KOPANO_KAPI_COMPRESSION_ENCODINGS value is invalid: %v", err)
+		}
+		logger.WithField("encodings", compressionEncodings).Infoln("response compression enabled")
 	}
 
 	if enabledPlugins != nil {
@@ -107,6 +180,12 @@ func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	case path == "/health-check":
 		s.HealthCheckHandler(rw, req)
 
+	case path == openAPIDocumentPath:
+		s.OpenAPIHandler(rw, req)
+
+	case s.swaggerUI && path == openAPISwaggerUIPath:
+		s.SwaggerUIHandler(rw, req)
+
 	default:
 		// Try all registered plugins.
 		for _, p := range s.plugins {
@@ -169,6 +248,16 @@ func (s *Server) Logger() logrus.FieldLogger {
 	return s.logger
 }
 
+// drainPlugins lets all plugins which support it end their long lived
+// connections, which would otherwise delay or break the clean shutdown.
+func (s *Server) drainPlugins() {
+	for _, plugin := range s.plugins {
+		if drainer, ok := plugin.(plugins.DrainerV1); ok {
+			drainer.DrainV1()
+		}
+	}
+}
+
 // Serve is the accociated Server's main blocking runner.
 func (s *Server) Serve(ctx context.Context) error {
 	serveCtx, serveCtxCancel := context.WithCancel(ctx)
@@ -184,7 +273,7 @@ func (s *Server) Serve(ctx context.Context) error {
 	for _, plugin := range s.plugins {
 		switch p := plugin.(type) {
 		case plugins.PluginV1:
-			if pluginErr := p.Initialize(serveCtx, errCh, s); pluginErr != nil {
+			if pluginErr := p.Initialize(serveCtx, errCh, s.pluginServer(p.Info().ID)); pluginErr != nil {
 				return fmt.Errorf("failed to initialize plugin %T: %v", p, pluginErr)
 			}
 		default:
@@ -192,27 +281,41 @@ func (s *Server) Serve(ctx context.Context) error {
 		}
 	}
 
-	// OpenID Connect.
-	err := s.provider.Initialize(serveCtx, s.iss)
-	if err != nil {
-		return fmt.Errorf("OIDC provider initialization error: %v", err)
+	// OpenAPI.
+	if openAPIErr := s.initializeOpenAPI(); openAPIErr != nil {
+		return fmt.Errorf("OpenAPI initialization error: %v", openAPIErr)
 	}
-	if errOIDCInitialize := s.provider.WaitUntilReady(serveCtx, 10*time.Second); errOIDCInitialize != nil {
-		// NOTE(longsleep): Do not treat this as error - just log.
-		logger.WithError(errOIDCInitialize).WithField("iss", s.iss).Warnf("failed to initialize OIDC provider")
-	} else {
-		logger.WithField("iss", s.iss).Debugln("OIDC provider initialized")
+
+	// OpenID Connect, unless replaced.
+	if s.provider != nil {
+		if err := s.provider.Initialize(serveCtx, s.iss); err != nil {
+			return fmt.Errorf("OIDC provider initialization error: %v", err)
+		}
+		if errOIDCInitialize := s.provider.WaitUntilReady(serveCtx, 10*time.Second); errOIDCInitialize != nil {
+			// NOTE(longsleep): Do not treat this as error - just log.
+			logger.WithError(errOIDCInitialize).WithField("iss", s.iss).Warnf("failed to initialize OIDC provider")
+		} else {
+			logger.WithField("iss", s.iss).Debugln("OIDC provider initialized")
+		}
 	}
 
 	// HTTP listener.
+	var handler http.Handler = s
+	if s.compression != nil {
+		handler = s.compression.Handler(handler)
+	}
 	srv := &http.Server{
-		Handler: s.AddContext(serveCtx, s),
+		Handler: s.AddContext(serveCtx, handler),
 	}
-
-	logger.WithField("listenAddr", s.listenAddr).Infoln("starting http listener")
-	listener, err := net.Listen("tcp", s.listenAddr)
-	if err != nil {
-		return err
+	srv.RegisterOnShutdown(s.drainPlugins)
+
+	listener := s.listener
+	if listener == nil {
+		logger.WithField("listenAddr", s.listenAddr).Infoln("starting http listener")
+		var err error
+		if listener, err = net.Listen("tcp", s.listenAddr); err != nil {
+			return err
+		}
 	}
 
 	logger.Infoln("ready to handle requests")
@@ -229,23 +332,29 @@ func (s *Server) Serve(ctx context.Context) error {
 
 	// Wait for exit or error.
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalCh)
+	var err error
 	select {
 	case err = <-errCh:
 		// breaks
 	case reason := <-signalCh:
 		logger.WithField("signal", reason).Warnln("received signal")
 		// breaks
+	case <-ctx.Done():
+		// breaks
 	}
 
 	// Shutdown, server will stop to accept new connections, requires Go 1.8+.
 	logger.Infoln("clean server shutdown start")
-	shutDownCtx, shutDownCtxCancel := context.WithTimeout(ctx, 10*time.Second)
+	// NOTE: The shutdown gets its own context, as ctx might be done already.
+	shutDownCtx, shutDownCtxCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	if shutdownErr := srv.Shutdown(shutDownCtx); shutdownErr != nil {
 		logger.WithError(shutdownErr).Warn("clean server shutdown failed")
 	}
 
-	// Close plugins.
-	for _, p := range s.plugins {
+	// Close plugins, in reverse initialization order.
+	for idx := len(s.plugins) - 1; idx >= 0; idx-- {
+		p := s.plugins[idx]
 		if closeErr := p.Close(); closeErr != nil {
 			logger.WithError(err).Debugf("failed to close plugin %T: %v", p, closeErr)
 		}
@@ -0,0 +1,294 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package servertest runs Kopano API server in-process for tests of plugins,
+// with a fake validator of access tokens and fake upstreams on unix sockets.
+package servertest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+	"stash.kopano.io/kgol/rndm"
+
+	"stash.kopano.io/kc/kapi/auth"
+	"stash.kopano.io/kc/kapi/server"
+)
+
+// Token describes an access token of the fake TokenValidator.
+type Token struct {
+	// Subject is the authenticated user ID of the token.
+	Subject string
+	// UserEntryID and Username are the identity claims of Kopano Konnect.
+	UserEntryID string
+	Username    string
+	// Scopes are the authorized scopes of the token.
+	Scopes []string
+	// ClientID is the client to which the token was issued. Tokens with the
+	// client as subject are client credentials tokens.
+	ClientID string
+}
+
+// TokenValidator is a server.TokenValidator which accepts the tokens which
+// were added to it.
+type TokenValidator struct {
+	mutex  sync.RWMutex
+	tokens map[string]*Token
+}
+
+// NewTokenValidator creates a TokenValidator without tokens.
+func NewTokenValidator() *TokenValidator {
+	return &TokenValidator{
+		tokens: make(map[string]*Token),
+	}
+}
+
+// AddToken adds the provided token to the accociated validator and returns
+// its random token string.
+func (v *TokenValidator) AddToken(token *Token) string {
+	s := rndm.GenerateRandomString(32)
+
+	v.mutex.Lock()
+	v.tokens[s] = token
+	v.mutex.Unlock()
+
+	return s
+}
+
+// ValidateAccessToken implements the server.TokenValidator interface.
+func (v *TokenValidator) ValidateAccessToken(ctx context.Context, s string) (string, *jwt.StandardClaims, *kcoidc.ExtraClaimsWithType, error) {
+	v.mutex.RLock()
+	token, ok := v.tokens[s]
+	v.mutex.RUnlock()
+	if !ok {
+		return "", nil, nil, errors.New("unknown token")
+	}
+
+	standardClaims := &jwt.StandardClaims{
+		Subject:   token.Subject,
+		Audience:  token.ClientID,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	scopes := make([]interface{}, 0, len(token.Scopes))
+	for _, scope := range token.Scopes {
+		scopes = append(scopes, scope)
+	}
+	extraClaims := &kcoidc.ExtraClaimsWithType{
+		auth.AuthorizedScopesClaim: scopes,
+		auth.AuthorizedPartyClaim:  token.ClientID,
+	}
+	if token.UserEntryID != "" || token.Username != "" {
+		(*extraClaims)[auth.IdentityClaim] = map[string]interface{}{
+			auth.IdentifiedUserIDClaim:   token.UserEntryID,
+			auth.IdentifiedUsernameClaim: token.Username,
+		}
+	}
+
+	return token.Subject, standardClaims, extraClaims, nil
+}
+
+// Server is a Kopano API server listening on a random local port.
+type Server struct {
+	*server.Server
+
+	// URL is the base URL of the server, like http://127.0.0.1:12345.
+	URL string
+	// Validator validates the access tokens of requests to the server.
+	Validator *TokenValidator
+
+	cancel context.CancelFunc
+	done   chan error
+}
+
+// NewServer starts a Kopano API server with the provided plugins and waits
+// until it is ready. Plugins are configured as usual with environment
+// variables, which must be set before. The test fails if the server cannot
+// be started.
+func NewServer(t testing.TB, enabledPlugins []string) *Server {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	if !testing.Verbose() {
+		logger.SetOutput(ioutil.Discard)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	validator := NewTokenValidator()
+	srv, err := server.NewServer("127.0.0.1:0", "", &url.URL{Scheme: "https", Host: "issuer.test"}, enabledPlugins, logger, nil, &server.Options{
+		Validator: validator,
+		Listener:  listener,
+	})
+	if err != nil {
+		listener.Close()
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	s := &Server{
+		Server:    srv,
+		URL:       "http://" + listener.Addr().String(),
+		Validator: validator,
+
+		done: make(chan error, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go func() {
+		s.done <- srv.Serve(ctx)
+	}()
+
+	// Wait until ready.
+	for start := time.Now(); ; {
+		response, err := http.Get(s.URL + "/health-check")
+		if err == nil {
+			response.Body.Close()
+			break
+		}
+		select {
+		case serveErr := <-s.done:
+			t.Fatalf("server failed: %v", serveErr)
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Since(start) > 10*time.Second {
+			s.Close()
+			t.Fatalf("server not ready: %v", err)
+		}
+	}
+
+	return s
+}
+
+// NewRequest returns a request to the provided path of the accociated server,
+// with the provided access token if not empty.
+func (s *Server) NewRequest(method string, path string, token string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		panic(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req
+}
+
+// Close stops the accociated server and waits until it is done.
+func (s *Server) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Upstream is a fake upstream HTTP server listening on a unix socket, like
+// the workers of Kopano Groupware REST.
+type Upstream struct {
+	// SocketPath is the path of the unix socket of the upstream.
+	SocketPath string
+
+	requests int64
+	server   *http.Server
+}
+
+// NewUpstream starts a fake upstream with the provided handler on a unix
+// socket with the provided name in the provided directory. The response
+// header X-Upstream is set to the name.
+func NewUpstream(t testing.TB, dir string, name string, handler http.Handler) *Upstream {
+	socketPath := filepath.Join(dir, name)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+
+	u := &Upstream{
+		SocketPath: socketPath,
+	}
+	u.server = &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&u.requests, 1)
+			rw.Header().Set("X-Upstream", name)
+			handler.ServeHTTP(rw, req)
+		}),
+	}
+	go u.server.Serve(listener)
+
+	return u
+}
+
+// Requests returns the number of requests which the accociated upstream
+// received.
+func (u *Upstream) Requests() int64 {
+	return atomic.LoadInt64(&u.requests)
+}
+
+// Close stops the accociated upstream and removes its socket, as workers do
+// when they exit.
+func (u *Upstream) Close() {
+	u.server.Close()
+	os.Remove(u.SocketPath)
+}
+
+// TempDir creates a temporary directory and returns it with a function to
+// remove it.
+func TempDir(t testing.TB) (string, func()) {
+	dir, err := ioutil.TempDir("", "kapi-servertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// Setenv sets the provided environment variables and returns a function to
+// restore their previous values.
+func Setenv(values map[string]string) func() {
+	previous := make(map[string]*string, len(values))
+	for key, value := range values {
+		if v, ok := os.LookupEnv(key); ok {
+			previous[key] = &v
+		} else {
+			previous[key] = nil
+		}
+		os.Setenv(key, value)
+	}
+
+	return func() {
+		for key, v := range previous {
+			if v == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *v)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"fmt"
+)
+
+// RegisterService registers the provided service with the provided id, so
+// other plugins can look it up.
+func (s *Server) RegisterService(id string, service interface{}) error {
+	s.servicesMutex.Lock()
+	defer s.servicesMutex.Unlock()
+
+	if _, exists := s.services[id]; exists {
+		return fmt.Errorf("service %s is already registered", id)
+	}
+	s.services[id] = service
+	s.logger.WithField("service", id).Debugln("service registered")
+
+	return nil
+}
+
+// LookupService returns the service registered with the provided id.
+func (s *Server) LookupService(id string) (interface{}, bool) {
+	s.servicesMutex.RLock()
+	defer s.servicesMutex.RUnlock()
+
+	service, ok := s.services[id]
+	return service, ok
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2020 Kopano and its licensors
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License, version 3,
+ * as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/dgrijalva/jwt-go"
+	kcoidc "stash.kopano.io/kc/libkcoidc"
+)
+
+// TokenValidator validates bearer access tokens. It returns the authenticated
+// user ID and the claims of valid access tokens.
+type TokenValidator interface {
+	ValidateAccessToken(ctx context.Context, token string) (string, *jwt.StandardClaims, *kcoidc.ExtraClaimsWithType, error)
+}
+
+// providerTokenValidator validates access tokens with the OIDC provider of
+// the server.
+type providerTokenValidator struct {
+	provider *kcoidc.Provider
+}
+
+// ValidateAccessToken implements the TokenValidator interface.
+func (v *providerTokenValidator) ValidateAccessToken(ctx context.Context, token string) (string, *jwt.StandardClaims, *kcoidc.ExtraClaimsWithType, error) {
+	authenticatedUserID, standardClaims, extraClaims, err := v.provider.ValidateTokenString(ctx, token)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if extraClaims == nil || extraClaims.KCTokenType() != kcoidc.TokenTypeKCAccess {
+		return "", nil, nil, errors.New("missing access token claim")
+	}
+	if err = extraClaims.Valid(); err != nil {
+		return "", nil, nil, err
+	}
+
+	return authenticatedUserID, standardClaims, extraClaims, nil
+}